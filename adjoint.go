@@ -0,0 +1,208 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+
+	"github.com/ctessum/geom"
+)
+
+// A Receptor is a quantity of interest that depends linearly on the
+// steady-state concentrations, such as the population-weighted
+// concentration in a region. It returns the derivative of the quantity
+// with respect to the concentration of each pollutant in PolNames
+// in each grid cell, indexed as [cell][pollutant].
+type Receptor func(d *InMAP) ([][]float64, error)
+
+// PopulationWeightedReceptor returns a Receptor for the ground-level
+// concentration of output variable variable (for example, "Total PM2.5")
+// weighted by population type popType in the grid cells whose centers are
+// within region. If region is nil, all of the grid cells are included.
+func PopulationWeightedReceptor(variable, popType string, region geom.Polygonal) Receptor {
+	return func(d *InMAP) ([][]float64, error) {
+		conv, i, err := receptorVariables(d, variable, popType)
+		if err != nil {
+			return nil, err
+		}
+		w := make([][]float64, len(d.cells))
+		var totalPop float64
+		for j, c := range d.cells {
+			w[j] = make([]float64, len(PolNames))
+			if !inReceptorRegion(c, region) {
+				continue
+			}
+			totalPop += c.PopData[i]
+			for k, ii := range conv.index {
+				w[j][ii] += c.PopData[i] * conv.conversion[k] * conv.fractionIn(c)
+			}
+		}
+		if totalPop == 0 {
+			return nil, fmt.Errorf("inmap: there is no %s population in the receptor region", popType)
+		}
+		for _, wc := range w {
+			for ii := range wc {
+				wc[ii] /= totalPop
+			}
+		}
+		return w, nil
+	}
+}
+
+// DeathsReceptor returns a Receptor for the number of deaths caused by
+// Total PM2.5 among population type popType in the grid cells whose centers
+// are within region, or in all grid cells if region is nil, calculated
+// with concentration–response function cr in the same way as
+// the output variables added by SetHealthImpacts. Because cr is not
+// generally linear, it is linearized about the current concentrations
+// using its analytic derivative, which must be known.
+func DeathsReceptor(popType string, cr ConcentrationResponse, region geom.Polygonal) Receptor {
+	return func(d *InMAP) ([][]float64, error) {
+		const variable = "Total PM2.5"
+		conv, i, err := receptorVariables(d, variable, popType)
+		if err != nil {
+			return nil, err
+		}
+		if cr.RR == nil || cr.DRR == nil {
+			return nil, fmt.Errorf("inmap: deaths receptor concentration–response function '%s' has no derivative", cr.Name)
+		}
+		w := make([][]float64, len(d.cells))
+		for j, c := range d.cells {
+			w[j] = make([]float64, len(PolNames))
+			if !inReceptorRegion(c, region) {
+				continue
+			}
+			base := c.getValue("Baseline Total PM2.5", nil)
+			conc := c.getValue(variable, d.popIndices)
+			dDeaths := c.PopData[i] * c.MortalityRate / 100000 * cr.DRR(base+conc) / cr.RR(base)
+			for k, ii := range conv.index {
+				w[j][ii] += dDeaths * conv.conversion[k] * conv.fractionIn(c)
+			}
+		}
+		return w, nil
+	}
+}
+
+// receptorVariables returns the pollutants and conversions that make up
+// output variable variable and the index of population type popType.
+func receptorVariables(d *InMAP, variable, popType string) (polConv, int, error) {
+	conv, ok := PolLabels[variable]
+	if !ok {
+		return polConv{}, 0, fmt.Errorf("inmap: receptor variable %s is not a concentration output variable", variable)
+	}
+	i, ok := d.popIndices[popType]
+	if !ok {
+		return polConv{}, 0, fmt.Errorf("inmap: receptor population type %s is not in the population data", popType)
+	}
+	return conv, i, nil
+}
+
+// inReceptorRegion returns whether c is a ground-level cell whose
+// center is within region.
+func inReceptorRegion(c *Cell, region geom.Polygonal) bool {
+	if c.Layer != 0 {
+		return false
+	}
+	return region == nil || c.Centroid().Within(region) != geom.Outside
+}
+
+// Adjoint calculates the sensitivity of receptor to the emissions of each
+// pollutant in EmisNames in each grid cell, in units of the receptor per μg/s
+// of emissions. The results are in the same form as those of Results,
+// with the names of the emitted pollutants as keys.
+//
+// Rather than calculating the steady-state concentrations caused by the
+// emissions in each grid cell separately, the adjoint (transpose) of the
+// steady-state system of equations solved by LinearSteadyState is
+// solved once using the same method, with the derivatives of the receptor
+// with respect to the concentrations as the right-hand side.
+// The sensitivities therefore apply to the steady state found by
+// LinearSteadyState with the same funcs, tolerance, and maxIterations.
+// The sensitivity of emissions released above the ground level
+// is included in the grid cells in the layer they are released into.
+func (d *InMAP) Adjoint(receptor Receptor, tolerance float64, maxIterations int, funcs ...CellManipulator) (map[string][]float64, error) {
+	if d.maxTimestepClass > 0 {
+		return nil, fmt.Errorf("inmap: the adjoint solver does not support multiple time step classes")
+	}
+	w, err := receptor(d)
+	if err != nil {
+		return nil, err
+	}
+	S, _, err := d.steadyStateSystem(funcs)
+	if err != nil {
+		return nil, err
+	}
+	n := len(PolNames)
+	b := make([]float64, len(d.cells)*n)
+	for i, wc := range w {
+		copy(b[i*n:], wc)
+	}
+	ST := S.transpose()
+	λ := make([]float64, len(b))
+	if err = bicgstab(ST, b, λ, tolerance, maxIterations, func(int, float64) {}); err != nil {
+		return nil, err
+	}
+	// Emissions are added before the other calculations in each time step,
+	// so the sensitivity to the emission flux is Δt·Sᵀλ, where S is the
+	// change over one time step. ST.mulVec calculates (I - S)ᵀλ = λ - Sᵀλ,
+	// which approximates the receptor weights b, and subtracting it from λ
+	// leaves Sᵀλ.
+	dEmis := make([]float64, len(λ))
+	ST.mulVec(λ, dEmis)
+	for i, v := range dEmis {
+		dEmis[i] = d.Dt * (λ[i] - v)
+	}
+
+	o := make(map[string][]float64, len(EmisNames))
+	for k, e := range emissions {
+		s := make([]float64, len(d.cells))
+		for i, c := range d.cells {
+			fluxScale := 1. / c.Dx / c.Dy / c.Dz // μg/s to μg/m³/s
+			s[i] = dEmis[i*n+e.species] * e.conversion * fluxScale
+		}
+		o[EmisNames[k]] = s
+	}
+	return o, nil
+}
+
+// transpose returns the transpose of m.
+func (m *sparseMatrix) transpose() *sparseMatrix {
+	nRows := len(m.rowPtr) - 1
+	t := &sparseMatrix{
+		rowPtr: make([]int, nRows+1),
+		cols:   make([]int, len(m.cols)),
+		vals:   make([]float64, len(m.vals)),
+	}
+	for _, c := range m.cols {
+		t.rowPtr[c+1]++
+	}
+	for r := 0; r < nRows; r++ {
+		t.rowPtr[r+1] += t.rowPtr[r]
+	}
+	next := append([]int{}, t.rowPtr[:nRows]...)
+	for r := 0; r < nRows; r++ {
+		for k := m.rowPtr[r]; k < m.rowPtr[r+1]; k++ {
+			c := m.cols[k]
+			t.cols[next[c]] = r
+			t.vals[next[c]] = m.vals[k]
+			next[c]++
+		}
+	}
+	return t
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// The receptor value calculated from the adjoint sensitivities should
+// equal the value calculated from the forward steady-state solution.
+func TestAdjoint(t *testing.T) {
+	const (
+		testTolerance   = 1.e-5
+		solverTolerance = 1.e-10
+		maxIterations   = 1000
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emisLocation := geom.Point{X: -3999, Y: -3999.}
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: emisLocation,
+	}) // ground level emissions
+
+	funcs := []CellManipulator{UpwindAdvection(), Mixing(), MeanderMixing(),
+		DryDeposition(), WetDeposition(), Chemistry()}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			LinearSteadyState(solverTolerance, maxIterations, nil, funcs...),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	receptor := PopulationWeightedReceptor("Total PM2.5", "TotalPop", nil)
+	sensitivity, err := d.Adjoint(receptor, solverTolerance, maxIterations, funcs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var adjoint float64
+	for _, s := range sensitivity {
+		for i, c := range d.cells {
+			if c.Layer == 0 {
+				adjoint += s[i] * E * calcWeightFactor(emisLocation, c)
+			}
+		}
+	}
+
+	if err = d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := receptor(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forward float64
+	for i, c := range d.cells {
+		for ii, v := range c.Cf {
+			forward += w[i][ii] * v
+		}
+	}
+	if forward == 0 {
+		t.Fatal("forward receptor value is zero")
+	}
+	if different(forward, adjoint, testTolerance) {
+		t.Errorf("adjoint receptor value %g != forward value %g", adjoint, forward)
+	}
+}
+
+func TestDeathsReceptor(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, NewEmissions()),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.cells {
+		c.Cf[iPM2_5] = 1
+	}
+	cr := LogLinear("test", 0.01)
+	w, err := DeathsReceptor("TotalPop", cr, nil)(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := popIndices["TotalPop"]
+	for j, c := range d.cells {
+		var want float64
+		if c.Layer == 0 {
+			// The log-linear derivative relative to the baseline risk is β·RR(ΔC).
+			want = c.PopData[i] * c.MortalityRate / 100000 * 0.01 * math.Exp(0.01)
+		}
+		if have := w[j][iPM2_5]; absDifferent(have, want, 1.e-10*math.Max(want, 1)) {
+			t.Errorf("cell %d: have weight %g, want %g", j, have, want)
+		}
+	}
+
+	cr.DRR = nil
+	if _, err = DeathsReceptor("TotalPop", cr, nil)(d); err == nil {
+		t.Error("no error for a concentration–response function without a derivative")
+	}
+}
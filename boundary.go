@@ -0,0 +1,148 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// boundaryFaces are the names of the faces of the domain, in the same
+// order as InMAP.boundaries.
+var boundaryFaces = []string{"west", "east", "north", "south", "top"}
+
+// BoundaryConditions returns the concentrations [μg/m³] of each species
+// in PolNames in boundary cell b, which is on face face of the domain
+// ("west", "east", "north", "south", or "top") next to grid cell c.
+type BoundaryConditions func(face string, b, c *Cell) []float64
+
+// SetBoundaryConditions returns a function that sets the concentrations
+// in the boundary cells, which are otherwise zero, using bc. The
+// concentrations are the inflow boundary conditions, which are held fixed
+// throughout the simulation, including in boundary cells that are added
+// when the grid changes. Mass that enters the domain through the boundaries
+// is counted as negative outflow in the mass budget. SetBoundaryConditions
+// should be run after the grid is created.
+func SetBoundaryConditions(bc BoundaryConditions) DomainManipulator {
+	return func(d *InMAP) error {
+		d.boundaryConditions = bc
+		for _, c := range d.cells {
+			for i, nbs := range [][]*Cell{c.west, c.east, c.north, c.south, c.above} {
+				if len(nbs) == 1 && nbs[0].boundary {
+					d.setBoundaryConcentrations(boundaryFaces[i], nbs[0], c)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// setBoundaryConcentrations sets the concentrations in boundary cell b,
+// which is on face face of the domain next to grid cell c.
+func (d *InMAP) setBoundaryConcentrations(face string, b, c *Cell) {
+	if d.boundaryConditions == nil {
+		return
+	}
+	copy(b.Ci, d.boundaryConditions(face, b, c))
+}
+
+// BaselineBoundaryConditions returns boundary conditions where the
+// concentrations in each boundary cell are the baseline concentrations in
+// the grid cell next to it. The baseline of primary PM2.5 is the baseline
+// Total PM2.5, which includes the secondary particles that are also
+// species of their own, so the baseline of the other species in
+// "Total PM2.5" is subtracted from it so that they aren't counted twice.
+func BaselineBoundaryConditions() BoundaryConditions {
+	return func(_ string, _, c *Cell) []float64 {
+		o := append([]float64{}, c.CBaseline...)
+		total, ok := PolLabels["Total PM2.5"]
+		if !ok {
+			return o
+		}
+		base, ok := baselinePolLabels["Baseline Total PM2.5"]
+		if !ok || len(base.index) != 1 {
+			return o
+		}
+		primary := base.index[0]
+		for i, ii := range total.index {
+			if ii != primary {
+				o[primary] -= c.CBaseline[ii] * total.conversion[i]
+			}
+		}
+		o[primary] = math.Max(o[primary], 0)
+		return o
+	}
+}
+
+// ReadBoundaryConditions reads boundary conditions from a CSV file with the
+// columns "Face", "Species", and "Concentration", where each row gives the
+// concentration [μg/m³] of one of the species in PolNames on one of the
+// faces of the domain ("west", "east", "north", "south", or "top").
+// Concentrations that are not specified are zero. The chemical mechanism
+// (see SetMechanism) should be set before the file is read.
+func ReadBoundaryConditions(r io.Reader) (BoundaryConditions, error) {
+	lines, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading boundary conditions: %v", err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("inmap: boundary conditions file is empty")
+	}
+	cols := make(map[string]int)
+	for i, h := range lines[0] {
+		cols[strings.TrimSpace(h)] = i
+	}
+	for _, h := range []string{"Face", "Species", "Concentration"} {
+		if _, ok := cols[h]; !ok {
+			return nil, fmt.Errorf("inmap: boundary conditions file does not have a '%s' column", h)
+		}
+	}
+	speciesIndex := make(map[string]int)
+	for i, n := range PolNames {
+		speciesIndex[n] = i
+	}
+	conc := make(map[string][]float64)
+	for _, f := range boundaryFaces {
+		conc[f] = make([]float64, len(PolNames))
+	}
+	for j, line := range lines[1:] {
+		face := strings.ToLower(strings.TrimSpace(line[cols["Face"]]))
+		fc, ok := conc[face]
+		if !ok {
+			return nil, fmt.Errorf("inmap: boundary conditions line %d: invalid face '%s'", j+2, face)
+		}
+		s := strings.TrimSpace(line[cols["Species"]])
+		i, ok := speciesIndex[s]
+		if !ok {
+			return nil, fmt.Errorf("inmap: boundary conditions line %d: invalid species '%s'", j+2, s)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(line[cols["Concentration"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: boundary conditions line %d: %v", j+2, err)
+		}
+		fc[i] = v
+	}
+	return func(face string, _, _ *Cell) []float64 {
+		return conc[face]
+	}, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBoundaryConditions(t *testing.T) {
+	const testTolerance = 1.e-8
+
+	bc, err := ReadBoundaryConditions(strings.NewReader(
+		"Face,Species,Concentration\nwest,PM2_5,5\ntop,pS,1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadBoundaryConditions(strings.NewReader(
+		"Face,Species,Concentration\nwest,xxx,5\n")); err == nil {
+		t.Error("no error for an invalid species")
+	}
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+			SetBoundaryConditions(bc),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing(),
+				DryDeposition(), WetDeposition(), Chemistry()),
+			SteadyStateConvergenceCheck(10, nil),
+		},
+	}
+	if err = d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.westBoundary {
+		if c.Ci[iPM2_5] != 5 || c.Ci[ipS] != 0 {
+			t.Fatalf("west boundary: PM2_5 %g and pS %g; want 5 and 0", c.Ci[iPM2_5], c.Ci[ipS])
+		}
+	}
+	if err = d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mass enters the domain through the boundaries but is not emitted.
+	var inDomain float64
+	for _, c := range d.cells {
+		inDomain += c.Cf[iPM2_5] * c.Volume
+	}
+	if inDomain <= 0 {
+		t.Errorf("no PM2.5 entered the domain")
+	}
+	b := d.MassBudget()
+	if b.Emitted[iPM2_5] != 0 {
+		t.Errorf("emitted PM2.5: have %g, want 0", b.Emitted[iPM2_5])
+	}
+	if r := b.Residual()[iPM2_5]; absDifferent(r, 0, testTolerance*inDomain) {
+		t.Errorf("PM2.5 mass budget residual %g with %g in domain", r, inDomain)
+	}
+	for _, c := range d.westBoundary {
+		if c.Ci[iPM2_5] != 5 {
+			t.Fatalf("west boundary concentration changed to %g", c.Ci[iPM2_5])
+		}
+	}
+
+	// The boundary conditions are restored after the cells are reset.
+	if err = ResetCells()(d); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.topBoundary {
+		if c.Ci[ipS] != 1 {
+			t.Fatalf("top boundary after reset: have %g, want 1", c.Ci[ipS])
+		}
+	}
+
+	// Baseline boundary conditions are from the neighboring grid cells.
+	if err = SetBoundaryConditions(BaselineBoundaryConditions())(d); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.cells {
+		if len(c.east) == 1 && c.east[0].boundary {
+			if have, want := c.east[0].Ci[iPM2_5], c.CBaseline[iPM2_5]; have != want {
+				t.Errorf("east boundary: have %g, want %g", have, want)
+			}
+		}
+	}
+}
+
+// The baseline boundary conditions should not count secondary PM2.5
+// as primary PM2.5.
+func TestBaselineBoundaryConditions(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	c := &Cell{}
+	c.make()
+	c.CBaseline[iPM2_5] = 10 // Total PM2.5
+	c.CBaseline[ipOrg] = 1
+	c.CBaseline[ipBOrg] = 0.5
+	c.CBaseline[ipNH] = 0.2
+	c.CBaseline[ipS] = 0.3
+	c.CBaseline[ipNO] = 0.4
+	c.CBaseline[igS] = 7
+
+	conc := BaselineBoundaryConditions()("west", nil, c)
+	want := 10 - 1 - 0.5 - 0.2*NtoNH4 - 0.3*StoSO4 - 0.4*NtoNO3
+	if absDifferent(conc[iPM2_5], want, testTolerance) {
+		t.Errorf("primary PM2.5: have %g, want %g", conc[iPM2_5], want)
+	}
+	for _, i := range []int{ipOrg, ipBOrg, ipNH, ipS, ipNO, igS} {
+		if conc[i] != c.CBaseline[i] {
+			t.Errorf("%s: have %g, want %g", PolNames[i], conc[i], c.CBaseline[i])
+		}
+	}
+	if c.CBaseline[iPM2_5] != 10 {
+		t.Errorf("the baseline concentration was changed to %g", c.CBaseline[iPM2_5])
+	}
+
+	// The primary PM2.5 is not negative if the secondary baselines
+	// are inconsistent with the total.
+	c.CBaseline[iPM2_5] = 1
+	if conc = BaselineBoundaryConditions()("west", nil, c); conc[iPM2_5] != 0 {
+		t.Errorf("primary PM2.5: have %g, want 0", conc[iPM2_5])
+	}
+}
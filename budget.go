@@ -0,0 +1,261 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"text/tabwriter"
+)
+
+// Indices of the mass budget terms that are accumulated in each grid cell.
+// The terms are stored as changes in concentration [μg/m³] and are
+// converted to mass by multiplying by the cell volume.
+const (
+	budgetEmitted = iota
+	budgetDryDep
+	budgetWetDep
+	budgetChem
+	budgetExtrapolated
+	numBudgetTerms
+)
+
+// makeBudget allocates the mass budget accumulators for the cell.
+func (c *Cell) makeBudget() {
+	for i := range c.budget {
+		c.budget[i] = make([]float64, len(PolNames))
+	}
+	c.dryDepTime, c.wetDepTime = 0, 0
+}
+
+// depositDry removes amount [μg/m³] of pollutant i from the cell by
+// dry deposition.
+func (c *Cell) depositDry(i int, amount float64) {
+	c.Cf[i] -= amount
+	c.budget[budgetDryDep][i] += amount
+}
+
+// depositWet removes amount [μg/m³] of pollutant i from the cell by
+// wet deposition.
+func (c *Cell) depositWet(i int, amount float64) {
+	c.Cf[i] -= amount
+	c.budget[budgetWetDep][i] += amount
+}
+
+// MassBudget holds the mass balance of each pollutant in PolNames
+// since the beginning of the simulation. All values are in units of μg.
+type MassBudget struct {
+	// Emitted is the mass that has been emitted.
+	Emitted []float64
+
+	// West, East, North, South, and Top are the mass that has
+	// been advected or mixed out of the domain through each boundary.
+	// Negative values indicate mass that has entered the domain
+	// (see SetBoundaryConditions).
+	West, East, North, South, Top []float64
+
+	// DryDeposited and WetDeposited are the mass that has been removed
+	// by dry and wet deposition, respectively.
+	DryDeposited, WetDeposited []float64
+
+	// Chemistry is the net mass that has been produced by chemical
+	// reactions and gas-particle partitioning. Negative values
+	// indicate mass that has been converted into other pollutants.
+	Chemistry []float64
+
+	// Extrapolated is the net mass that has been added to the domain
+	// by extrapolating the concentrations toward steady state
+	// (see AitkenExtrapolation).
+	Extrapolated []float64
+
+	// GridChanges is the mass that was in grid cells that have been
+	// deleted when the grid was changed during the simulation.
+	GridChanges []float64
+
+	// InDomain is the mass that is currently in the domain.
+	InDomain []float64
+}
+
+func newMassBudget() *MassBudget {
+	n := len(PolNames)
+	return &MassBudget{
+		Emitted:      make([]float64, n),
+		West:         make([]float64, n),
+		East:         make([]float64, n),
+		North:        make([]float64, n),
+		South:        make([]float64, n),
+		Top:          make([]float64, n),
+		DryDeposited: make([]float64, n),
+		WetDeposited: make([]float64, n),
+		Chemistry:    make([]float64, n),
+		Extrapolated: make([]float64, n),
+		GridChanges:  make([]float64, n),
+		InDomain:     make([]float64, n),
+	}
+}
+
+// faces returns the terms for mass leaving through the domain boundaries
+// in the same order as InMAP.boundaries.
+func (b *MassBudget) faces() [][]float64 {
+	return [][]float64{b.West, b.East, b.North, b.South, b.Top}
+}
+
+// addCell adds the budget terms accumulated in grid cell c to b.
+func (b *MassBudget) addCell(c *Cell) {
+	for i := range PolNames {
+		b.Emitted[i] += c.budget[budgetEmitted][i] * c.Volume
+		b.DryDeposited[i] += c.budget[budgetDryDep][i] * c.Volume
+		b.WetDeposited[i] += c.budget[budgetWetDep][i] * c.Volume
+		b.Chemistry[i] += c.budget[budgetChem][i] * c.Volume
+		b.Extrapolated[i] += c.budget[budgetExtrapolated][i] * c.Volume
+	}
+}
+
+// add adds the values in b2 to b.
+func (b *MassBudget) add(b2 *MassBudget) {
+	for _, p := range [][2][]float64{
+		{b.Emitted, b2.Emitted}, {b.West, b2.West}, {b.East, b2.East},
+		{b.North, b2.North}, {b.South, b2.South}, {b.Top, b2.Top},
+		{b.DryDeposited, b2.DryDeposited}, {b.WetDeposited, b2.WetDeposited},
+		{b.Chemistry, b2.Chemistry}, {b.Extrapolated, b2.Extrapolated},
+		{b.GridChanges, b2.GridChanges},
+		{b.InDomain, b2.InDomain},
+	} {
+		for i, v := range p[1] {
+			p[0][i] += v
+		}
+	}
+}
+
+// Residual returns the mass of each pollutant that is not accounted for
+// by the other terms in the budget. For a mass-conserving simulation
+// the residual should be close to zero.
+func (b *MassBudget) Residual() []float64 {
+	r := make([]float64, len(b.Emitted))
+	for i := range r {
+		r[i] = b.Emitted[i] + b.Chemistry[i] + b.Extrapolated[i] -
+			b.DryDeposited[i] - b.WetDeposited[i] -
+			b.West[i] - b.East[i] - b.North[i] - b.South[i] - b.Top[i] -
+			b.GridChanges[i] - b.InDomain[i]
+	}
+	return r
+}
+
+// RelativeResidual returns the residual of each pollutant as a fraction
+// of the total mass that has entered the domain as that pollutant, either
+// by emission or by chemical production.
+func (b *MassBudget) RelativeResidual() []float64 {
+	r := b.Residual()
+	for i := range r {
+		sources := b.Emitted[i] + math.Max(b.Chemistry[i], 0)
+		if sources == 0 {
+			r[i] = 0
+			continue
+		}
+		r[i] /= sources
+	}
+	return r
+}
+
+func (b *MassBudget) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "Mass budget since the beginning of the simulation (μg):")
+	w := tabwriter.NewWriter(buf, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "pol\temitted\tchemistry\textrap.\tdry dep.\twet dep.\twest\teast\t"+
+		"north\tsouth\ttop\tgrid\tin domain\tresidual\tresidual %\t")
+	residual := b.Residual()
+	relResidual := b.RelativeResidual()
+	for i, n := range PolNames {
+		fmt.Fprintf(w, "%s\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.2g%%\t\n",
+			n, b.Emitted[i], b.Chemistry[i], b.Extrapolated[i], b.DryDeposited[i], b.WetDeposited[i],
+			b.West[i], b.East[i], b.North[i], b.South[i], b.Top[i],
+			b.GridChanges[i], b.InDomain[i], residual[i], relResidual[i]*100)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// MassBudget returns the mass budget of each pollutant since the beginning
+// of the simulation. It should not be called concurrently with
+// functions that modify the grid cells.
+func (d *InMAP) MassBudget() *MassBudget {
+	b := newMassBudget()
+	if d.retiredBudget != nil {
+		b.add(d.retiredBudget)
+	}
+	for _, c := range d.cells {
+		c.mutex.RLock()
+		b.addCell(c)
+		for i, v := range c.Cf {
+			b.InDomain[i] += v * c.Volume
+		}
+		c.mutex.RUnlock()
+	}
+	faces := b.faces()
+	for j, boundary := range d.boundaries() {
+		for _, c := range boundary {
+			for i, v := range c.Cf {
+				faces[j][i] += v * c.Volume
+			}
+		}
+	}
+	return b
+}
+
+// ReportMassBudget returns a function that sends the current mass
+// budget of the simulation to c.
+func ReportMassBudget(c chan *MassBudget) DomainManipulator {
+	return func(d *InMAP) error {
+		c <- d.MassBudget()
+		return nil
+	}
+}
+
+// retireCell keeps track of the budget terms of grid cell c, which is
+// about to be deleted from the domain. Any mass remaining in c is counted
+// as being removed by grid changes.
+func (d *InMAP) retireCell(c *Cell) {
+	if d.retiredBudget == nil {
+		d.retiredBudget = newMassBudget()
+	}
+	d.retiredBudget.addCell(c)
+	for i, v := range c.Cf {
+		d.retiredBudget.GridChanges[i] += v * c.Volume
+	}
+}
+
+// deleteBoundaryCell removes c from boundary, which must be one of the
+// domain boundaries, while keeping track of the mass that has left
+// the domain through c.
+func (d *InMAP) deleteBoundaryCell(c *Cell, boundary *[]*Cell) {
+	if d.retiredBudget == nil {
+		d.retiredBudget = newMassBudget()
+	}
+	faces := d.retiredBudget.faces()
+	for j, b := range []*[]*Cell{&d.westBoundary, &d.eastBoundary,
+		&d.northBoundary, &d.southBoundary, &d.topBoundary} {
+		if b == boundary {
+			for i, v := range c.Cf {
+				faces[j][i] += v * c.Volume
+			}
+		}
+	}
+	deleteCellFromSlice(c, boundary)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestMassBudget(t *testing.T) {
+	const (
+		testTolerance = 1.e-10
+		numIterations = 10
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	newModel := func(scienceFuncs ...CellManipulator) *InMAP {
+		return &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(scienceFuncs...),
+				SteadyStateConvergenceCheck(numIterations, nil),
+			},
+		}
+	}
+
+	// Without transport, all of the mass should be accounted for by
+	// emissions, deposition, and chemistry.
+	d := newModel(DryDeposition(), WetDeposition(), Chemistry())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	b := d.MassBudget()
+	wantEmitted := E * d.Dt * numIterations
+	if different(b.Emitted[iPM2_5], wantEmitted, testTolerance) {
+		t.Errorf("emitted PM2.5: have %g, want %g", b.Emitted[iPM2_5], wantEmitted)
+	}
+	if b.DryDeposited[iPM2_5] <= 0 || b.WetDeposited[iPM2_5] <= 0 {
+		t.Errorf("PM2.5 should be deposited: dry=%g, wet=%g",
+			b.DryDeposited[iPM2_5], b.WetDeposited[iPM2_5])
+	}
+	if b.Chemistry[ipS] <= 0 || b.Chemistry[igS] >= 0 {
+		t.Errorf("chemistry should convert gas-phase S to particle-phase S: gS=%g, pS=%g",
+			b.Chemistry[igS], b.Chemistry[ipS])
+	}
+	for i, r := range b.RelativeResidual() {
+		if math.Abs(r) > testTolerance {
+			t.Errorf("%s: relative residual %g is too large", PolNames[i], r)
+		}
+	}
+
+	// With transport, some of the mass should leave the domain.
+	d = newModel(UpwindAdvection(), Mixing(), MeanderMixing(), DryDeposition(),
+		WetDeposition(), Chemistry())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	b = d.MassBudget()
+	var out float64
+	for _, f := range b.faces() {
+		out += f[iPM2_5]
+	}
+	if out <= 0 {
+		t.Errorf("PM2.5 should leave the domain but %g did", out)
+	}
+	t.Log(b)
+}
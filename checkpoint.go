@@ -0,0 +1,207 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// checkpoint holds the information required to resume a simulation.
+type checkpoint struct {
+	// Version is the version of the software that wrote the checkpoint.
+	Version string
+
+	// PolNames are the names of the pollutants in the concentration arrays.
+	PolNames []string
+
+	Dt float64
+
+	Convergence *convergenceState
+	Log         *logState
+
+	// Ci and Cf are the concentrations in each grid cell.
+	Ci, Cf [][]float64
+
+	// BoundaryCf holds the mass that has left the domain through each
+	// boundary cell, with the boundaries in the order west, east, north,
+	// south, top.
+	BoundaryCf [][][]float64
+
+	// Budget holds the mass budget terms accumulated in each grid cell,
+	// and RetiredBudget holds the budget terms of cells that have been
+	// deleted.
+	Budget        [][][]float64
+	RetiredBudget *MassBudget
+
+	// DepositionTime holds the time over which the dry and wet deposition
+	// budget terms have been accumulated in each grid cell.
+	DepositionTime [][2]float64
+}
+
+func (d *InMAP) boundaries() [][]*Cell {
+	return [][]*Cell{d.westBoundary, d.eastBoundary, d.northBoundary,
+		d.southBoundary, d.topBoundary}
+}
+
+// checkpoint returns a snapshot of the current state of the simulation.
+func (d *InMAP) checkpoint() *checkpoint {
+	cp := &checkpoint{
+		Version:        Version,
+		PolNames:       PolNames,
+		Dt:             d.Dt,
+		Convergence:    d.convergence,
+		Log:            d.log,
+		Ci:             make([][]float64, len(d.cells)),
+		Cf:             make([][]float64, len(d.cells)),
+		Budget:         make([][][]float64, len(d.cells)),
+		RetiredBudget:  d.retiredBudget,
+		DepositionTime: make([][2]float64, len(d.cells)),
+	}
+	for i, c := range d.cells {
+		c.mutex.RLock()
+		cp.Ci[i] = append([]float64{}, c.Ci...)
+		cp.Cf[i] = append([]float64{}, c.Cf...)
+		cp.Budget[i] = make([][]float64, numBudgetTerms)
+		for j, b := range c.budget {
+			cp.Budget[i][j] = append([]float64{}, b...)
+		}
+		cp.DepositionTime[i] = [2]float64{c.dryDepTime, c.wetDepTime}
+		c.mutex.RUnlock()
+	}
+	for _, b := range d.boundaries() {
+		bCf := make([][]float64, len(b))
+		for i, c := range b {
+			bCf[i] = append([]float64{}, c.Cf...)
+		}
+		cp.BoundaryCf = append(cp.BoundaryCf, bCf)
+	}
+	return cp
+}
+
+// restore sets the state of the simulation to the state stored in cp.
+func (d *InMAP) restore(cp *checkpoint) error {
+	if cp.Version != Version {
+		return fmt.Errorf("inmap: checkpoint was created by InMAP version %s but "+
+			"this is version %s; checkpoints can only be resumed using the "+
+			"version they were created with", cp.Version, Version)
+	}
+	if len(cp.PolNames) != len(PolNames) {
+		return fmt.Errorf("inmap: checkpoint has %d pollutants but the model has %d",
+			len(cp.PolNames), len(PolNames))
+	}
+	for i, n := range cp.PolNames {
+		if n != PolNames[i] {
+			return fmt.Errorf("inmap: checkpoint pollutant %d is %s but should be %s",
+				i, n, PolNames[i])
+		}
+	}
+	if len(cp.Cf) != len(d.cells) {
+		return fmt.Errorf("inmap: checkpoint has %d grid cells but the model has %d; "+
+			"checkpoints can only be resumed using the same grid they were created with",
+			len(cp.Cf), len(d.cells))
+	}
+	boundaries := d.boundaries()
+	if len(cp.BoundaryCf) != len(boundaries) {
+		return fmt.Errorf("inmap: checkpoint has %d boundaries but the model has %d",
+			len(cp.BoundaryCf), len(boundaries))
+	}
+	for i, b := range boundaries {
+		if len(cp.BoundaryCf[i]) != len(b) {
+			return fmt.Errorf("inmap: checkpoint boundary %d has %d cells but the "+
+				"model has %d", i, len(cp.BoundaryCf[i]), len(b))
+		}
+	}
+
+	for i, c := range d.cells {
+		c.mutex.Lock()
+		copy(c.Ci, cp.Ci[i])
+		copy(c.Cf, cp.Cf[i])
+		if cp.Budget != nil {
+			for j, b := range cp.Budget[i] {
+				copy(c.budget[j], b)
+			}
+		}
+		if cp.DepositionTime != nil {
+			c.dryDepTime, c.wetDepTime = cp.DepositionTime[i][0], cp.DepositionTime[i][1]
+		}
+		c.mutex.Unlock()
+	}
+	for i, b := range boundaries {
+		for j, c := range b {
+			copy(c.Cf, cp.BoundaryCf[i][j])
+		}
+	}
+	d.Dt = cp.Dt
+	d.convergence = cp.Convergence
+	d.log = cp.Log
+	d.retiredBudget = cp.RetiredBudget
+	return nil
+}
+
+// Checkpoint returns a function that periodically writes the state of the
+// simulation to the file fileName, so that the simulation can later be
+// resumed using Resume. period is the time in seconds (of simulation time)
+// between checkpoints. Only the latest checkpoint is kept: each one is
+// written to a temporary file that then replaces fileName, so that if the
+// program is stopped while a checkpoint is being written the previous
+// checkpoint can still be used.
+// Checkpoint should be included in RunFuncs after the convergence check.
+func Checkpoint(fileName string, period float64) DomainManipulator {
+	return RunPeriodically(period, func(d *InMAP) error {
+		tmp := fileName + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return fmt.Errorf("inmap: creating checkpoint file: %v", err)
+		}
+		if err = gob.NewEncoder(f).Encode(d.checkpoint()); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing checkpoint: %v", err)
+		}
+		if err = f.Close(); err != nil {
+			return fmt.Errorf("inmap: writing checkpoint: %v", err)
+		}
+		if err = os.Rename(tmp, fileName); err != nil {
+			return fmt.Errorf("inmap: writing checkpoint: %v", err)
+		}
+		return nil
+	})
+}
+
+// Resume returns a function that restores the state of the simulation from
+// the checkpoint in r, which should have been created by
+// Checkpoint. Resume should be included in InitFuncs after the grid has been
+// created or loaded and the time step has been set. The grid must be the same
+// as the one the checkpoint was created with, so simulations with dynamic
+// grids cannot be resumed. The resumed simulation continues from the
+// checkpoint even if the simulation that created it had finished.
+func Resume(r io.Reader) DomainManipulator {
+	return func(d *InMAP) error {
+		cp := new(checkpoint)
+		if err := gob.NewDecoder(r).Decode(cp); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("inmap: the checkpoint file is empty")
+			}
+			return fmt.Errorf("inmap: reading checkpoint: %v", err)
+		}
+		return d.restore(cp)
+	}
+}
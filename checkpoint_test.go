@@ -0,0 +1,215 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// Test whether a simulation that is checkpointed and resumed gives the same
+// results as one that is run without interruption.
+func TestCheckpoint(t *testing.T) {
+	const (
+		testTolerance = 1.e-10
+		numIterations = 6
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	newModel := func(iterations int, extraInit, extraRun []DomainManipulator) *InMAP {
+		return &InMAP{
+			InitFuncs: append([]DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				SetTimestepCFL(),
+			}, extraInit...),
+			RunFuncs: append([]DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(
+					UpwindAdvection(),
+					Mixing(),
+					MeanderMixing(),
+					DryDeposition(),
+					WetDeposition(),
+					Chemistry(),
+				),
+				SteadyStateConvergenceCheck(iterations, nil),
+			}, extraRun...),
+		}
+	}
+
+	// Run the full simulation without interruption.
+	dFull := newModel(numIterations, nil, nil)
+	if err := dFull.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dFull.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "inmap_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ckptFile := filepath.Join(dir, "checkpoint.gob")
+
+	// Run the first half of the simulation, checkpointing every time step.
+	dFirst := newModel(numIterations/2, nil, []DomainManipulator{Checkpoint(ckptFile, 0)})
+	if err := dFirst.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dFirst.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(ckptFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary checkpoint file was not removed: %v", err)
+	}
+
+	// Resume the simulation from the checkpoint and run the second half.
+	ckpt, err := os.Open(ckptFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckpt.Close()
+	dResumed := newModel(numIterations, []DomainManipulator{Resume(ckpt)}, nil)
+	if err := dResumed.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if dResumed.Done {
+		t.Fatal("resumed simulation should not be finished")
+	}
+	if dResumed.convergence.Iteration != numIterations/2 {
+		t.Errorf("resumed iteration: have %d, want %d",
+			dResumed.convergence.Iteration, numIterations/2)
+	}
+	if err := dResumed.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if dResumed.convergence.Iteration != numIterations {
+		t.Errorf("final iteration: have %d, want %d",
+			dResumed.convergence.Iteration, numIterations)
+	}
+
+	for i, c := range dFull.cells {
+		for ii, want := range c.Cf {
+			have := dResumed.cells[i].Cf[ii]
+			if absDifferent(have, want, testTolerance) {
+				t.Errorf("cell %d pollutant %d: have %g, want %g", i, ii, have, want)
+			}
+		}
+	}
+}
+
+// Test whether resuming a checkpoint with an incompatible grid fails.
+func TestCheckpointWrongGrid(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ckpt := new(bytes.Buffer)
+	if err := gob.NewEncoder(ckpt).Encode(d.checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+
+	d2 := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+			SetTimestepCFL(),
+			Resume(ckpt),
+		},
+	}
+	if err := d2.Init(); err == nil {
+		t.Error("resuming a checkpoint with a different grid should fail")
+	}
+}
+
+// Test whether incomplete, empty, and mismatched-version checkpoint files
+// are reported.
+func TestResumeCorrupt(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	newModel := func() *InMAP {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				SetTimestepCFL(),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := newModel()
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(d.checkpoint()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(bytes.NewReader(b.Bytes()))(newModel()); err != nil {
+		t.Errorf("complete checkpoint: %v", err)
+	}
+
+	// The checkpoint is truncated.
+	truncated := b.Bytes()[:b.Len()/2]
+	if err := Resume(bytes.NewReader(truncated))(newModel()); err == nil {
+		t.Error("no error for a truncated checkpoint")
+	}
+
+	// The checkpoint file is empty.
+	if err := Resume(bytes.NewReader(nil))(newModel()); err == nil {
+		t.Error("no error for an empty checkpoint file")
+	}
+
+	// The checkpoint was created by a different version.
+	cp := d.checkpoint()
+	cp.Version = "0.0.0"
+	b.Reset()
+	if err := gob.NewEncoder(b).Encode(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(b)(newModel()); err == nil {
+		t.Error("no error for a checkpoint from a different version")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// A ConvergenceCriterion measures the state of a steady-state simulation
+// so that successive measurements can be compared to determine whether
+// the simulation has converged.
+type ConvergenceCriterion interface {
+	// Names returns the names of the quantities whose changes are
+	// returned by Change.
+	Names() []string
+
+	// Measure returns a measurement of the current state of the simulation.
+	Measure(d *InMAP) ([]float64, error)
+
+	// Change returns the relative change in each quantity between
+	// measurements old and current. old is nil before the first check.
+	Change(old, current []float64) []float64
+}
+
+// MassConvergence returns a ConvergenceCriterion that compares the sum
+// of the concentrations of each pollutant across all grid cells. It
+// is the criterion used by SteadyStateConvergenceCheck.
+func MassConvergence() ConvergenceCriterion {
+	return massConvergence{}
+}
+
+type massConvergence struct{}
+
+func (massConvergence) Names() []string { return PolNames }
+
+func (massConvergence) Measure(d *InMAP) ([]float64, error) {
+	sums := make([]float64, len(PolNames))
+	for ii := range PolNames {
+		for _, c := range d.cells {
+			sums[ii] += c.Cf[ii]
+		}
+	}
+	return sums, nil
+}
+
+func (massConvergence) Change(old, current []float64) []float64 {
+	return relativeChange(old, current)
+}
+
+// PopulationWeightedConvergence returns a ConvergenceCriterion that
+// compares the ground-level Total PM2.5 concentration weighted by
+// population type popType, which is the quantity that health impact
+// estimates are based on.
+func PopulationWeightedConvergence(popType string) ConvergenceCriterion {
+	return popWeightedConvergence(popType)
+}
+
+type popWeightedConvergence string
+
+func (p popWeightedConvergence) Names() []string {
+	return []string{string(p) + "-weighted Total PM2.5"}
+}
+
+func (p popWeightedConvergence) Measure(d *InMAP) ([]float64, error) {
+	i, ok := d.popIndices[string(p)]
+	if !ok {
+		return nil, fmt.Errorf("inmap: convergence criterion population type %s is not in the population data", p)
+	}
+	if _, ok := PolLabels["Total PM2.5"]; !ok {
+		return nil, fmt.Errorf("inmap: population-weighted convergence requires " +
+			"the chemical mechanism to include a Total PM2.5 label")
+	}
+	var pop, popConc float64
+	for _, c := range d.cells {
+		if c.Layer != 0 {
+			continue
+		}
+		pop += c.PopData[i]
+		popConc += c.PopData[i] * c.getValue("Total PM2.5", d.popIndices)
+	}
+	if pop == 0 {
+		return nil, fmt.Errorf("inmap: there is no %s population in the domain", p)
+	}
+	return []float64{popConc / pop}, nil
+}
+
+func (popWeightedConvergence) Change(old, current []float64) []float64 {
+	return relativeChange(old, current)
+}
+
+// relativeChange returns the relative change between each value in
+// old and current, where missing old values are treated as zero.
+func relativeChange(old, current []float64) []float64 {
+	if len(old) != len(current) {
+		old = make([]float64, len(current))
+	}
+	o := make([]float64, len(current))
+	for i, v := range current {
+		o[i] = (v - old[i]) / old[i]
+	}
+	return o
+}
+
+// MaxCellChangeConvergence returns a ConvergenceCriterion that finds,
+// for each pollutant, the largest change in concentration in any
+// grid cell, relative to the largest concentration of that pollutant
+// in any grid cell. Unlike MassConvergence, it does not allow
+// changes in different parts of the domain to cancel each other out.
+// The simulation is not considered to have converged if the
+// number of grid cells changes between checks.
+func MaxCellChangeConvergence() ConvergenceCriterion {
+	return maxCellChangeConvergence{}
+}
+
+type maxCellChangeConvergence struct{}
+
+func (maxCellChangeConvergence) Names() []string { return PolNames }
+
+// Measure returns the concentrations in each cell.
+func (maxCellChangeConvergence) Measure(d *InMAP) ([]float64, error) {
+	o := make([]float64, 0, len(d.cells)*len(PolNames))
+	for _, c := range d.cells {
+		o = append(o, c.Cf...)
+	}
+	return o, nil
+}
+
+func (maxCellChangeConvergence) Change(old, current []float64) []float64 {
+	n := len(PolNames)
+	o := make([]float64, n)
+	if len(old) != len(current) {
+		for ii := range o {
+			o[ii] = math.Inf(1)
+		}
+		return o
+	}
+	maxConc := make([]float64, n)
+	for i, v := range current {
+		ii := i % n
+		o[ii] = math.Max(o[ii], math.Abs(v-old[i]))
+		maxConc[ii] = math.Max(maxConc[ii], math.Abs(v))
+	}
+	for ii := range o {
+		o[ii] /= maxConc[ii]
+	}
+	return o
+}
+
+// ConvergenceHistory returns the results of the convergence checks
+// that have been made so far during the simulation.
+func (d *InMAP) ConvergenceHistory() []ConvergenceRecord {
+	if d.convergence == nil {
+		return nil
+	}
+	return append([]ConvergenceRecord{}, d.convergence.History...)
+}
+
+// convergenceHistorySuffix is appended to the base name of an output file
+// to create the name of the file that holds the convergence history.
+const convergenceHistorySuffix = "_convergence.csv"
+
+// writeConvergenceHistory writes the convergence history, if there is any,
+// to a CSV file next to the output file with base name fileBase.
+func (d *InMAP) writeConvergenceHistory(fileBase string) error {
+	history := d.ConvergenceHistory()
+	if len(history) == 0 {
+		return nil
+	}
+	f, err := os.Create(fileBase + convergenceHistorySuffix)
+	if err != nil {
+		return fmt.Errorf("inmap: creating convergence history file: %v", err)
+	}
+	w := csv.NewWriter(f)
+	header := append([]string{"Iteration", "Simulation time (s)"}, history[0].Names...)
+	if err = w.Write(header); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing convergence history: %v", err)
+	}
+	for _, s := range history {
+		line := []string{strconv.Itoa(s.Iteration), strconv.FormatFloat(s.SimulationTime, 'g', -1, 64)}
+		for _, v := range s.Change {
+			line = append(line, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		if err = w.Write(line); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing convergence history: %v", err)
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing convergence history: %v", err)
+	}
+	return f.Close()
+}
+
+// aitkenMaxRatio is the largest ratio between successive changes in
+// concentration for which AitkenExtrapolation extrapolates. It limits
+// the extrapolated change to 9 times the most recent change.
+const aitkenMaxRatio = 0.9
+
+// extrapolationState holds the internal state of AitkenExtrapolation.
+type extrapolationState struct {
+	// snapshots are the concentrations in each cell at the
+	// end of successive periods.
+	snapshots [][]float64
+
+	// timeSinceLastSnapshot is the simulation time [s] since the
+	// last snapshot was taken.
+	timeSinceLastSnapshot float64
+}
+
+// AitkenExtrapolation returns a function that accelerates the convergence
+// of a steady-state simulation. It records the concentrations in each grid
+// cell at intervals of period seconds of simulation time, and after
+// every three records x0, x1, and x2, uses Aitken's delta-squared method
+// to extrapolate the concentration toward the steady state:
+//
+//	x = x2 + (x2-x1)·r/(1-r), where r = (x2-x1)/(x1-x0).
+//
+// Each concentration is only extrapolated where it has been approaching
+// steady state monotonically (0 < r < 0.9), and not to below zero.
+// The mass that is added or removed is kept track of in the mass budget.
+// The records are discarded if the grid changes. They are not saved
+// in checkpoints, so a resumed simulation starts recording again.
+// AitkenExtrapolation should be included in RunFuncs before the
+// convergence check.
+func AitkenExtrapolation(period float64) DomainManipulator {
+	return func(d *InMAP) error {
+		if period <= 0 {
+			return fmt.Errorf("inmap: Aitken extrapolation period must be > 0 but is %g", period)
+		}
+		if d.extrapolation == nil {
+			d.extrapolation = new(extrapolationState)
+		}
+		s := d.extrapolation
+		s.timeSinceLastSnapshot += d.Dt
+		if s.timeSinceLastSnapshot < period {
+			return nil
+		}
+		s.timeSinceLastSnapshot = 0
+		snapshot := make([]float64, 0, len(d.cells)*len(PolNames))
+		for _, c := range d.cells {
+			snapshot = append(snapshot, c.Cf...)
+		}
+		if len(s.snapshots) > 0 && len(s.snapshots[0]) != len(snapshot) {
+			s.snapshots = nil // The grid has changed.
+		}
+		s.snapshots = append(s.snapshots, snapshot)
+		if len(s.snapshots) < 3 {
+			return nil
+		}
+		x0, x1 := s.snapshots[0], s.snapshots[1]
+		n := len(PolNames)
+		for i, c := range d.cells {
+			for ii, x2 := range c.Cf {
+				j := i*n + ii
+				d1, d2 := x1[j]-x0[j], x2-x1[j]
+				if d1 == 0 {
+					continue
+				}
+				r := d2 / d1
+				if r <= 0 || r >= aitkenMaxRatio {
+					continue
+				}
+				x := math.Max(x2+d2*r/(1-r), 0)
+				c.budget[budgetExtrapolated][ii] += x - x2
+				c.Cf[ii] = x
+				c.Ci[ii] = x
+			}
+		}
+		// The extrapolated concentrations are the start of a new sequence.
+		snapshot = snapshot[:0]
+		for _, c := range d.cells {
+			snapshot = append(snapshot, c.Cf...)
+		}
+		s.snapshots = [][]float64{snapshot}
+		return nil
+	}
+}
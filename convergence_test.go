@@ -0,0 +1,220 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestConvergenceCriteria(t *testing.T) {
+	const tolerance = 0.001
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	criteria := map[string]ConvergenceCriterion{
+		"mass":            MassConvergence(),
+		"population":      PopulationWeightedConvergence("TotalPop"),
+		"max cell change": MaxCellChangeConvergence(),
+	}
+	for name, criterion := range criteria {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(
+					DryDeposition(),
+					WetDeposition(),
+				),
+				ConvergenceCheck(-1, criterion, tolerance, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		history := d.ConvergenceHistory()
+		if len(history) < 2 {
+			t.Fatalf("%s: history has %d checks", name, len(history))
+		}
+		for i, s := range history {
+			if len(s.Change) != len(criterion.Names()) {
+				t.Errorf("%s: check %d has %d values but there are %d names",
+					name, i, len(s.Change), len(criterion.Names()))
+			}
+			if i > 0 && s.SimulationTime <= history[i-1].SimulationTime {
+				t.Errorf("%s: check %d is not after check %d", name, i, i-1)
+			}
+		}
+		if !converged(history[len(history)-1].Change, tolerance) {
+			t.Errorf("%s: last check %v has not converged", name, history[len(history)-1])
+		}
+		if converged(history[len(history)-2].Change, tolerance) {
+			t.Errorf("%s: second-to-last check %v has already converged", name, history[len(history)-2])
+		}
+	}
+}
+
+// SteadyStateConvergenceCheck should send the relative change in the mass
+// of each pollutant and keep the same results in the history.
+func TestSteadyStateConvergenceStatus(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	c := make(chan ConvergenceStatus)
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(DryDeposition(), WetDeposition()),
+			SteadyStateConvergenceCheck(-1, c),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []ConvergenceStatus
+	done := make(chan struct{})
+	go func() {
+		for s := range c {
+			statuses = append(statuses, s)
+		}
+		close(done)
+	}()
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	close(c)
+	<-done
+	history := d.ConvergenceHistory()
+	if len(statuses) < 2 || len(statuses) != len(history) {
+		t.Fatalf("received %d statuses for %d checks", len(statuses), len(history))
+	}
+	for i, s := range statuses {
+		if len(s) != len(PolNames) {
+			t.Fatalf("status %d has %d values; want %d", i, len(s), len(PolNames))
+		}
+		for ii, v := range s {
+			if h := history[i].Change[ii]; v != h && !(math.IsNaN(v) && math.IsNaN(h)) {
+				t.Errorf("status %d %s: %g != history %g", i, PolNames[ii], v, h)
+			}
+		}
+	}
+	if _, ok := checkConvergence(1.0001, 1, 0.001); !ok {
+		t.Error("a change of 0.01% should be converged")
+	}
+	if _, ok := checkConvergence(1, 0, 0.001); ok {
+		t.Error("a change from zero should not be converged")
+	}
+}
+
+func TestMaxCellChangeConvergence(t *testing.T) {
+	n := len(PolNames)
+	old := make([]float64, 2*n)
+	current := make([]float64, 2*n)
+	for ii := 0; ii < n; ii++ {
+		old[ii], current[ii] = 10, 9
+		old[n+ii], current[n+ii] = 1, 2
+	}
+	c := MaxCellChangeConvergence()
+	for ii, v := range c.Change(old, current) {
+		// The largest change is 1 and the largest concentration is 9.
+		if different(v, 1./9., 1.e-12) {
+			t.Errorf("%s: change %g should be %g", PolNames[ii], v, 1./9.)
+		}
+	}
+	for ii, v := range c.Change(nil, current) {
+		if !math.IsInf(v, 1) {
+			t.Errorf("%s: change without an old measurement should be +Inf but is %g", PolNames[ii], v)
+		}
+	}
+}
+
+// Aitken extrapolation should find the steady state of a geometric
+// sequence exactly, and the added mass should be included in the
+// mass budget.
+func TestAitkenExtrapolation(t *testing.T) {
+	const (
+		steadyState = 2.
+		tolerance   = 1.e-12
+	)
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(func(c *Cell, _ float64) {
+				for ii := range c.Cf {
+					c.Cf[ii] = c.Cf[ii]/2 + steadyState/2
+					c.Ci[ii] = c.Cf[ii]
+				}
+			}),
+			func(d *InMAP) error {
+				return AitkenExtrapolation(d.Dt)(d)
+			},
+			SteadyStateConvergenceCheck(3, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var volume float64
+	for _, c := range d.cells {
+		volume += c.Volume
+		for ii, v := range c.Cf {
+			if different(v, steadyState, tolerance) {
+				t.Fatalf("%s: concentration %g should be %g", PolNames[ii], v, steadyState)
+			}
+		}
+	}
+	b := d.MassBudget()
+	for ii := range PolNames {
+		// The concentrations were 1.75 before extrapolation.
+		if different(b.Extrapolated[ii], (steadyState-1.75)*volume, tolerance) {
+			t.Errorf("%s: extrapolated mass %g should be %g", PolNames[ii],
+				b.Extrapolated[ii], (steadyState-1.75)*volume)
+		}
+	}
+}
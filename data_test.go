@@ -73,7 +73,7 @@ var WriteTestPopShapefile = func() {
 		}
 	}
 	e.Close()
-	f, err := os.Create(strings.TrimRight(TestPopulationShapefile, ".shp") + ".prj")
+	f, err := os.Create(strings.TrimSuffix(TestPopulationShapefile, ".shp") + ".prj")
 	if err != nil {
 		panic(err)
 	}
@@ -114,7 +114,7 @@ func WriteTestMortalityShapefile() {
 		}
 	}
 	e.Close()
-	f, err := os.Create(strings.TrimRight(TestMortalityShapefile, ".shp") + ".prj")
+	f, err := os.Create(strings.TrimSuffix(TestMortalityShapefile, ".shp") + ".prj")
 	if err != nil {
 		panic(err)
 	}
@@ -389,7 +389,7 @@ func CreateTestCTMData() (VarGridConfig, *CTMData) {
 		"NO_NO2partitioning": {
 			dims:        []string{"z", "y", "x"},
 			data:        sparse.ZerosDense([]int{10, 2, 2}...),
-			description: "Mass fraction of N in NOx that exists as NO.",
+			description: "Mass fraction of N in NOx that exists as NO2.",
 			units:       "fraction",
 		},
 		"ParticleWetDep": {
@@ -490,6 +490,11 @@ func VarGridData() (*VarGridConfig, *CTMData, *Population, PopIndices, *Mortalit
 
 	WriteTestPopShapefile()
 	WriteTestMortalityShapefile()
+	defer func() {
+		for _, fname := range []string{TestPopulationShapefile, TestMortalityShapefile} {
+			DeleteShapefile(fname)
+		}
+	}()
 
 	cfg, data := CreateTestCTMData()
 
@@ -498,10 +503,6 @@ func VarGridData() (*VarGridConfig, *CTMData, *Population, PopIndices, *Mortalit
 		panic(err)
 	}
 
-	for _, fname := range []string{TestPopulationShapefile, TestMortalityShapefile} {
-		DeleteShapefile(fname)
-	}
-
 	return &cfg, data, population, popIndices, mortalityRates
 }
 
@@ -0,0 +1,111 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+// DepositionLabel specifies model output variables holding the flux of one
+// or more species to the ground by deposition. Each label creates three
+// output variables: Name+" dry deposition", Name+" wet deposition", and
+// Name+" deposition", which is the sum of the two.
+type DepositionLabel struct {
+	Name string
+
+	// Species are the species that are included in the variables.
+	Species []string
+
+	// Conversions are the factors that the flux of each species
+	// [kg/ha/yr of the species as it is represented in the model, for
+	// example as N] is multiplied by.
+	Conversions []float64
+
+	// Units are the units of the converted flux, for example "kg N/ha/yr".
+	Units string
+}
+
+// depositionTypes are the output variables created for each DepositionLabel.
+var depositionTypes = []struct {
+	suffix   string
+	dry, wet bool
+}{
+	{suffix: " dry deposition", dry: true},
+	{suffix: " wet deposition", wet: true},
+	{suffix: " deposition", dry: true, wet: true},
+}
+
+type depositionConv struct {
+	polConv
+	units    string
+	dry, wet bool
+}
+
+// ugm2sToKgHaYr converts a flux in μg/m²/s to kg/ha/yr.
+const ugm2sToKgHaYr = 1.e-9 * 1.e4 * 3600 * 8760
+
+// depositionFlux returns the deposition flux to the ground
+// [kg/ha/yr of the converted species] below grid cell c, which is the
+// mass removed by DryDeposition and WetDeposition that has been accumulated
+// in the mass budget divided by the simulation time it was accumulated
+// over and by the area of c. Because the model represents annual average
+// conditions, the flux at steady state is the annual deposition.
+// Dry deposition is from the ground-level cell, and wet deposition is
+// from the whole column of cells above it. In cells where deposition has
+// not been calculated, for example after LinearSteadyState, which does not
+// update the mass budget, the flux at the current concentrations is used
+// instead. The flux is zero for cells that are not at ground level.
+func (c *Cell) depositionFlux(conv depositionConv) float64 {
+	if c.Layer != 0 {
+		return 0
+	}
+	var flux float64 // μg/m²/s
+	if conv.dry {
+		for i, ii := range conv.index {
+			if vd := species[ii].DryDep; vd != nil {
+				if c.dryDepTime > 0 {
+					flux += c.budget[budgetDryDep][ii] * c.Dz / c.dryDepTime * conv.conversion[i]
+				} else {
+					flux += c.Cf[ii] * vd(c) * conv.conversion[i]
+				}
+			}
+		}
+	}
+	if conv.wet {
+		flux += c.wetDepositionColumn(conv)
+	}
+	return flux * ugm2sToKgHaYr
+}
+
+// wetDepositionColumn returns the wet deposition flux [μg/m²/s] of the
+// converted species from c and the cells above it, per unit area of c.
+func (c *Cell) wetDepositionColumn(conv depositionConv) float64 {
+	var flux float64
+	for i, ii := range conv.index {
+		if k := species[ii].WetDep; k != nil {
+			if c.wetDepTime > 0 {
+				flux += c.budget[budgetWetDep][ii] * c.Dz / c.wetDepTime * conv.conversion[i]
+			} else {
+				flux += c.Cf[ii] * k(c) * c.Dz * conv.conversion[i]
+			}
+		}
+	}
+	for i, a := range c.above {
+		if !a.boundary {
+			flux += a.wetDepositionColumn(conv) * c.aboveFrac[i]
+		}
+	}
+	return flux
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// TestDepositionFlux checks that the deposition flux output variables
+// match the mass removed by DryDeposition and WetDeposition.
+func TestDepositionFlux(t *testing.T) {
+	const testTolerance = 1.e-8
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		NH3:    E,
+		NOx:    E,
+		SOx:    E,
+		Height: 20,
+		Geom:   geom.Point{X: -3999, Y: -3999.},
+	})
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), DryDeposition(), WetDeposition(), Chemistry()),
+			SteadyStateConvergenceCheck(10, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"N dry deposition", "N wet deposition", "N deposition",
+		"S dry deposition", "S wet deposition", "S deposition"}
+	results := func() map[string][]float64 {
+		r, err := d.Results(false, names...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r := results()
+	units := map[string]string{"N deposition": "kg N/ha/yr", "S wet deposition": "kg S/ha/yr"}
+	for n, want := range units {
+		if have := d.getUnits(n); have != want {
+			t.Errorf("%s units: have %s, want %s", n, have, want)
+		}
+	}
+
+	// Total the deposition rate over the ground area [μg/s].
+	totals := make(map[string]float64)
+	for _, n := range names {
+		for i, v := range r[n] {
+			c := d.cells[i]
+			totals[n] += v / ugm2sToKgHaYr * c.Dx * c.Dy
+		}
+	}
+	for _, p := range []string{"N", "S"} {
+		sum := totals[p+" dry deposition"] + totals[p+" wet deposition"]
+		if absDifferent(totals[p+" deposition"], sum, testTolerance*sum) {
+			t.Errorf("%s deposition %g != dry + wet %g", p, totals[p+" deposition"], sum)
+		}
+	}
+
+	// The average flux over the simulation is the deposited mass
+	// divided by the simulation time.
+	b := d.MassBudget()
+	removed := func(dep []float64, species ...int) float64 {
+		var o float64
+		for _, i := range species {
+			o += dep[i]
+		}
+		return o / d.convergence.SimulationTime
+	}
+	for _, test := range []struct {
+		name string
+		want float64
+	}{
+		{"N dry deposition", removed(b.DryDeposited, igNH, ipNH, igNO, ipNO)},
+		{"N wet deposition", removed(b.WetDeposited, igNH, ipNH, igNO, ipNO)},
+		{"S dry deposition", removed(b.DryDeposited, igS, ipS)},
+		{"S wet deposition", removed(b.WetDeposited, igS, ipS)},
+	} {
+		if test.want == 0 {
+			t.Errorf("%s: no mass was removed", test.name)
+		}
+		if absDifferent(totals[test.name], test.want, testTolerance*test.want) {
+			t.Errorf("%s: flux %g μg/s != removed mass %g μg/s", test.name, totals[test.name], test.want)
+		}
+	}
+
+	// Without an accumulated budget, the flux at the current concentrations
+	// is used, which is the same as the flux over one time step.
+	for _, c := range d.cells {
+		c.makeBudget()
+		copy(c.Ci, c.Cf)
+	}
+	before := results()
+	if err := Calculations(DryDeposition(), WetDeposition())(d); err != nil {
+		t.Fatal(err)
+	}
+	after := results()
+	for _, n := range names {
+		for i, want := range before[n] {
+			if have := after[n][i]; absDifferent(have, want, testTolerance*want) {
+				t.Errorf("%s cell %d: budget flux %g != instantaneous flux %g", n, i, have, want)
+			}
+		}
+	}
+
+	for _, c := range d.cells {
+		if c.Layer > 0 && c.getValue("N deposition", d.popIndices) != 0 {
+			t.Errorf("cell above ground level has non-zero deposition")
+			break
+		}
+	}
+}
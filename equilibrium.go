@@ -0,0 +1,157 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+)
+
+// Physical constants used to convert between mixing ratios and
+// concentrations.
+const (
+	rGas             = 8.314462 // J/mol/K
+	gravity          = 9.80665  // m/s²
+	mwAir            = 28.9647  // g/mol
+	standardPressure = 101325.  // Pa
+)
+
+// inorganicSpecies holds the indices of the species in the
+// sulfate-nitrate-ammonium system.
+type inorganicSpecies struct {
+	gNH, pNH, gNO, pNO, pS int
+}
+
+// InorganicEquilibrium returns a function that partitions ammonia and
+// nitrate between the gas and particle phases based on the thermodynamic
+// equilibrium of the sulfate-nitrate-ammonium system, rather than using the
+// fixed partitioning from the baseline CTM data. This allows the partitioning
+// to respond to large changes in ammonia or NOx. It should be run after
+// Chemistry, whose partitioning of these species it replaces.
+//
+// Ammonia first neutralizes particulate sulfate to form ammonium sulfate,
+// and the remaining ammonia forms ammonium nitrate in equilibrium with
+// gaseous ammonia and nitric acid. The equilibrium constant depends on
+// Temperature and, above the deliquescence point, RelativeHumidity
+// (Mozurkewich, 1993; Seinfeld and Pandis, 2006, section 10.4).
+// Because gaseous "gNO" is NOx rather than nitric acid, the fraction of
+// it that is available to form nitrate is chosen in each grid cell so that the
+// baseline nitrate concentration is in equilibrium. Grid cells without
+// temperature data are not changed.
+//
+// The chemical mechanism must include the species gNH, pNH, gNO, pNO, and pS
+// in the units used by DefaultMechanism. Because the calculation is not
+// linear, it cannot be used with LinearSteadyState or Adjoint.
+func InorganicEquilibrium() (CellManipulator, error) {
+	index := make(map[string]int)
+	for i, n := range PolNames {
+		index[n] = i
+	}
+	var s inorganicSpecies
+	for _, sp := range []struct {
+		name string
+		i    *int
+	}{{"gNH", &s.gNH}, {"pNH", &s.pNH}, {"gNO", &s.gNO}, {"pNO", &s.pNO}, {"pS", &s.pS}} {
+		i, ok := index[sp.name]
+		if !ok {
+			return nil, fmt.Errorf("inmap: inorganic equilibrium requires species %s, "+
+				"which is not in the chemical mechanism", sp.name)
+		}
+		*sp.i = i
+	}
+	return func(c *Cell, Δt float64) {
+		if c.Temperature <= 0 {
+			return
+		}
+		k := ammoniumNitrateK(c)
+		tno3Frac := s.nitrateAvailability(c.CBaseline, k)
+
+		// Keep track of the net change as part of chemistry.
+		for _, i := range []int{s.gNH, s.pNH, s.gNO, s.pNO} {
+			c.budget[budgetChem][i] -= c.Cf[i]
+		}
+
+		nh := (c.Cf[s.gNH] + c.Cf[s.pNH]) / mwN // μmol/m³
+		no := (c.Cf[s.gNO] + c.Cf[s.pNO]) / mwN // μmol/m³
+		nh4, no3 := inorganicEquilibrium(c.Cf[s.pS]/mwS, nh, no*tno3Frac, k)
+		c.Cf[s.pNH] = nh4 * mwN
+		c.Cf[s.gNH] = math.Max(nh-nh4, 0) * mwN
+		c.Cf[s.pNO] = no3 * mwN
+		c.Cf[s.gNO] = math.Max(no-no3, 0) * mwN
+
+		for _, i := range []int{s.gNH, s.pNH, s.gNO, s.pNO} {
+			c.budget[budgetChem][i] += c.Cf[i]
+		}
+	}, nil
+}
+
+// inorganicEquilibrium returns the particulate ammonium and nitrate
+// in equilibrium with sulfate so4, total ammonia nh, and total nitrate
+// tno3, where k is the dissociation constant of ammonium nitrate.
+// All values are in μmol/m³.
+func inorganicEquilibrium(so4, nh, tno3, k float64) (nh4, no3 float64) {
+	nh4 = math.Min(nh, 2*so4)
+	free := nh - nh4
+	if free*tno3 <= k {
+		return nh4, 0
+	}
+	// Solve (free - no3)·(tno3 - no3) = k for the smaller root.
+	no3 = (free + tno3 - math.Sqrt((free-tno3)*(free-tno3)+4*k)) / 2
+	return nh4 + no3, no3
+}
+
+// nitrateAvailability returns the fraction of the total NOx nitrogen that
+// is available to form ammonium nitrate, chosen so that the baseline
+// concentrations cb are in equilibrium given dissociation constant k.
+func (s inorganicSpecies) nitrateAvailability(cb []float64, k float64) float64 {
+	no := (cb[s.gNO] + cb[s.pNO]) / mwN
+	if no <= 0 {
+		return 0
+	}
+	no3 := cb[s.pNO] / mwN
+	nh := (cb[s.gNH] + cb[s.pNH]) / mwN
+	free := nh - math.Min(nh, 2*cb[s.pS]/mwS) - no3
+	tno3 := no3
+	if free > 0 {
+		tno3 += k / free
+	}
+	return math.Min(tno3/no, 1)
+}
+
+// ammoniumNitrateK returns the dissociation constant of ammonium nitrate
+// in grid cell c [(μmol/m³)²].
+func ammoniumNitrateK(c *Cell) float64 {
+	t := c.Temperature
+	lnT := math.Log(t)
+	k := math.Exp(118.87 - 24084/t - 6.025*lnT) // ppb²
+	rh := math.Min(math.Max(c.RelativeHumidity, 0), 1)
+	if drh := math.Exp(723.7/t+1.6954) / 100; rh >= drh {
+		// Ammonium nitrate is dissolved in aerosol water.
+		p1 := math.Exp(-135.94 + 8763/t + 19.12*lnT)
+		p2 := math.Exp(-122.65 + 9969/t + 16.22*lnT)
+		p3 := math.Exp(-182.61 + 13875/t + 24.46*lnT)
+		a := 1 - rh
+		k *= (p1 - p2*a + p3*a*a) * math.Pow(a, 1.75)
+	}
+	// Convert to concentrations using the pressure at the cell center.
+	z := c.LayerHeight + c.Dz/2
+	p := standardPressure * math.Exp(-gravity*mwAir*1.e-3*z/(rGas*t))
+	ppbToConc := p / (rGas * t) * 1.e-3 // μmol/m³ per ppb
+	return k * ppbToConc * ppbToConc
+}
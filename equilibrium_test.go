@@ -0,0 +1,110 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "testing"
+
+func TestInorganicEquilibrium(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	f, err := InorganicEquilibrium()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCell := func() *Cell {
+		c := &Cell{Temperature: 285, RelativeHumidity: 0.5, Dz: 50}
+		c.make()
+		c.CBaseline[igNH] = 1.0
+		c.CBaseline[ipNH] = 1.5
+		c.CBaseline[igNO] = 5.0
+		c.CBaseline[ipNO] = 0.5
+		c.CBaseline[ipS] = 0.8
+		copy(c.Cf, c.CBaseline)
+		return c
+	}
+	totalN := func(c *Cell) (nh, no float64) {
+		return c.Cf[igNH] + c.Cf[ipNH], c.Cf[igNO] + c.Cf[ipNO]
+	}
+
+	// The baseline nitrate is in equilibrium.
+	c := newCell()
+	f(c, 1)
+	if absDifferent(c.Cf[ipNO], c.CBaseline[ipNO], testTolerance) {
+		t.Errorf("baseline nitrate: have %g, want %g", c.Cf[ipNO], c.CBaseline[ipNO])
+	}
+	wantNH4 := 2*c.CBaseline[ipS]/mwS*mwN + c.CBaseline[ipNO]
+	if absDifferent(c.Cf[ipNH], wantNH4, testTolerance) {
+		t.Errorf("baseline ammonium: have %g, want %g", c.Cf[ipNH], wantNH4)
+	}
+
+	// Reducing ammonia reduces nitrate more than proportionally
+	// once it is mostly neutralizing sulfate.
+	c = newCell()
+	nh0, no0 := totalN(c)
+	c.Cf[igNH] = 0.5
+	c.Cf[ipNH] = 0.5
+	nh1, _ := totalN(c)
+	f(c, 1)
+	nh, no := totalN(c)
+	if absDifferent(nh, nh1, testTolerance) || absDifferent(no, no0, testTolerance) {
+		t.Errorf("nitrogen is not conserved: ammonia %g != %g or nitrate %g != %g", nh, nh1, no, no0)
+	}
+	if c.Cf[ipNO]/c.CBaseline[ipNO] >= nh1/nh0 {
+		t.Errorf("nitrate decreased from %g to %g, which is not more than proportional "+
+			"to the decrease in ammonia from %g to %g", c.CBaseline[ipNO], c.Cf[ipNO], nh0, nh1)
+	}
+	if c.Cf[ipNH] > 2*c.Cf[ipS]/mwS*mwN+c.Cf[ipNO]+testTolerance {
+		t.Errorf("ammonium %g is more than is needed to neutralize sulfate and nitrate", c.Cf[ipNH])
+	}
+
+	// Nitrate is not formed when there is not enough ammonia
+	// to neutralize the sulfate.
+	c = newCell()
+	c.Cf[igNH] = 0.1
+	c.Cf[ipNH] = 0.1
+	f(c, 1)
+	if c.Cf[ipNO] != 0 || c.Cf[igNH] != 0 {
+		t.Errorf("sulfate-rich: nitrate is %g and gaseous ammonia is %g; want 0", c.Cf[ipNO], c.Cf[igNH])
+	}
+
+	// Cool and humid conditions favor the particle phase.
+	k := ammoniumNitrateK(newCell())
+	c = newCell()
+	c.RelativeHumidity = 0.9
+	if kHumid := ammoniumNitrateK(c); kHumid >= k {
+		t.Errorf("dissociation constant at 90%% humidity (%g) is not less than at 50%% (%g)", kHumid, k)
+	}
+	c = newCell()
+	c.Temperature = 300
+	if kWarm := ammoniumNitrateK(c); kWarm <= k {
+		t.Errorf("dissociation constant at 300 K (%g) is not greater than at 285 K (%g)", kWarm, k)
+	}
+
+	// Cells without temperature data are not changed.
+	c = newCell()
+	c.Temperature = 0
+	c.Cf[igNH] = 0.1
+	want := append([]float64{}, c.Cf...)
+	f(c, 1)
+	for i, v := range c.Cf {
+		if v != want[i] {
+			t.Errorf("no temperature: species %s changed from %g to %g", PolNames[i], want[i], v)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GroupExposure holds exposure and inequality metrics for the
+// people in one population type.
+type GroupExposure struct {
+	// Population is the population type.
+	Population string
+
+	// People is the number of people in the population type.
+	People float64
+
+	// MeanExposure is the population-weighted mean concentration
+	// caused by the modeled emissions.
+	MeanExposure float64
+
+	// MeanBaselineExposure is the population-weighted mean baseline
+	// concentration, or zero if there is no baseline for the variable.
+	MeanBaselineExposure float64
+
+	// RelativeExposure is MeanExposure divided by the MeanExposure
+	// of the reference population type.
+	RelativeExposure float64
+
+	// Share is the fraction of the baseline exposure that is caused by
+	// the modeled emissions: MeanExposure divided by MeanBaselineExposure.
+	Share float64
+
+	// Atkinson is the Atkinson inequality index of the exposure of
+	// the people in the population type. It is zero if everyone has the
+	// same exposure.
+	Atkinson float64
+
+	// Gini is the Gini coefficient of the exposure of the people in the
+	// population type: twice the area between the LorenzCurve and the line
+	// of equality. It is zero if everyone has the same exposure and
+	// approaches one if all of the exposure is experienced by one person.
+	Gini float64
+
+	// LorenzCurve is the cumulative fraction of the total exposure
+	// as a function of the cumulative fraction of the people, ranked from
+	// the least to the most exposed. It starts at (0, 0) and ends at (1, 1).
+	LorenzCurve []CurvePoint
+}
+
+// CurvePoint is a point on a LorenzCurve.
+type CurvePoint struct {
+	PopulationFraction, ExposureFraction float64
+}
+
+// Equity calculates exposure and inequality metrics for each population
+// type in the ground-level grid cells, for the concentration in output
+// variable variable (for example "Total PM2.5"). The baseline concentration
+// is from the variable with "Baseline " added to the name, if there is one.
+// RelativeExposure is relative to population type reference (for example
+// "TotalPop"), and epsilon is the inequality aversion parameter of the
+// Atkinson index. Because concentrations of pollutants such as PM2.5 are
+// harmful, epsilon should usually be negative (Levy et al., 2006,
+// International Journal for Equity in Health 5:2); positive values treat
+// the exposure as a benefit.
+// The population types are returned in alphabetical order. This function will
+// only give the correct results if run after InMAP finishes calculating.
+func (d *InMAP) Equity(variable, reference string, epsilon float64) ([]GroupExposure, error) {
+	if _, ok := PolLabels[variable]; !ok {
+		return nil, fmt.Errorf("inmap: equity variable '%s' is not a concentration", variable)
+	}
+	if _, ok := d.popIndices[reference]; !ok {
+		return nil, fmt.Errorf("inmap: equity reference population type '%s' is not in the grid", reference)
+	}
+	baseline := "Baseline " + variable
+	_, hasBaseline := baselinePolLabels[baseline]
+
+	type cellExposure struct{ people, conc float64 }
+	var pops []string
+	for p := range d.popIndices {
+		pops = append(pops, p)
+	}
+	sort.Strings(pops)
+
+	o := make([]GroupExposure, len(pops))
+	for k, p := range pops {
+		i := d.popIndices[p]
+		g := GroupExposure{Population: p}
+		var exposures []cellExposure
+		var baseExposure float64
+		for _, c := range d.cells {
+			if c.Layer != 0 || c.PopData[i] == 0 {
+				continue
+			}
+			conc := c.getValue(variable, d.popIndices)
+			exposures = append(exposures, cellExposure{people: c.PopData[i], conc: conc})
+			g.People += c.PopData[i]
+			g.MeanExposure += c.PopData[i] * conc
+			if hasBaseline {
+				baseExposure += c.PopData[i] * c.getValue(baseline, d.popIndices)
+			}
+		}
+		if g.People > 0 {
+			g.MeanExposure /= g.People
+			g.MeanBaselineExposure = baseExposure / g.People
+		}
+		if g.MeanBaselineExposure != 0 {
+			g.Share = g.MeanExposure / g.MeanBaselineExposure
+		}
+
+		people := make([]float64, len(exposures))
+		concs := make([]float64, len(exposures))
+		sort.Slice(exposures, func(a, b int) bool { return exposures[a].conc < exposures[b].conc })
+		for j, e := range exposures {
+			people[j], concs[j] = e.people, e.conc
+		}
+		g.Atkinson = atkinson(people, concs, epsilon)
+		g.LorenzCurve, g.Gini = lorenzCurve(people, concs)
+		o[k] = g
+	}
+
+	var ref float64
+	for _, g := range o {
+		if g.Population == reference {
+			ref = g.MeanExposure
+		}
+	}
+	if ref != 0 {
+		for k := range o {
+			o[k].RelativeExposure = o[k].MeanExposure / ref
+		}
+	}
+	return o, nil
+}
+
+// atkinson returns the Atkinson index of concentrations conc experienced
+// by numbers of people people, with inequality aversion parameter epsilon.
+// For epsilon > 0, the concentration is treated as a good and the index is
+// one minus the ratio of the equally-distributed equivalent concentration
+// to the mean. For epsilon < 0, the concentration is treated as a bad, for
+// which the equally-distributed equivalent is greater than the mean, and the
+// index is the ratio minus one.
+func atkinson(people, conc []float64, epsilon float64) float64 {
+	var total, mean float64
+	for i, p := range people {
+		total += p
+		mean += p * conc[i]
+	}
+	if total == 0 || mean == 0 {
+		return 0
+	}
+	mean /= total
+	var ede float64 // equally-distributed equivalent concentration
+	if epsilon == 1 {
+		for i, p := range people {
+			if conc[i] <= 0 {
+				return 1
+			}
+			ede += p * math.Log(conc[i])
+		}
+		ede = math.Exp(ede / total)
+	} else {
+		for i, p := range people {
+			ede += p * math.Pow(math.Max(conc[i], 0), 1-epsilon)
+		}
+		ede = math.Pow(ede/total, 1/(1-epsilon))
+	}
+	if epsilon < 0 {
+		return ede/mean - 1
+	}
+	return 1 - ede/mean
+}
+
+// lorenzCurveSuffix is appended to the base name of an output file
+// to create the name of the file that holds the Lorenz curves.
+const lorenzCurveSuffix = "_lorenzcurves.csv"
+
+// WriteLorenzCurves writes the Lorenz curves of groups, as
+// returned by Equity, to a CSV file next to the output file fileName,
+// with the suffix "_lorenzcurves.csv". There is a row for each
+// point on each curve.
+func WriteLorenzCurves(fileName string, groups []GroupExposure) error {
+	f, err := os.Create(strings.TrimSuffix(fileName, filepath.Ext(fileName)) + lorenzCurveSuffix)
+	if err != nil {
+		return fmt.Errorf("inmap: creating Lorenz curve file: %v", err)
+	}
+	w := csv.NewWriter(f)
+	if err = w.Write([]string{"Population", "PopulationFraction", "ExposureFraction"}); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing Lorenz curves: %v", err)
+	}
+	for _, g := range groups {
+		for _, pt := range g.LorenzCurve {
+			line := []string{g.Population,
+				strconv.FormatFloat(pt.PopulationFraction, 'g', -1, 64),
+				strconv.FormatFloat(pt.ExposureFraction, 'g', -1, 64)}
+			if err = w.Write(line); err != nil {
+				f.Close()
+				return fmt.Errorf("inmap: writing Lorenz curves: %v", err)
+			}
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing Lorenz curves: %v", err)
+	}
+	return f.Close()
+}
+
+// lorenzCurve returns the Lorenz curve and Gini coefficient for
+// concentrations conc, sorted in increasing order, experienced by
+// numbers of people people.
+func lorenzCurve(people, conc []float64) ([]CurvePoint, float64) {
+	var totalPeople, totalExposure float64
+	for i, p := range people {
+		totalPeople += p
+		totalExposure += p * conc[i]
+	}
+	curve := []CurvePoint{{0, 0}}
+	if totalPeople == 0 || totalExposure == 0 {
+		return curve, 0
+	}
+	var cumPeople, cumExposure, area float64
+	for i, p := range people {
+		prev := curve[len(curve)-1]
+		cumPeople += p
+		cumExposure += p * conc[i]
+		pt := CurvePoint{PopulationFraction: cumPeople / totalPeople,
+			ExposureFraction: cumExposure / totalExposure}
+		area += (pt.PopulationFraction - prev.PopulationFraction) *
+			(pt.ExposureFraction + prev.ExposureFraction) / 2
+		curve = append(curve, pt)
+	}
+	return curve, 1 - 2*area
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEquity(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	// Half of the people are exposed to 1 and half to 3.
+	people, conc := []float64{10, 10}, []float64{1, 3}
+	want := 1 - math.Pow((1+math.Sqrt(3))/2, 2)/2
+	if have := atkinson(people, conc, 0.5); absDifferent(have, want, testTolerance) {
+		t.Errorf("Atkinson index: have %g, want %g", have, want)
+	}
+	want = 1 - math.Sqrt(3)/2
+	if have := atkinson(people, conc, 1); absDifferent(have, want, testTolerance) {
+		t.Errorf("Atkinson index with ε=1: have %g, want %g", have, want)
+	}
+	// For a bad, the equally-distributed equivalent is the root mean square.
+	want = math.Sqrt(5)/2 - 1
+	if have := atkinson(people, conc, -1); absDifferent(have, want, testTolerance) {
+		t.Errorf("Atkinson index with ε=-1: have %g, want %g", have, want)
+	}
+	curve, gini := lorenzCurve(people, conc)
+	if len(curve) != 3 || curve[1].PopulationFraction != 0.5 || curve[1].ExposureFraction != 0.25 {
+		t.Errorf("Lorenz curve: have %v", curve)
+	}
+	if absDifferent(gini, 0.25, testTolerance) {
+		t.Errorf("Gini coefficient: have %g, want 0.25", gini)
+	}
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everyone is exposed to the same concentration.
+	for _, c := range d.cells {
+		c.Cf[iPM2_5] = 2
+	}
+	groups, err := d.Equity("Total PM2.5", "TotalPop", -0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != len(popIndices) {
+		t.Fatalf("have %d groups, want %d", len(groups), len(popIndices))
+	}
+	for _, g := range groups {
+		if g.People == 0 {
+			continue
+		}
+		if absDifferent(g.MeanExposure, 2, testTolerance) || absDifferent(g.RelativeExposure, 1, testTolerance) {
+			t.Errorf("%s: mean exposure %g and relative exposure %g; want 2 and 1",
+				g.Population, g.MeanExposure, g.RelativeExposure)
+		}
+		if absDifferent(g.Atkinson, 0, testTolerance) || absDifferent(g.Gini, 0, testTolerance) {
+			t.Errorf("%s: Atkinson %g and Gini coefficient %g; want 0",
+				g.Population, g.Atkinson, g.Gini)
+		}
+		if g.MeanBaselineExposure <= 0 || absDifferent(g.Share, 2/g.MeanBaselineExposure, testTolerance) {
+			t.Errorf("%s: share %g of baseline %g", g.Population, g.Share, g.MeanBaselineExposure)
+		}
+	}
+
+	if _, err = d.Equity("Total PM2.5", "Martians", -0.75); err == nil {
+		t.Error("no error for a reference population type that is not in the grid")
+	}
+
+	dir, err := ioutil.TempDir("", "inmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = WriteLorenzCurves(filepath.Join(dir, "out.shp"), groups); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "out"+lorenzCurveSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines := 1
+	for _, g := range groups {
+		wantLines += len(g.LorenzCurve)
+	}
+	if len(lines) != wantLines {
+		t.Errorf("Lorenz curve file has %d lines, want %d", len(lines), wantLines)
+	}
+}
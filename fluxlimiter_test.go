@@ -0,0 +1,100 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "testing"
+
+func TestFluxLimiters(t *testing.T) {
+	limiters := map[string]FluxLimiter{
+		"van Leer":            VanLeer,
+		"minmod":              MinMod,
+		"monotonized central": MonotonizedCentral,
+	}
+	for name, φ := range limiters {
+		// Second-order accuracy requires φ(1) = 1.
+		if φ(1) != 1 {
+			t.Errorf("%s: φ(1) = %g", name, φ(1))
+		}
+		for _, r := range []float64{-10, -1, -0.1, 0, 0.1, 0.5, 1, 2, 3, 100} {
+			v := φ(r)
+			// At extrema, the scheme should be first-order.
+			if r <= 0 && v != 0 {
+				t.Errorf("%s: φ(%g) = %g, but it should be 0", name, r, v)
+			}
+			// TVD region (Sweby, 1984).
+			if v < 0 || v > 2 || v > 2*r*(1+1.e-12) && r > 0 {
+				t.Errorf("%s: φ(%g) = %g is outside of the TVD region", name, r, v)
+			}
+		}
+	}
+}
+
+// Test whether mass is conserved during flux-limited advection.
+func TestFluxLimitedAdvection(t *testing.T) {
+	const tolerance = 1.e-8
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+
+	for _, limiter := range []FluxLimiter{VanLeer, MinMod, MonotonizedCentral} {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(FluxLimitedAdvection(limiter)),
+				SteadyStateConvergenceCheck(2, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		var cellGroups = [][]*Cell{d.cells, d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary}
+
+		for testRow := 0; testRow < len(d.cells); testRow++ {
+			ResetCells()(d)
+			d.Done = false
+			d.convergence = nil
+
+			// Add emissions
+			c := d.cells[testRow]
+			c.Ci[0] += E / c.Dz / c.Dy / c.Dx
+			c.Cf[0] += E / c.Dz / c.Dy / c.Dx
+
+			if err := d.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			sum := 0.
+			for _, cellGroup := range cellGroups {
+				for _, c := range cellGroup {
+					sum += c.Cf[0] * c.Dy * c.Dx * c.Dz
+				}
+			}
+			if different(sum, E, tolerance) {
+				t.Errorf("row %d emis: sum=%.12g (it should equal %v)\n", testRow, sum, E)
+			}
+		}
+	}
+}
@@ -24,10 +24,11 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
-	"bitbucket.org/ctessum/aqhealth"
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/index/rtree"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -63,6 +64,10 @@ type InMAP struct {
 	Dt      float64 // seconds
 	nlayers int     // number of model layers
 
+	// Time is the current simulation time. It is only used by
+	// time-resolved (transient) simulations.
+	Time time.Time
+
 	// Done specifies whether the simulation is finished.
 	Done bool
 
@@ -83,13 +88,70 @@ type InMAP struct {
 	// field in each Cell.
 	popIndices map[string]int
 
+	// healthImpacts are the health impact output variables, by name.
+	healthImpacts map[string]HealthImpact
+
+	// deathsImpacts are the health impacts used for the "<pop> deaths"
+	// output variables, by population type (see SetHealthImpacts).
+	deathsImpacts map[string]HealthImpact
+
+	// valuation specifies how the deaths variables are monetized.
+	valuation *Valuation
+
+	// boundaryConditions specifies the concentrations in the boundary
+	// cells, which are zero if it is nil.
+	boundaryConditions BoundaryConditions
+
 	// index is a spatial index of Cells.
 	index *rtree.Rtree
+
+	// convergence and log hold the internal states of
+	// SteadyStateConvergenceCheck and Log, respectively.
+	convergence *convergenceState
+	log         *logState
+
+	// extrapolation holds the internal state of AitkenExtrapolation.
+	extrapolation *extrapolationState
+
+	// interrupted holds the reason the simulation was stopped before
+	// it converged, if it was.
+	interrupted error
+
+	// timestepClasses is the requested number of time step classes and
+	// maxTimestepClass is the largest class currently assigned to a cell.
+	timestepClasses, maxTimestepClass int
+
+	// noVerticalDiffusionTimestep is true if the stability of vertical
+	// diffusion is not considered when setting the time step.
+	noVerticalDiffusionTimestep bool
+
+	// verticalSystem holds the connections between vertically neighboring
+	// cells for ImplicitVerticalDiffusion.
+	verticalSystem *verticalSystem
+
+	// plumeColumns holds the meteorology and plume rise in the vertical
+	// column of grid cells that each cell is in, for placing elevated
+	// emissions. It is guarded by plumeMu.
+	plumeColumns map[*Cell]*plumeColumn
+	plumeMu      sync.Mutex
+
+	// retiredBudget holds the mass budget terms of grid and boundary
+	// cells that have been deleted from the domain.
+	retiredBudget *MassBudget
 }
 
 // Init initializes the simulation by running d.InitFuncs.
 func (d *InMAP) Init() error {
+	return d.InitContext(context.Background())
+}
+
+// InitContext is the same as Init, except that it stops and returns
+// ctx.Err() if ctx is cancelled before all of d.InitFuncs have run.
+func (d *InMAP) InitContext(ctx context.Context) error {
 	for _, f := range d.InitFuncs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := f(d); err != nil {
 			return err
 		}
@@ -99,7 +161,20 @@ func (d *InMAP) Init() error {
 
 // Run carries out the simulation by running d.RunFuncs until d.Done is true.
 func (d *InMAP) Run() error {
+	return d.RunContext(context.Background())
+}
+
+// RunContext is the same as Run, except that it stops and returns
+// ctx.Err() if ctx is cancelled before d.Done is true. Cancellation is
+// checked between iterations, so the state of the simulation is always
+// consistent when RunContext returns and d.CleanupFuncs can still be run
+// to save the partially converged results.
+func (d *InMAP) RunContext(ctx context.Context) error {
 	for !d.Done {
+		if err := ctx.Err(); err != nil {
+			d.interrupted = err
+			return err
+		}
 		for _, f := range d.RunFuncs {
 			if err := f(d); err != nil {
 				return err
@@ -111,7 +186,16 @@ func (d *InMAP) Run() error {
 
 // Cleanup finishes the simulation by running d.CleanupFuncs.
 func (d *InMAP) Cleanup() error {
+	return d.CleanupContext(context.Background())
+}
+
+// CleanupContext is the same as Cleanup, except that it stops and returns
+// ctx.Err() if ctx is cancelled before all of d.CleanupFuncs have run.
+func (d *InMAP) CleanupContext(ctx context.Context) error {
 	for _, f := range d.CleanupFuncs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := f(d); err != nil {
 			return err
 		}
@@ -131,12 +215,14 @@ type Cell struct {
 	VDeviation float64 `desc:"Average deviation from North-South velocity" units:"m/s"`
 
 	AOrgPartitioning float64 `desc:"Organic particle partitioning" units:"fraction particles"`
-	BOrgPartitioning float64 // particle fraction
+	BOrgPartitioning float64 `desc:"Biogenic organic particle partitioning" units:"fraction particles"`
 	SPartitioning    float64 `desc:"Sulfur particle partitioning" units:"fraction particles"`
 	NOPartitioning   float64 `desc:"Nitrate particle partitioning" units:"fraction particles"`
 	NHPartitioning   float64 `desc:"Ammonium particle partitioning" units:"fraction particles"`
 	SO2oxidation     float64 `desc:"SO2 oxidation to SO4 by HO and H2O2" units:"1/s"`
 
+	NONO2partitioning float64 `desc:"Fraction of NOx nitrogen that is NO2 (vs. NO)" units:"fraction NO2"`
+
 	ParticleWetDep float64 `desc:"Particle wet deposition" units:"1/s"`
 	SO2WetDep      float64 `desc:"SO2 wet deposition" units:"1/s"`
 	OtherGasWetDep float64 `desc:"Wet deposition: other gases" units:"1/s"`
@@ -169,6 +255,14 @@ type Cell struct {
 	EmisFlux  []float64 // emissions [μg/m³/s]
 	CBaseline []float64 // Total baseline PM2.5 concentration.
 
+	// budget holds the mass budget terms accumulated in this cell
+	// since the beginning of the simulation [μg/m³].
+	budget [numBudgetTerms][]float64
+
+	// dryDepTime and wetDepTime are the simulation time [s] over which
+	// the dry and wet deposition budget terms have been accumulated.
+	dryDepTime, wetDepTime float64
+
 	west        []*Cell // Neighbors to the East
 	east        []*Cell // Neighbors to the West
 	south       []*Cell // Neighbors to the South
@@ -178,6 +272,15 @@ type Cell struct {
 	groundLevel []*Cell // Neighbors at ground level
 	boundary    bool    // Does this cell represent a boundary condition?
 
+	// dtClass is the time step class of the cell, which is advanced with
+	// a time step 2^dtClass times as long as that of the cells in class 0.
+	// See SetTimestepClasses.
+	dtClass int
+
+	// fluxRegisters hold fluxes calculated by this cell for neighbors in
+	// larger time step classes until they are applied to the neighbors.
+	fluxRegisters map[*Cell][]float64
+
 	westFrac, eastFrac   []float64 // Fraction of cell covered by each neighbor (adds up to 1).
 	northFrac, southFrac []float64 // Fraction of cell covered by each neighbor (adds up to 1).
 	aboveFrac, belowFrac []float64 // Fraction of cell covered by each neighbor (adds up to 1).
@@ -194,6 +297,7 @@ type Cell struct {
 	LayerHeight float64 `desc:"Height at layer bottom" units:"m"`
 
 	Temperature                float64 `desc:"Average temperature" units:"K"`
+	RelativeHumidity           float64 `desc:"Average relative humidity" units:"fraction"`
 	WindSpeed                  float64 `desc:"RMS wind speed" units:"m/s"`
 	WindSpeedInverse           float64 `desc:"RMS wind speed inverse" units:"(m/s)^(-1)"`
 	WindSpeedMinusThird        float64 `desc:"RMS wind speed^(-1/3)" units:"(m/s)^(-1/3)"`
@@ -217,7 +321,9 @@ func (d *InMAP) Cells() []*Cell {
 type DomainManipulator func(d *InMAP) error
 
 // CellManipulator is a class of functions that operate on a single grid cell,
-// using the given timestep Dt.
+// using the given timestep Dt. CellManipulators can read the initial
+// concentrations (Ci) of neighboring cells, but should only change
+// the cell they are given and its boundary cells (see BlockCalculations).
 type CellManipulator func(c *Cell, Dt float64)
 
 func (c *Cell) make() {
@@ -225,29 +331,37 @@ func (c *Cell) make() {
 	c.Cf = make([]float64, len(PolNames))
 	c.CBaseline = make([]float64, len(PolNames))
 	c.EmisFlux = make([]float64, len(PolNames))
+	c.makeBudget()
 }
 
 func (c *Cell) boundaryCopy() *Cell {
 	c2 := new(Cell)
 	c2.Polygonal = c.Polygonal
-	c2.Dx, c2.Dy, c2.Dz = c.Dx, c.Dy, c.Dz
-	c2.UAvg, c2.VAvg, c2.WAvg = c.UAvg, c.VAvg, c.WAvg
-	c2.UDeviation, c2.VDeviation = c.UDeviation, c.VDeviation
-	c2.Kxxyy, c2.Kzz = c.Kxxyy, c.Kzz
-	c2.M2u, c2.M2d = c.M2u, c.M2d
-	c2.Layer, c2.LayerHeight = c.Layer, c.LayerHeight
+	c.setBoundaryData(c2)
 	c2.boundary = true
 	c2.make()
-	c2.Volume = c2.Dx * c2.Dy * c2.Dz
 	c2.PopData = c.PopData
 	return c2
 }
 
+// setBoundaryData copies the dimensions and meteorology of c to
+// boundary cell b.
+func (c *Cell) setBoundaryData(b *Cell) {
+	b.Dx, b.Dy, b.Dz = c.Dx, c.Dy, c.Dz
+	b.UAvg, b.VAvg, b.WAvg = c.UAvg, c.VAvg, c.WAvg
+	b.UDeviation, b.VDeviation = c.UDeviation, c.VDeviation
+	b.Kxxyy, b.Kzz = c.Kxxyy, c.Kzz
+	b.M2u, b.M2d = c.M2u, c.M2d
+	b.Layer, b.LayerHeight = c.Layer, c.LayerHeight
+	b.Volume = b.Dx * b.Dy * b.Dz
+}
+
 // addWestBoundary adds a cell to the western boundary of the domain.
 func (d *InMAP) addWestBoundary(cell *Cell) {
 	c := cell.boundaryCopy()
 	cell.west = []*Cell{c}
 	d.westBoundary = append(d.westBoundary, c)
+	d.setBoundaryConcentrations("west", c, cell)
 }
 
 // addEastBoundary adds a cell to the eastern boundary of the domain.
@@ -255,6 +369,7 @@ func (d *InMAP) addEastBoundary(cell *Cell) {
 	c := cell.boundaryCopy()
 	cell.east = []*Cell{c}
 	d.eastBoundary = append(d.eastBoundary, c)
+	d.setBoundaryConcentrations("east", c, cell)
 }
 
 // addSouthBoundary adds a cell to the southern boundary of the domain.
@@ -262,6 +377,7 @@ func (d *InMAP) addSouthBoundary(cell *Cell) {
 	c := cell.boundaryCopy()
 	cell.south = []*Cell{c}
 	d.southBoundary = append(d.southBoundary, c)
+	d.setBoundaryConcentrations("south", c, cell)
 }
 
 // addNorthBoundary adds a cell to the northern boundary of the domain.
@@ -269,6 +385,7 @@ func (d *InMAP) addNorthBoundary(cell *Cell) {
 	c := cell.boundaryCopy()
 	cell.north = []*Cell{c}
 	d.northBoundary = append(d.northBoundary, c)
+	d.setBoundaryConcentrations("north", c, cell)
 }
 
 // addTopBoundary adds a cell to the top boundary of the domain.
@@ -276,6 +393,7 @@ func (d *InMAP) addTopBoundary(cell *Cell) {
 	c := cell.boundaryCopy()
 	cell.above = []*Cell{c}
 	d.topBoundary = append(d.topBoundary, c)
+	d.setBoundaryConcentrations("top", c, cell)
 }
 
 // SetTimestepCFL returns a function that sets the time step using the
@@ -283,29 +401,31 @@ func (d *InMAP) addTopBoundary(cell *Cell) {
 // for advection or Von Neumann stability analysis
 // (http://en.wikipedia.org/wiki/Von_Neumann_stability_analysis) for
 // diffusion, whichever one yields a smaller time step.
+// All grid cells are advanced using the same time step.
 func SetTimestepCFL() DomainManipulator {
-	return func(d *InMAP) error {
-		const Cmax = 1.
-		sqrt3 := math.Pow(3., 0.5)
-		for i, c := range d.cells {
-			// Advection time step
-			dt1 := Cmax / sqrt3 /
-				max((math.Abs(c.UAvg)+c.UDeviation*2)/c.Dx,
-					(math.Abs(c.VAvg)+c.VDeviation*2)/c.Dy,
-					math.Abs(c.WAvg)/c.Dz)
-			// vertical diffusion time step
-			dt2 := Cmax * c.Dz * c.Dz / 2. / c.Kzz
-			// horizontal diffusion time step
-			dt3 := Cmax * c.Dx * c.Dx / 2. / c.Kxxyy
-			dt4 := Cmax * c.Dy * c.Dy / 2. / c.Kxxyy
-			if i == 0 {
-				d.Dt = amin(dt1, dt2, dt3, dt4) // seconds
-			} else {
-				d.Dt = amin(d.Dt, dt1, dt2, dt3, dt4) // seconds
-			}
-		}
-		return nil
+	return SetTimestepClasses(1)
+}
+
+// cflTimestep returns the largest stable time step for c [s], as
+// described in the documentation for SetTimestepCFL. The stability of
+// vertical diffusion is only considered if verticalDiffusion is true.
+func (c *Cell) cflTimestep(verticalDiffusion bool) float64 {
+	const Cmax = 1.
+	sqrt3 := math.Pow(3., 0.5)
+	// Advection time step
+	dt1 := Cmax / sqrt3 /
+		max((math.Abs(c.UAvg)+c.UDeviation*2)/c.Dx,
+			(math.Abs(c.VAvg)+c.VDeviation*2)/c.Dy,
+			math.Abs(c.WAvg)/c.Dz)
+	// vertical diffusion time step
+	dt2 := Cmax * c.Dz * c.Dz / 2. / c.Kzz
+	// horizontal diffusion time step
+	dt3 := Cmax * c.Dx * c.Dx / 2. / c.Kxxyy
+	dt4 := Cmax * c.Dy * c.Dy / 2. / c.Kxxyy
+	if !verticalDiffusion {
+		return amin(dt1, dt3, dt4) // seconds
 	}
+	return amin(dt1, dt2, dt3, dt4) // seconds
 }
 
 func harmonicMean(a, b float64) float64 {
@@ -324,7 +444,7 @@ func (d *InMAP) toArray(varName string, layer int) []float64 {
 			return o
 		}
 		if layer < 0 || c.Layer == layer {
-			o = append(o, c.getValue(varName, d.popIndices))
+			o = append(o, d.value(c, varName))
 		}
 		c.mutex.RUnlock()
 	}
@@ -342,23 +462,21 @@ func (c *Cell) getValue(varName string, popIndices map[string]int) float64 {
 		for i, ii := range polConv.index {
 			o += c.Cf[ii] * polConv.conversion[i]
 		}
-		return o
+		return o * polConv.fractionIn(c)
 
 	} else if polConv, ok := baselinePolLabels[varName]; ok { // Baseline concentrations
 		var o float64
 		for i, ii := range polConv.index {
 			o += c.CBaseline[ii] * polConv.conversion[i]
 		}
-		return o
+		return o * polConv.fractionIn(c)
+
+	} else if conv, ok := depositionLabels[varName]; ok { // Deposition
+		return c.depositionFlux(conv)
 
 	} else if i, ok := popIndices[varName]; ok { // Population
 		return c.PopData[i]
 
-	} else if i, ok := popIndices[strings.Replace(varName, " deaths", "", 1)]; ok {
-		// Mortalities
-		rr := aqhealth.RRpm25Linear(c.getValue("Total PM2.5", popIndices))
-		return aqhealth.Deaths(rr, c.PopData[i], c.MortalityRate)
-
 	} // Everything else
 	val := reflect.ValueOf(c).Elem().FieldByName(varName)
 	switch val.Type().Kind() {
@@ -379,11 +497,17 @@ func (d *InMAP) getUnits(varName string) string {
 		return "μg/m³"
 	} else if _, ok := baselinePolLabels[varName]; ok { // Concentrations
 		return "μg/m³"
+	} else if conv, ok := depositionLabels[varName]; ok { // Deposition
+		return conv.units
 	} else if _, ok := d.popIndices[varName]; ok { // Population
 		return "people/grid cell"
 	} else if _, ok := d.popIndices[strings.Replace(varName, " deaths", "", 1)]; ok {
 		// Mortalities
 		return "deaths/grid cell"
+	} else if _, ok := d.healthImpacts[varName]; ok { // Health impacts
+		return "deaths/grid cell"
+	} else if _, ok := d.damagesDeaths(varName); ok { // Damages
+		return d.valuation.units()
 	}
 	// Everything else
 	t := reflect.TypeOf(*d.cells[0])
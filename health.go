@@ -0,0 +1,239 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// ConcentrationResponse is a concentration–response function for the
+// effect of long-term exposure to PM2.5 on mortality.
+type ConcentrationResponse struct {
+	// Name identifies the function in the names of output variables.
+	Name string
+
+	// RR returns the relative risk of death at a Total PM2.5
+	// concentration [μg/m³] compared to a concentration of zero.
+	RR func(conc float64) float64
+
+	// DRR returns the derivative of RR with respect to the concentration
+	// [m³/μg]. It is nil if the derivative is not known.
+	DRR func(conc float64) float64
+
+	// Sample returns a random realization of the function that reflects
+	// the statistical uncertainty in its coefficients. It is nil if the
+	// uncertainty is not known.
+	Sample func(r *rand.Rand) ConcentrationResponse
+}
+
+// LogLinear returns a log-linear concentration–response function,
+// where the relative risk is exp(beta × concentration) and beta is in
+// units of m³/μg.
+func LogLinear(name string, beta float64) ConcentrationResponse {
+	return ConcentrationResponse{
+		Name: name,
+		RR: func(conc float64) float64 {
+			return math.Exp(beta * conc)
+		},
+		DRR: func(conc float64) float64 {
+			return beta * math.Exp(beta*conc)
+		},
+	}
+}
+
+// UncertainLogLinear returns a log-linear concentration–response function
+// (see LogLinear) whose coefficient beta has standard error se [m³/μg].
+// Samples of the coefficient are normally distributed.
+func UncertainLogLinear(name string, beta, se float64) ConcentrationResponse {
+	cr := LogLinear(name, beta)
+	cr.Sample = func(r *rand.Rand) ConcentrationResponse {
+		return LogLinear(name, beta+se*r.NormFloat64())
+	}
+	return cr
+}
+
+// Krewski2009 returns the log-linear concentration–response function for
+// all-cause mortality from the American Cancer Society cohort
+// (Krewski et al., 2009, Research Report 140, Health Effects Institute),
+// with a relative risk of 1.06 (95% confidence interval 1.04–1.08)
+// for each 10 μg/m³ increase in PM2.5.
+func Krewski2009() ConcentrationResponse {
+	return UncertainLogLinear("Krewski2009", math.Log(1.06)/10,
+		(math.Log(1.08)-math.Log(1.04))/(2*1.96)/10)
+}
+
+// LePeule2012 returns the log-linear concentration–response function for
+// all-cause mortality from the Harvard Six Cities cohort
+// (Lepeule et al., 2012, Environmental Health Perspectives 120:965–970),
+// with a relative risk of 1.14 (95% confidence interval 1.07–1.22)
+// for each 10 μg/m³ increase in PM2.5.
+func LePeule2012() ConcentrationResponse {
+	return UncertainLogLinear("LePeule2012", math.Log(1.14)/10,
+		(math.Log(1.22)-math.Log(1.07))/(2*1.96)/10)
+}
+
+// GEMM returns the Global Exposure Mortality Model for non-accidental
+// mortality (noncommunicable diseases plus lower respiratory infections)
+// fit to the cohorts including the Chinese cohort (Burnett et al., 2018,
+// PNAS 115:9592–9597). The relative risk is not increased at concentrations
+// below the counterfactual concentration of 2.4 μg/m³. Samples of the
+// coefficient θ are normally distributed with its standard error.
+func GEMM() ConcentrationResponse {
+	const (
+		theta   = 0.1430
+		thetaSE = 0.01807
+	)
+	cr := gemm(theta)
+	cr.Sample = func(r *rand.Rand) ConcentrationResponse {
+		return gemm(theta + thetaSE*r.NormFloat64())
+	}
+	return cr
+}
+
+// gemm returns the GEMM function with coefficient theta.
+func gemm(theta float64) ConcentrationResponse {
+	const (
+		alpha = 1.6
+		mu    = 15.5
+		nu    = 36.8
+		cf    = 2.4 // μg/m³
+	)
+	rr := func(conc float64) float64 {
+		z := math.Max(0, conc-cf)
+		return math.Exp(theta * math.Log(z/alpha+1) / (1 + math.Exp(-(z-mu)/nu)))
+	}
+	return ConcentrationResponse{
+		Name: "GEMM",
+		RR:   rr,
+		DRR: func(conc float64) float64 {
+			if conc <= cf {
+				return 0
+			}
+			z := conc - cf
+			w := 1 / (1 + math.Exp(-(z-mu)/nu)) // logistic weight
+			// d/dz of θ·ln(z/α+1)·w, using dw/dz = w(1-w)/ν.
+			dExp := theta * (w/(z+alpha) + math.Log(z/alpha+1)*w*(1-w)/nu)
+			return rr(conc) * dExp
+		},
+	}
+}
+
+// HealthImpact specifies an output variable holding the number of deaths
+// among a population type caused by Total PM2.5, calculated with a
+// concentration–response function.
+type HealthImpact struct {
+	// Population is the population type, which must be one of the
+	// population types in the grid.
+	Population string
+
+	// CR is the concentration–response function.
+	CR ConcentrationResponse
+}
+
+// Name returns the name of the output variable, for example
+// "TotalPop deaths[GEMM]".
+func (h HealthImpact) Name() string {
+	return h.Population + " deaths[" + h.CR.Name + "]"
+}
+
+// deaths returns the number of deaths per year in grid cell c, where i is
+// the index of the population type in c.PopData. The baseline mortality
+// rate is observed at the baseline concentration, so the change
+// in mortality is calculated from the relative risk at the baseline plus
+// the modeled change in concentration relative to the risk at the baseline,
+// which matters when the concentration–response function is not linear.
+func (h HealthImpact) deaths(c *Cell, i int) float64 {
+	base := c.getValue("Baseline Total PM2.5", nil)
+	delta := c.getValue("Total PM2.5", nil)
+	return c.PopData[i] * c.MortalityRate / 100000 * (h.CR.RR(base+delta)/h.CR.RR(base) - 1)
+}
+
+// defaultCR returns the concentration–response function for the
+// "<pop> deaths" output variables of population types without a
+// health impact.
+func defaultCR() ConcentrationResponse {
+	return LogLinear("", math.Log(1.078)/10)
+}
+
+// SetHealthImpacts returns a function that adds an output variable for each
+// of the health impacts (see HealthImpact.Name). The first health impact
+// for each population type is also used for its "<pop> deaths" output
+// variable, which otherwise uses a log-linear function with a relative risk
+// of 1.078 for each 10 μg/m³ (Krewski et al., 2009). It should be run after
+// the grid is created.
+func SetHealthImpacts(impacts ...HealthImpact) DomainManipulator {
+	return func(d *InMAP) error {
+		if len(impacts) == 0 {
+			return nil
+		}
+		if _, ok := PolLabels["Total PM2.5"]; !ok {
+			return fmt.Errorf("inmap: health impacts require a 'Total PM2.5' output variable")
+		}
+		if _, ok := baselinePolLabels["Baseline Total PM2.5"]; !ok {
+			return fmt.Errorf("inmap: health impacts require a 'Baseline Total PM2.5' output variable")
+		}
+		d.healthImpacts = make(map[string]HealthImpact)
+		d.deathsImpacts = make(map[string]HealthImpact)
+		for _, h := range impacts {
+			if _, ok := d.popIndices[h.Population]; !ok {
+				return fmt.Errorf("inmap: health impact population type '%s' is not in the grid", h.Population)
+			}
+			if h.CR.RR == nil {
+				return fmt.Errorf("inmap: health impact '%s' has no concentration–response function", h.Name())
+			}
+			if _, ok := d.healthImpacts[h.Name()]; ok {
+				return fmt.Errorf("inmap: duplicate health impact '%s'", h.Name())
+			}
+			d.healthImpacts[h.Name()] = h
+			if _, ok := d.deathsImpacts[h.Population]; !ok {
+				d.deathsImpacts[h.Population] = h
+			}
+		}
+		return nil
+	}
+}
+
+// deathsImpact returns the health impact used for the "<pop> deaths"
+// output variable of population type pop.
+func (d *InMAP) deathsImpact(pop string) HealthImpact {
+	if h, ok := d.deathsImpacts[pop]; ok {
+		return h
+	}
+	return HealthImpact{Population: pop, CR: defaultCR()}
+}
+
+// value returns the value of variable varName in grid cell c, including
+// the health impact and damages variables.
+func (d *InMAP) value(c *Cell, varName string) float64 {
+	if h, ok := d.healthImpacts[varName]; ok {
+		return h.deaths(c, d.popIndices[h.Population])
+	}
+	if pop := strings.TrimSuffix(varName, " deaths"); pop != varName {
+		if i, ok := d.popIndices[pop]; ok {
+			return d.deathsImpact(pop).deaths(c, i)
+		}
+	}
+	if deaths, ok := d.damagesDeaths(varName); ok {
+		return d.value(c, deaths) * d.valuation.valuePerDeath()
+	}
+	return c.getValue(varName, d.popIndices)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHealthImpacts(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	newCell := func(base, delta float64) *Cell {
+		c := &Cell{PopData: []float64{1.e5}, MortalityRate: 800}
+		c.make()
+		c.CBaseline[iPM2_5] = base
+		c.Cf[iPM2_5] = delta
+		return c
+	}
+
+	// The deaths from a log-linear function don't depend on the baseline.
+	h := HealthImpact{Population: "TotalPop", CR: Krewski2009()}
+	want := 800 * (math.Pow(1.06, 0.5) - 1)
+	for _, base := range []float64{0, 10, 30} {
+		if have := h.deaths(newCell(base, 5), 0); absDifferent(have, want, testTolerance) {
+			t.Errorf("Krewski2009 at baseline %g: have %g, want %g", base, have, want)
+		}
+	}
+	if have := h.deaths(newCell(10, -5), 0); have >= 0 {
+		t.Errorf("Krewski2009: a decrease in concentration causes %g deaths", have)
+	}
+
+	// The GEMM function is concave, so the same change causes fewer
+	// deaths at a higher baseline concentration.
+	h = HealthImpact{Population: "TotalPop", CR: GEMM()}
+	if rr := h.CR.RR(2); rr != 1 {
+		t.Errorf("GEMM relative risk below the counterfactual concentration: have %g, want 1", rr)
+	}
+	low, high := h.deaths(newCell(5, 1), 0), h.deaths(newCell(50, 1), 0)
+	if low <= high || high <= 0 {
+		t.Errorf("GEMM deaths at low baseline (%g) are not greater than at high baseline (%g)", low, high)
+	}
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetHealthImpacts(
+				HealthImpact{Population: "TotalPop", CR: LePeule2012()},
+				HealthImpact{Population: "Black", CR: LogLinear("test", 0.01)},
+			),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.cells {
+		c.Cf[iPM2_5] = 1
+	}
+	r, err := d.Results(false, "TotalPop deaths[LePeule2012]", "Black deaths[test]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range d.cells {
+		if c.Layer > 0 {
+			break
+		}
+		want := c.PopData[popIndices["Black"]] * c.MortalityRate / 100000 * (math.Exp(0.01) - 1)
+		if have := r["Black deaths[test]"][i]; absDifferent(have, want, testTolerance*want) {
+			t.Errorf("cell %d: have %g deaths, want %g", i, have, want)
+		}
+	}
+	if u := d.getUnits("Black deaths[test]"); u != "deaths/grid cell" {
+		t.Errorf("units: have %s, want deaths/grid cell", u)
+	}
+
+	// The "<pop> deaths" variables use the first health impact for the
+	// population type, or the default function if there is none.
+	r, err = d.Results(false, "TotalPop deaths", "Black deaths", "Asian deaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range d.cells {
+		if c.Layer > 0 {
+			break
+		}
+		for _, test := range []struct {
+			name string
+			cr   ConcentrationResponse
+			pop  string
+		}{
+			{"TotalPop deaths", LePeule2012(), "TotalPop"},
+			{"Black deaths", LogLinear("test", 0.01), "Black"},
+			{"Asian deaths", defaultCR(), "Asian"},
+		} {
+			want := c.PopData[popIndices[test.pop]] * c.MortalityRate / 100000 * (test.cr.RR(1) - 1)
+			if have := r[test.name][i]; absDifferent(have, want, testTolerance*want) {
+				t.Errorf("%s cell %d: have %g deaths, want %g", test.name, i, have, want)
+			}
+		}
+	}
+
+	err = SetHealthImpacts(HealthImpact{Population: "Martians", CR: GEMM()})(d)
+	if err == nil {
+		t.Error("no error for a population type that is not in the grid")
+	}
+}
+
+func TestConcentrationResponseDerivative(t *testing.T) {
+	const h = 1.e-6
+	for _, cr := range []ConcentrationResponse{Krewski2009(), LogLinear("test", 0.01), GEMM()} {
+		for _, conc := range []float64{1, 5, 15, 40, 100} {
+			want := (cr.RR(conc+h) - cr.RR(conc-h)) / (2 * h)
+			if have := cr.DRR(conc); absDifferent(have, want, 1.e-6*math.Max(want, 1.e-3)) {
+				t.Errorf("%s at %g μg/m³: have dRR/dC %g, want %g", cr.Name, conc, have, want)
+			}
+		}
+		if s := cr.Sample; s != nil && s(rand.New(rand.NewSource(1))).DRR == nil {
+			t.Errorf("%s: sample has no derivative", cr.Name)
+		}
+	}
+}
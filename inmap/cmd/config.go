@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/ctessum/geom/proj"
@@ -56,6 +57,16 @@ type ConfigData struct {
 	// Can include environment variables.
 	EmissionsShapefiles []string
 
+	// EmissionTags are tags for source apportionment, one for each file in
+	// EmissionsShapefiles. The contribution of the emissions with each tag to
+	// the concentration output variables is available as an output variable
+	// with the tag added to the name, for example "Total PM2.5[tag=power]".
+	// Emissions records with a value in the "Tag" attribute column of
+	// the emissions shapefiles are tagged with that value instead.
+	// A tag of "" means the emissions are not tagged. If EmissionTags is
+	// empty, only the "Tag" attribute column is used.
+	EmissionTags []string
+
 	// EmissionUnits gives the units that the input emissions are in.
 	// Acceptable values are 'tons/year' and 'kg/year'.
 	EmissionUnits string
@@ -76,6 +87,126 @@ type ConfigData struct {
 	// is automatically calculated.
 	NumIterations int
 
+	// ConvergenceCriterion specifies how it is determined whether the
+	// simulation has converged when NumIterations < 1. Acceptable values
+	// are 'mass' (the default), which compares the total concentration of
+	// each pollutant in the domain; 'population', which compares the
+	// ground-level Total PM2.5 concentration weighted by the population type
+	// in VarGrid.PopGridColumn; and 'maxcell', which compares the largest
+	// change in concentration in any grid cell.
+	ConvergenceCriterion string
+
+	// ConvergenceTolerance is the relative change between convergence checks
+	// below which the simulation is considered to have converged.
+	// If it is not set, it is 0.001.
+	ConvergenceTolerance float64
+
+	// ConvergenceAcceleration specifies a method for reaching steady
+	// state in fewer iterations. Acceptable values are 'none' (the default)
+	// and 'aitken', which periodically extrapolates the concentrations
+	// toward steady state using Aitken's delta-squared method.
+	ConvergenceAcceleration string
+
+	// VerticalDiffusionScheme specifies how vertical diffusion is calculated.
+	// Acceptable values are 'explicit' (the default); 'implicit', which uses
+	// the backward Euler method; and 'cranknicolson', which uses the
+	// Crank–Nicolson method. The implicit methods allow longer time steps
+	// because the time step is not limited by the stability of vertical diffusion.
+	VerticalDiffusionScheme string
+
+	// TimestepClasses is the maximum number of time step classes that the
+	// grid cells are grouped into. Cells in each class are advanced with a
+	// time step twice as long as the cells in the previous class, so that
+	// large grid cells are not advanced using the short time step required
+	// by the smallest cells. If TimestepClasses is less than 2, all cells
+	// are advanced using the same time step.
+	TimestepClasses int
+
+	// AdvectionScheme specifies the numerical scheme used to calculate
+	// horizontal advection. Acceptable values are 'upwind' (the default),
+	// which is first-order, and 'vanleer', 'minmod', and 'mc', which are
+	// second-order, flux-limited schemes using the van Leer, minmod, and
+	// monotonized central flux limiters, respectively.
+	AdvectionScheme string
+
+	// InorganicPartitioning specifies how ammonia and nitrate are partitioned
+	// between the gas and particle phases. Acceptable values are 'baseline'
+	// (the default), which uses the partitioning in the baseline CTM data,
+	// and 'equilibrium', which calculates sulfate-nitrate-ammonium
+	// thermodynamic equilibrium so that the partitioning can change in
+	// response to changes in emissions. 'equilibrium' requires temperature
+	// and relative humidity in the CTM data.
+	InorganicPartitioning string
+
+	// BreathingRate is the average breathing rate [m³/day] that is used to
+	// calculate the intake fraction. If it is zero, 15 m³/day is used.
+	BreathingRate float64
+
+	// HealthImpacts specifies additional mortality output variables, each
+	// calculated for one of the CensusPopColumns using a
+	// concentration–response function. Each creates an output variable
+	// named for the population and function, for example
+	// "TotalPop deaths[GEMM]". The first function for each population type
+	// is also used for its "<pop> deaths" output variable, for example
+	// "TotalPop deaths".
+	HealthImpacts []HealthImpactConfig
+
+	// Valuation specifies how the deaths output variables are monetized
+	// to create damages output variables, for example "TotalPop damages".
+	// If Valuation.VSL is zero, damages are not calculated.
+	Valuation inmap.Valuation
+
+	// Uncertainty specifies a Monte Carlo analysis of the uncertainty in
+	// the HealthImpacts deaths. The percentiles of the total deaths are
+	// printed at the end of the simulation, and the percentiles of the deaths
+	// in each ground-level grid cell are written to a file next to
+	// OutputFile with the suffix "_uncertainty.csv". If Uncertainty.Samples
+	// is zero, the uncertainty is not calculated. If Uncertainty.Percentiles
+	// is empty, the 2.5th, 50th, and 97.5th percentiles are reported.
+	Uncertainty inmap.Uncertainty
+
+	// Equity specifies the exposure equity results that are printed at the
+	// end of the simulation. The Lorenz curves of exposure are written to a
+	// file next to OutputFile with the suffix "_lorenzcurves.csv".
+	Equity EquityConfig
+
+	// BoundaryConditions specifies the concentrations of pollutants that
+	// flow into the domain through its edges. Acceptable values are 'zero'
+	// (the default), which is appropriate for simulations of the marginal
+	// effect of emissions, 'baseline', which uses the baseline
+	// concentrations in the grid cells at the edges of the domain, and 'file',
+	// which uses the concentrations in BoundaryConditionsFile.
+	BoundaryConditions string
+
+	// BoundaryConditionsFile is the path to a CSV file with columns 'Face'
+	// ('west', 'east', 'north', 'south', or 'top'), 'Species', and
+	// 'Concentration' [μg/m³], giving the concentration of each model
+	// species on each face of the domain. It is only used if
+	// BoundaryConditions is 'file', and it can include environment variables.
+	BoundaryConditionsFile string
+
+	// Plume specifies how emissions from elevated sources are placed in
+	// the vertical layers. Plume.Rise is the plume rise parameterization:
+	// 'ASME' (the default) or 'Briggs'. Plume.Profile is 'layer' (the
+	// default), which puts each plume in the layer that contains its
+	// effective height, or 'tophat' or 'gaussian', which spread each plume
+	// over Plume.Depth meters around its effective height.
+	Plume inmap.PlumeOptions
+
+	// CheckpointFile is the path to a file where the state of the simulation
+	// should be periodically saved, so that the simulation can be resumed
+	// if it is interrupted. If CheckpointFile is "", no checkpoints are saved.
+	// It can contain environment variables.
+	CheckpointFile string
+
+	// CheckpointPeriod is the simulation time in seconds between checkpoints.
+	// If it is not set, checkpoints are saved once per simulated day.
+	CheckpointPeriod float64
+
+	// Transient holds information for time-resolved simulations, which
+	// are run using 'inmap run transient'.
+	Transient TransientConfig
+
 	// Port for hosting web page. If HTTPport is `8080`, then the GUI
 	// would be viewed by visiting `localhost:8080` in a web browser.
 	// If HTTPport is "", then the web server doesn't run.
@@ -90,6 +221,204 @@ type ConfigData struct {
 	SROutputFile string
 
 	sr *proj.SR
+
+	// convergence is the criterion specified by ConvergenceCriterion.
+	convergence inmap.ConvergenceCriterion
+
+	// advection calculates advection using AdvectionScheme.
+	advection inmap.CellManipulator
+
+	// inorganicEquilibrium calculates the inorganic partitioning if
+	// InorganicPartitioning is 'equilibrium', and is nil otherwise.
+	inorganicEquilibrium inmap.CellManipulator
+
+	// healthImpacts are the health impacts specified by HealthImpacts.
+	healthImpacts []inmap.HealthImpact
+
+	// implicitVerticalDiffusion is the θ parameter for implicit vertical
+	// diffusion, or 0 if vertical diffusion is explicit.
+	implicitVerticalDiffusion float64
+}
+
+// TransientConfig holds configuration information for time-resolved
+// simulations.
+type TransientConfig struct {
+	// StartTime and EndTime are the beginning and end of the simulation
+	// in RFC 3339 format, for example "2005-07-01T00:00:00-05:00".
+	// The time zone of StartTime is used to determine the local hour and day
+	// for the temporal profiles.
+	StartTime, EndTime string
+
+	// OutputInterval is the simulation time between outputs, for example
+	// "1h" or "30m". The concentrations at each output time are written to
+	// a separate file, with the time added to the name of OutputFile.
+	OutputInterval string
+
+	// HourlyProfile, WeeklyProfile, and MonthlyProfile are factors
+	// that the annual average emissions are multiplied by in each hour of
+	// the day (24 values, starting at midnight), each day of the week
+	// (7 values, starting on Sunday), and each month of the year (12 values,
+	// starting in January). Each profile should average to one. If a profile
+	// is not specified, emissions do not vary at that time scale.
+	HourlyProfile, WeeklyProfile, MonthlyProfile []float64
+
+	// CTMData is a sequence of CTM data files in the same format as
+	// InMAPData, for example one for each month, and the times that each one
+	// starts to apply. If it is empty, the data in InMAPData is used for the
+	// whole simulation.
+	CTMData []CTMDataFile
+
+	start, end     time.Time
+	outputInterval time.Duration
+	profile        *inmap.TemporalProfile
+}
+
+// HealthImpactConfig specifies a concentration–response function
+// for calculating the deaths among a population type.
+type HealthImpactConfig struct {
+	// Population is the population type, which must be one of
+	// VarGrid.CensusPopColumns.
+	Population string
+
+	// Function is the concentration–response function. Acceptable values
+	// are 'Krewski2009', 'LePeule2012', 'GEMM', and 'LogLinear'.
+	Function string
+
+	// Beta is the coefficient of the 'LogLinear' function, in units of
+	// m³/μg, for example ln(1.06)/10 for a relative risk of 1.06 for each
+	// 10 μg/m³ increase in concentration.
+	Beta float64
+
+	// BetaSE is the standard error of Beta, which is used in the
+	// uncertainty analysis (see ConfigData.Uncertainty).
+	BetaSE float64
+
+	// Name is the name of the 'LogLinear' function in the output
+	// variable name. If it is "", 'LogLinear' is used.
+	Name string
+}
+
+// healthImpact checks the health impact configuration and converts it to
+// the type used by the model.
+func (h HealthImpactConfig) healthImpact(popColumns []string) (inmap.HealthImpact, error) {
+	var found bool
+	for _, p := range popColumns {
+		if p == h.Population {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return inmap.HealthImpact{}, fmt.Errorf("HealthImpacts population type `%s` is not "+
+			"one of the VarGrid.CensusPopColumns", h.Population)
+	}
+	var cr inmap.ConcentrationResponse
+	switch h.Function {
+	case "Krewski2009":
+		cr = inmap.Krewski2009()
+	case "LePeule2012":
+		cr = inmap.LePeule2012()
+	case "GEMM":
+		cr = inmap.GEMM()
+	case "LogLinear":
+		if h.Beta <= 0 {
+			return inmap.HealthImpact{}, fmt.Errorf("HealthImpacts Beta for the LogLinear " +
+				"function needs to be greater than zero")
+		}
+		name := h.Name
+		if name == "" {
+			name = "LogLinear"
+		}
+		cr = inmap.UncertainLogLinear(name, h.Beta, h.BetaSE)
+	default:
+		return inmap.HealthImpact{}, fmt.Errorf("the HealthImpacts Function variable in the "+
+			"configuration file needs to be set to Krewski2009, LePeule2012, GEMM, or "+
+			"LogLinear, but is currently set to `%s`", h.Function)
+	}
+	return inmap.HealthImpact{Population: h.Population, CR: cr}, nil
+}
+
+// EquityConfig specifies how exposure equity is calculated.
+type EquityConfig struct {
+	// Variable is the concentration output variable that exposure is
+	// calculated for. If it is "", "Total PM2.5" is used.
+	Variable string
+
+	// Reference is the population type that the exposure of each
+	// population type is compared to, which must be one of
+	// VarGrid.CensusPopColumns. If it is "", the first of the
+	// CensusPopColumns is used.
+	Reference string
+
+	// Epsilon is the inequality aversion parameter of the Atkinson index,
+	// which should be negative for harmful exposures such as PM2.5.
+	// If it is not set, -1 is used.
+	Epsilon *float64
+}
+
+// CTMDataFile specifies a CTM data file that applies during part of a
+// time-resolved simulation.
+type CTMDataFile struct {
+	// Start is the time, in RFC 3339 format, when the data starts to apply.
+	// It stops applying when the next file starts to apply.
+	Start string
+
+	// File is the path to the file. It can include environment variables.
+	File string
+
+	start time.Time
+}
+
+// parse checks the transient configuration and converts it to the types
+// used by the model.
+func (t *TransientConfig) parse() error {
+	var err error
+	if t.start, err = time.Parse(time.RFC3339, t.StartTime); err != nil {
+		return fmt.Errorf("invalid Transient.StartTime: %v", err)
+	}
+	if t.end, err = time.Parse(time.RFC3339, t.EndTime); err != nil {
+		return fmt.Errorf("invalid Transient.EndTime: %v", err)
+	}
+	if !t.end.After(t.start) {
+		return fmt.Errorf("Transient.EndTime must be after Transient.StartTime")
+	}
+	if t.outputInterval, err = time.ParseDuration(t.OutputInterval); err != nil {
+		return fmt.Errorf("invalid Transient.OutputInterval: %v", err)
+	}
+	if t.outputInterval <= 0 {
+		return fmt.Errorf("Transient.OutputInterval must be greater than zero")
+	}
+
+	t.profile = inmap.UniformTemporalProfile()
+	for _, p := range []struct {
+		name    string
+		factors []float64
+		profile []float64
+	}{
+		{"HourlyProfile", t.HourlyProfile, t.profile.Hourly[:]},
+		{"WeeklyProfile", t.WeeklyProfile, t.profile.Weekly[:]},
+		{"MonthlyProfile", t.MonthlyProfile, t.profile.Monthly[:]},
+	} {
+		if len(p.factors) == 0 {
+			continue
+		}
+		if len(p.factors) != len(p.profile) {
+			return fmt.Errorf("Transient.%s has %d values but should have %d",
+				p.name, len(p.factors), len(p.profile))
+		}
+		copy(p.profile, p.factors)
+	}
+
+	for i := range t.CTMData {
+		f := &t.CTMData[i]
+		if f.start, err = time.Parse(time.RFC3339, f.Start); err != nil {
+			return fmt.Errorf("invalid Transient.CTMData start time: %v", err)
+		}
+		if i > 0 && !f.start.After(t.CTMData[i-1].start) {
+			return fmt.Errorf("Transient.CTMData must be in order of increasing start time")
+		}
+	}
+	return nil
 }
 
 // ReadConfigFile reads and parses a TOML configuration file.
@@ -129,6 +458,13 @@ func ReadConfigFile(filename string) (config *ConfigData, err error) {
 	config.VarGrid.MortalityRateFile = os.ExpandEnv(config.VarGrid.MortalityRateFile)
 	config.SROutputFile = os.ExpandEnv(config.SROutputFile)
 	config.SRLogDir = os.ExpandEnv(config.SRLogDir)
+	config.CheckpointFile = os.ExpandEnv(config.CheckpointFile)
+	for i, f := range config.Transient.CTMData {
+		config.Transient.CTMData[i].File = os.ExpandEnv(f.File)
+	}
+	if config.CheckpointPeriod <= 0 {
+		config.CheckpointPeriod = 24 * 60 * 60
+	}
 
 	for i := 0; i < len(config.EmissionsShapefiles); i++ {
 		config.EmissionsShapefiles[i] =
@@ -156,12 +492,144 @@ func ReadConfigFile(filename string) (config *ConfigData, err error) {
 			"the OutputVariables section of the configuration file and try again.")
 	}
 
+	if len(config.EmissionTags) != 0 && len(config.EmissionTags) != len(config.EmissionsShapefiles) {
+		return nil, fmt.Errorf("there are %d EmissionTags in the configuration file, but there "+
+			"need to be either none or one for each of the %d EmissionsShapefiles",
+			len(config.EmissionTags), len(config.EmissionsShapefiles))
+	}
+
 	if config.EmissionUnits != "tons/year" && config.EmissionUnits != "kg/year" {
 		return nil, fmt.Errorf("the EmissionUnits variable in the configuration file "+
 			"needs to be set to either tons/year or kg/year, but is currently set to `%s`",
 			config.EmissionUnits)
 	}
 
+	switch config.ConvergenceCriterion {
+	case "", "mass":
+		config.convergence = inmap.MassConvergence()
+	case "population":
+		config.convergence = inmap.PopulationWeightedConvergence(config.VarGrid.PopGridColumn)
+	case "maxcell":
+		config.convergence = inmap.MaxCellChangeConvergence()
+	default:
+		return nil, fmt.Errorf("the ConvergenceCriterion variable in the configuration file "+
+			"needs to be set to mass, population, or maxcell, but is currently set to `%s`",
+			config.ConvergenceCriterion)
+	}
+	if config.ConvergenceTolerance == 0 {
+		config.ConvergenceTolerance = 0.001
+	} else if config.ConvergenceTolerance < 0 {
+		return nil, fmt.Errorf("the ConvergenceTolerance variable in the configuration file "+
+			"needs to be > 0, but is currently set to %g", config.ConvergenceTolerance)
+	}
+	if config.ConvergenceAcceleration != "" && config.ConvergenceAcceleration != "none" &&
+		config.ConvergenceAcceleration != "aitken" {
+		return nil, fmt.Errorf("the ConvergenceAcceleration variable in the configuration file "+
+			"needs to be set to none or aitken, but is currently set to `%s`",
+			config.ConvergenceAcceleration)
+	}
+
+	switch config.AdvectionScheme {
+	case "", "upwind":
+		config.advection = inmap.UpwindAdvection()
+	case "vanleer":
+		config.advection = inmap.FluxLimitedAdvection(inmap.VanLeer)
+	case "minmod":
+		config.advection = inmap.FluxLimitedAdvection(inmap.MinMod)
+	case "mc":
+		config.advection = inmap.FluxLimitedAdvection(inmap.MonotonizedCentral)
+	default:
+		return nil, fmt.Errorf("the AdvectionScheme variable in the configuration file "+
+			"needs to be set to upwind, vanleer, minmod, or mc, but is currently set to `%s`",
+			config.AdvectionScheme)
+	}
+
+	switch config.VerticalDiffusionScheme {
+	case "", "explicit":
+	case "implicit":
+		config.implicitVerticalDiffusion = 1
+	case "cranknicolson":
+		config.implicitVerticalDiffusion = 0.5
+	default:
+		return nil, fmt.Errorf("the VerticalDiffusionScheme variable in the configuration file "+
+			"needs to be set to explicit, implicit, or cranknicolson, but is currently set to `%s`",
+			config.VerticalDiffusionScheme)
+	}
+
+	switch config.InorganicPartitioning {
+	case "", "baseline":
+	case "equilibrium":
+		if config.inorganicEquilibrium, err = inmap.InorganicEquilibrium(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("the InorganicPartitioning variable in the configuration file "+
+			"needs to be set to baseline or equilibrium, but is currently set to `%s`",
+			config.InorganicPartitioning)
+	}
+
+	switch config.BoundaryConditions {
+	case "", "zero", "baseline":
+	case "file":
+		if config.BoundaryConditionsFile == "" {
+			return nil, fmt.Errorf("BoundaryConditionsFile needs to be specified when " +
+				"BoundaryConditions is 'file'")
+		}
+		config.BoundaryConditionsFile = os.ExpandEnv(config.BoundaryConditionsFile)
+	default:
+		return nil, fmt.Errorf("the BoundaryConditions variable in the configuration file "+
+			"needs to be set to zero, baseline, or file, but is currently set to `%s`",
+			config.BoundaryConditions)
+	}
+
+	if config.BreathingRate < 0 {
+		return nil, fmt.Errorf("the BreathingRate variable in the configuration file must not be negative")
+	} else if config.BreathingRate == 0 {
+		config.BreathingRate = 15 // m³/day
+	}
+
+	for _, h := range config.HealthImpacts {
+		hi, err := h.healthImpact(config.VarGrid.CensusPopColumns)
+		if err != nil {
+			return nil, err
+		}
+		config.healthImpacts = append(config.healthImpacts, hi)
+	}
+
+	if config.Equity.Variable == "" {
+		config.Equity.Variable = "Total PM2.5"
+	}
+	if config.Equity.Reference == "" && len(config.VarGrid.CensusPopColumns) > 0 {
+		config.Equity.Reference = config.VarGrid.CensusPopColumns[0]
+	}
+	if config.Equity.Reference != "" {
+		var found bool
+		for _, p := range config.VarGrid.CensusPopColumns {
+			if p == config.Equity.Reference {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Equity.Reference population type `%s` is not "+
+				"one of the VarGrid.CensusPopColumns", config.Equity.Reference)
+		}
+	}
+	if config.Equity.Epsilon == nil {
+		epsilon := -1.
+		config.Equity.Epsilon = &epsilon
+	}
+
+	if config.Uncertainty.Samples > 0 {
+		if len(config.HealthImpacts) == 0 {
+			return nil, fmt.Errorf("the uncertainty can only be calculated if HealthImpacts " +
+				"are specified in the configuration file")
+		}
+		if len(config.Uncertainty.Percentiles) == 0 {
+			config.Uncertainty.Percentiles = []float64{2.5, 50, 97.5}
+		}
+	}
+
 	outdir := filepath.Dir(config.OutputFile)
 	err = os.MkdirAll(outdir, os.ModePerm)
 	if err != nil {
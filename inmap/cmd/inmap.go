@@ -20,23 +20,67 @@ package cmd
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 
 	"github.com/spatialmodel/inmap"
+	"golang.org/x/net/context"
 )
 
+// signalContexts returns a context for running a simulation that is
+// cancelled when the program receives an interrupt or termination signal,
+// and a context for cleaning up the simulation that is cancelled if
+// a second signal is received. This allows the partial results of an
+// interrupted simulation to be saved, while still allowing the user to
+// exit immediately. stop should be called when the simulation is finished.
+func signalContexts() (run, cleanup context.Context, stop func()) {
+	run, cancelRun := context.WithCancel(context.Background())
+	cleanup, cancelCleanup := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sigChan:
+			log.Println("Received signal; stopping simulation and saving partial results. " +
+				"Send the signal again to exit without saving.")
+			cancelRun()
+		case <-done:
+			return
+		}
+		select {
+		case <-sigChan:
+			log.Println("Received second signal; exiting without saving results.")
+			cancelCleanup()
+		case <-done:
+		}
+	}()
+	stop = func() {
+		signal.Stop(sigChan)
+		close(done)
+		cancelRun()
+		cancelCleanup()
+	}
+	return run, cleanup, stop
+}
+
 func getCTMData() (*inmap.CTMData, error) {
 	log.Println("Reading input data...")
+	return loadCTMData(Config.InMAPData)
+}
 
-	f, err := os.Open(Config.InMAPData)
+// loadCTMData loads the CTM data in the file at path.
+func loadCTMData(path string) (*inmap.CTMData, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("Problem loading input data: %v\n", err)
 	}
+	defer f.Close()
 	ctmData, err := Config.VarGrid.LoadCTMData(f)
 	if err != nil {
 		return nil, fmt.Errorf("Problem loading input data: %v\n", err)
@@ -44,18 +88,52 @@ func getCTMData() (*inmap.CTMData, error) {
 	return ctmData, nil
 }
 
-// Run runs the model.
-func Run(dynamic, createGrid bool) error {
+// Run runs the model. If resume is not "", the simulation will be resumed
+// from the checkpoint file at that path. solver specifies how the steady
+// state is found: 'timestep' (or "") runs the simulation until it converges,
+// and 'linear' solves for the steady state directly.
+func Run(dynamic, createGrid bool, resume, solver string) error {
+
+	if dynamic && resume != "" {
+		return fmt.Errorf("simulations with dynamic grids cannot be resumed from checkpoints")
+	}
+	if dynamic && (Config.Uncertainty.DepositionGSD > 1 || Config.Uncertainty.PartitioningGSD > 1) {
+		return fmt.Errorf("the uncertainty in deposition and partitioning cannot be calculated " +
+			"for simulations with dynamic grids")
+	}
+	switch solver {
+	case "", "timestep":
+	case "linear":
+		if err := checkLinearSolver(dynamic, resume); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("the solver needs to be set to timestep or linear, but is currently set to `%s`", solver)
+	}
+	var resumeFile *os.File
+	if resume != "" {
+		// Open the checkpoint now in case we are about to replace it with
+		// new checkpoints.
+		var err error
+		resumeFile, err = os.Open(resume)
+		if err != nil {
+			return fmt.Errorf("problem reading checkpoint file: %v", err)
+		}
+		defer resumeFile.Close()
+	}
 
 	// Start a function to receive and print log messages.
-	cConverge := make(chan inmap.ConvergenceStatus)
+	cConverge := make(chan inmap.ConvergenceRecord)
 	cLog := make(chan *inmap.SimulationStatus)
+	cBudget := make(chan *inmap.MassBudget)
 	msgLog := make(chan string)
 	go func() {
 		for {
 			select {
 			case msg := <-cConverge:
 				fmt.Println(msg.String())
+			case msg := <-cBudget:
+				fmt.Println(msg.String())
 			case msg := <-cLog:
 				fmt.Println(msg.String())
 			case msg := <-msgLog:
@@ -64,8 +142,7 @@ func Run(dynamic, createGrid bool) error {
 		}
 	}()
 
-	emis, err := inmap.ReadEmissionShapefiles(Config.sr, Config.EmissionUnits,
-		msgLog, Config.EmissionsShapefiles...)
+	emis, mechanism, err := readEmissions(msgLog)
 	if err != nil {
 		return err
 	}
@@ -88,58 +165,60 @@ func Run(dynamic, createGrid bool) error {
 		}
 	}
 
-	scienceFuncs := inmap.Calculations(
-		inmap.UpwindAdvection(),
-		inmap.Mixing(),
-		inmap.MeanderMixing(),
-		inmap.DryDeposition(),
-		inmap.WetDeposition(),
-		inmap.Chemistry(),
-	)
+	scienceFuncs := scienceCalculations()
 
-	var initFuncs, runFuncs []inmap.DomainManipulator
+	// Report the mass budget as often as the convergence is checked.
+	const budgetPeriod = 3600. // seconds
+	reportBudget := inmap.RunPeriodically(budgetPeriod, inmap.ReportMassBudget(cBudget))
+
+	// rerunFuncs are the functions that are used to rerun the simulation
+	// for the uncertainty analysis, which does not save checkpoints.
+	var initFuncs, runFuncs, rerunFuncs []inmap.DomainManipulator
 	if !dynamic {
-		if createGrid {
-			initFuncs = []inmap.DomainManipulator{
-				inmap.HTMLUI(Config.HTTPAddress),
-				Config.VarGrid.RegularGrid(ctmData, pop, popIndices, mr, emis),
-				Config.VarGrid.MutateGrid(inmap.PopulationMutator(&Config.VarGrid, popIndices),
-					ctmData, pop, mr, emis),
-				inmap.SetTimestepCFL(),
-			}
-		} else {
-			var r io.Reader
-			r, err = os.Open(Config.VariableGridData)
-			if err != nil {
-				return fmt.Errorf("problem opening file to load VariableGridData: %v", err)
-			}
-			initFuncs = []inmap.DomainManipulator{
-				inmap.Load(r, &Config.VarGrid, emis),
-				inmap.SetTimestepCFL(),
-			}
+		initFuncs, err = staticGridInitFuncs(createGrid, ctmData, pop, popIndices, mr, emis)
+		if err != nil {
+			return err
+		}
+		if resume != "" {
+			initFuncs = append(initFuncs, inmap.Resume(resumeFile))
 		}
 		runFuncs = []inmap.DomainManipulator{
 			inmap.Log(cLog),
-			inmap.Calculations(inmap.AddEmissionsFlux()),
+			inmap.BlockCalculations(inmap.AddEmissionsFlux()),
 			scienceFuncs,
-			inmap.SteadyStateConvergenceCheck(Config.NumIterations, cConverge),
+			convergenceCheck(cConverge),
+			reportBudget,
+		}
+		if solver == "linear" {
+			runFuncs = []inmap.DomainManipulator{linearSteadyState(cConverge)}
+		}
+		rerunFuncs = runFuncs
+		if solver != "linear" && Config.CheckpointFile != "" {
+			runFuncs = append(runFuncs, inmap.Checkpoint(Config.CheckpointFile, Config.CheckpointPeriod))
 		}
 	} else {
+		if Config.CheckpointFile != "" {
+			log.Println("Checkpoints are not saved for simulations with dynamic grids.")
+		}
 		initFuncs = []inmap.DomainManipulator{
 			Config.VarGrid.RegularGrid(ctmData, pop, popIndices, mr, emis),
-			inmap.SetTimestepCFL(),
+			setTimestep(),
+			setBoundaryConditions(),
+			inmap.SetHealthImpacts(Config.healthImpacts...),
+			inmap.SetValuation(&Config.Valuation),
 		}
 		const gridMutateInterval = 3600. // seconds
 		runFuncs = []inmap.DomainManipulator{
 			inmap.Log(cLog),
-			inmap.Calculations(inmap.AddEmissionsFlux()),
+			inmap.BlockCalculations(inmap.AddEmissionsFlux()),
 			scienceFuncs,
 			inmap.RunPeriodically(gridMutateInterval,
 				Config.VarGrid.MutateGrid(inmap.PopConcMutator(
 					Config.VarGrid.PopConcThreshold, &Config.VarGrid, popIndices),
 					ctmData, pop, mr, emis)),
-			inmap.RunPeriodically(gridMutateInterval, inmap.SetTimestepCFL()),
-			inmap.SteadyStateConvergenceCheck(Config.NumIterations, cConverge),
+			inmap.RunPeriodically(gridMutateInterval, setTimestep()),
+			convergenceCheck(cConverge),
+			reportBudget,
 		}
 	}
 
@@ -147,10 +226,14 @@ func Run(dynamic, createGrid bool) error {
 		InitFuncs: initFuncs,
 		RunFuncs:  runFuncs,
 		CleanupFuncs: []inmap.DomainManipulator{
+			inmap.ReportMassBudget(cBudget),
 			inmap.Output(Config.OutputFile, Config.OutputAllLayers, Config.OutputVariables...),
 		},
 	}
-	if err = d.Init(); err != nil {
+	ctx, cleanupCtx, stop := signalContexts()
+	defer stop()
+
+	if err = d.InitContext(ctx); err != nil {
 		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
 	}
 
@@ -165,36 +248,338 @@ func Run(dynamic, createGrid bool) error {
 		fmt.Printf("%v, %g μg/s\n", pol, emisTotals[i])
 	}
 
-	if err = d.Run(); err != nil {
-		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+	runErr := d.RunContext(ctx)
+	if runErr != nil && runErr != context.Canceled {
+		return fmt.Errorf("InMAP: problem running simulation: %v\n", runErr)
 	}
 
-	if err = d.Cleanup(); err != nil {
+	if err = d.CleanupContext(cleanupCtx); err != nil {
 		return fmt.Errorf("InMAP: problem shutting down model.: %v\n", err)
 	}
+	if runErr != nil {
+		return fmt.Errorf("InMAP: simulation was interrupted before it converged; "+
+			"partial results have been written to %s", Config.OutputFile)
+	}
+
+	if err = printIntakeFraction(d); err != nil {
+		return err
+	}
+	printHealthTotals(d)
+	if err = printEquity(d); err != nil {
+		return err
+	}
+
+	if Config.Uncertainty.Samples > 0 {
+		log.Printf("Calculating the uncertainty using %d samples", Config.Uncertainty.Samples)
+		d.RunFuncs = rerunFuncs
+		r, err := d.Uncertainty(&Config.Uncertainty, mechanism)
+		if err != nil {
+			return fmt.Errorf("InMAP: problem calculating uncertainty: %v", err)
+		}
+		if err = r.WriteCSV(Config.OutputFile); err != nil {
+			return err
+		}
+		printUncertainty(r)
+	}
+	return nil
+}
+
+// readEmissions reads the emissions shapefiles and sets and returns the
+// chemical mechanism, which includes tagged species for source apportionment
+// if any of the emissions are tagged.
+func readEmissions(msgLog chan string) (*inmap.Emissions, *inmap.Mechanism, error) {
+	emis, err := inmap.ReadTaggedEmissionShapefiles(Config.sr, Config.EmissionUnits,
+		msgLog, Config.EmissionsShapefiles, Config.EmissionTags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = emis.SetPlume(Config.Plume); err != nil {
+		return nil, nil, err
+	}
+	m := inmap.DefaultMechanism()
+	if tags := emis.Tags(); len(tags) > 0 {
+		if Config.inorganicEquilibrium != nil {
+			return nil, nil, fmt.Errorf("tagged emissions cannot be used with equilibrium inorganic partitioning")
+		}
+		log.Printf("Tracking the contributions of emissions tagged %v", tags)
+		m = m.Tagged(tags...)
+	}
+	if err = inmap.SetMechanism(m); err != nil {
+		return nil, nil, err
+	}
+	return emis, m, nil
+}
+
+// staticGridInitFuncs returns functions that create a static
+// variable-resolution grid if createGrid is true, or otherwise load it from
+// the VariableGridData file, and then set the time step.
+func staticGridInitFuncs(createGrid bool, ctmData *inmap.CTMData, pop *inmap.Population,
+	popIndices inmap.PopIndices, mr *inmap.MortalityRates, emis *inmap.Emissions) ([]inmap.DomainManipulator, error) {
+	if createGrid {
+		return []inmap.DomainManipulator{
+			inmap.HTMLUI(Config.HTTPAddress),
+			Config.VarGrid.RegularGrid(ctmData, pop, popIndices, mr, emis),
+			Config.VarGrid.MutateGrid(inmap.PopulationMutator(&Config.VarGrid, popIndices),
+				ctmData, pop, mr, emis),
+			setTimestep(),
+			setBoundaryConditions(),
+			inmap.SetHealthImpacts(Config.healthImpacts...),
+			inmap.SetValuation(&Config.Valuation),
+		}, nil
+	}
+	r, err := os.Open(Config.VariableGridData)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+	}
+	return []inmap.DomainManipulator{
+		inmap.Load(r, &Config.VarGrid, emis),
+		setTimestep(),
+		setBoundaryConditions(),
+		inmap.SetHealthImpacts(Config.healthImpacts...),
+		inmap.SetValuation(&Config.Valuation),
+	}, nil
+}
+
+// setBoundaryConditions returns a function that sets the concentrations in
+// the boundary cells as specified by Config.BoundaryConditions.
+func setBoundaryConditions() inmap.DomainManipulator {
+	return func(d *inmap.InMAP) error {
+		switch Config.BoundaryConditions {
+		case "baseline":
+			return inmap.SetBoundaryConditions(inmap.BaselineBoundaryConditions())(d)
+		case "file":
+			f, err := os.Open(Config.BoundaryConditionsFile)
+			if err != nil {
+				return fmt.Errorf("problem opening BoundaryConditionsFile: %v", err)
+			}
+			defer f.Close()
+			bc, err := inmap.ReadBoundaryConditions(f)
+			if err != nil {
+				return err
+			}
+			return inmap.SetBoundaryConditions(bc)(d)
+		}
+		return nil
+	}
+}
+
+// setTimestep returns a function that sets the simulation time step,
+// grouping the grid cells into Config.TimestepClasses time step classes
+// if there is more than one. The stability of vertical diffusion is
+// not considered if it is calculated implicitly.
+func setTimestep() inmap.DomainManipulator {
+	explicit := Config.implicitVerticalDiffusion == 0
+	switch {
+	case Config.TimestepClasses > 1 && explicit:
+		return inmap.SetTimestepClasses(Config.TimestepClasses)
+	case Config.TimestepClasses > 1:
+		return inmap.SetTimestepClassesNoVerticalDiffusion(Config.TimestepClasses)
+	case explicit:
+		return inmap.SetTimestepCFL()
+	default:
+		return inmap.SetTimestepCFLNoVerticalDiffusion()
+	}
+}
+
+// scienceCalculations returns a function that calculates the physical and
+// chemical processes in each grid cell for one time step, using the
+// configured advection, vertical diffusion, and inorganic partitioning
+// schemes and multi-rate time stepping if there is more than one time step
+// class.
+func scienceCalculations() inmap.DomainManipulator {
+	mixing := inmap.Mixing()
+	if Config.implicitVerticalDiffusion != 0 {
+		mixing = inmap.MixingNoVerticalDiffusion()
+	}
+	funcs := []inmap.CellManipulator{
+		Config.advection,
+		mixing,
+		inmap.MeanderMixing(),
+		inmap.DryDeposition(),
+		inmap.WetDeposition(),
+		inmap.Chemistry(),
+	}
+	if Config.inorganicEquilibrium != nil {
+		funcs = append(funcs, Config.inorganicEquilibrium)
+	}
+	var calculations inmap.DomainManipulator
+	if Config.TimestepClasses > 1 {
+		calculations = inmap.MultirateCalculations(funcs...)
+	} else {
+		calculations = inmap.BlockCalculations(funcs...)
+	}
+	if Config.implicitVerticalDiffusion == 0 {
+		return calculations
+	}
+	verticalDiffusion := inmap.ImplicitVerticalDiffusion(Config.implicitVerticalDiffusion)
+	return func(d *inmap.InMAP) error {
+		if err := calculations(d); err != nil {
+			return err
+		}
+		return verticalDiffusion(d)
+	}
+}
+
+// checkLinearSolver returns an error if the simulation options are not
+// compatible with the linear steady-state solver.
+func checkLinearSolver(dynamic bool, resume string) error {
+	switch {
+	case dynamic:
+		return fmt.Errorf("the linear solver cannot be used with dynamic grids")
+	case resume != "":
+		return fmt.Errorf("the linear solver cannot be resumed from a checkpoint")
+	case Config.TimestepClasses > 1:
+		return fmt.Errorf("the linear solver cannot be used with more than one time step class")
+	case Config.AdvectionScheme != "" && Config.AdvectionScheme != "upwind":
+		return fmt.Errorf("the linear solver can only be used with the upwind advection scheme")
+	case Config.inorganicEquilibrium != nil:
+		return fmt.Errorf("the linear solver cannot be used with equilibrium inorganic partitioning")
+	}
+	return nil
+}
+
+// linearSteadyState returns a function that solves for the steady-state
+// concentrations directly. Vertical diffusion is always calculated explicitly
+// because the time step does not limit the stability of the solution.
+func linearSteadyState(c chan inmap.ConvergenceRecord) inmap.DomainManipulator {
+	const (
+		tolerance     = 1.e-8
+		maxIterations = 10000
+	)
+	return inmap.LinearSteadyState(tolerance, maxIterations, c,
+		inmap.UpwindAdvection(),
+		inmap.Mixing(),
+		inmap.MeanderMixing(),
+		inmap.DryDeposition(),
+		inmap.WetDeposition(),
+		inmap.Chemistry(),
+	)
+}
 
+// convergenceCheck returns a function that checks whether the simulation
+// has converged using the configured criterion, first extrapolating the
+// concentrations toward steady state if ConvergenceAcceleration is 'aitken'.
+func convergenceCheck(c chan inmap.ConvergenceRecord) inmap.DomainManipulator {
+	check := inmap.ConvergenceCheck(Config.NumIterations, Config.convergence,
+		Config.ConvergenceTolerance, c)
+	if Config.ConvergenceAcceleration != "aitken" || Config.NumIterations > 0 {
+		return check
+	}
+	// Extrapolate as often as the convergence is checked.
+	const extrapolationPeriod = 3600. // seconds
+	extrapolate := inmap.AitkenExtrapolation(extrapolationPeriod)
+	return func(d *inmap.InMAP) error {
+		if err := extrapolate(d); err != nil {
+			return err
+		}
+		return check(d)
+	}
+}
+
+// printIntakeFraction writes the intake fraction of Total PM2.5 caused by
+// each emitted pollutant to standard output and to a file next to
+// the output file.
+func printIntakeFraction(d *inmap.InMAP) error {
 	fmt.Println("\nIntake fraction results:")
-	breathingRate := 15. // [m³/day]
-	iF := d.IntakeFraction(breathingRate)
+	iF, err := d.TotalIntakeFraction(Config.BreathingRate, "Total PM2.5")
+	if err != nil {
+		return err
+	}
+	if err = inmap.WriteIntakeFraction(Config.OutputFile, iF); err != nil {
+		return err
+	}
 	// Write iF to stdout
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
-	var popList []string
-	for _, m := range iF {
-		for p := range m {
-			popList = append(popList, p)
+	var popList, emisList []string
+	for e, m := range iF {
+		emisList = append(emisList, e)
+		if popList == nil {
+			for p := range m {
+				popList = append(popList, p)
+			}
 		}
-		break
 	}
 	sort.Strings(popList)
-	fmt.Fprintln(w, strings.Join(append([]string{"pol"}, popList...), "\t"))
-	for pol, m := range iF {
+	sort.Strings(emisList)
+	fmt.Fprintln(w, strings.Join(append([]string{"emissions"}, popList...), "\t"))
+	for _, e := range emisList {
 		temp := make([]string, len(popList))
 		for i, pop := range popList {
-			temp[i] = fmt.Sprintf("%.3g", m[pop])
+			temp[i] = fmt.Sprintf("%.3g", iF[e][pop])
 		}
-		fmt.Fprintln(w, strings.Join(append([]string{pol}, temp...), "\t"))
+		fmt.Fprintln(w, strings.Join(append([]string{e}, temp...), "\t"))
 	}
 	w.Flush()
+	return nil
+}
 
+// printUncertainty writes the percentiles of the total deaths
+// to standard output.
+func printUncertainty(r *inmap.UncertaintyResults) {
+	fmt.Println("\nHealth impact uncertainty results:")
+	var names []string
+	for n := range r.Totals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	header := []string{"variable"}
+	for _, p := range r.Percentiles {
+		header = append(header, fmt.Sprintf("p%g", p))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, n := range names {
+		line := []string{n}
+		for _, v := range r.Totals[n] {
+			line = append(line, fmt.Sprintf("%.3g", v))
+		}
+		fmt.Fprintln(w, strings.Join(line, "\t"))
+	}
+	w.Flush()
+}
+
+// printEquity writes the population-weighted exposure and the inequality in
+// exposure for each population type, as specified by Config.Equity, to
+// standard output, and writes the Lorenz curves to a file.
+func printEquity(d *inmap.InMAP) error {
+	if len(Config.VarGrid.CensusPopColumns) == 0 {
+		return nil
+	}
+	e := Config.Equity
+	groups, err := d.Equity(e.Variable, e.Reference, *e.Epsilon)
+	if err != nil {
+		return err
+	}
+	if err = inmap.WriteLorenzCurves(Config.OutputFile, groups); err != nil {
+		return err
+	}
+	fmt.Printf("\nExposure equity results (%s, relative to %s, Atkinson ε=%g):\n",
+		e.Variable, e.Reference, *e.Epsilon)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintln(w, "pop\tpeople\tmean (μg/m³)\tbaseline mean (μg/m³)\t"+
+		"relative exposure\tshare of baseline\tAtkinson\tGini")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\t%.3g\n", g.Population, g.People,
+			g.MeanExposure, g.MeanBaselineExposure, g.RelativeExposure, g.Share,
+			g.Atkinson, g.Gini)
+	}
+	w.Flush()
 	return nil
 }
+
+// printHealthTotals writes the total of each deaths and damages output
+// variable to standard output.
+func printHealthTotals(d *inmap.InMAP) {
+	fmt.Println("\nHealth impact results:")
+	totals := d.HealthTotals()
+	var names []string
+	for n := range totals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s\t%.3g\n", n, totals[n])
+	}
+	w.Flush()
+}
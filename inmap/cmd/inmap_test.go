@@ -19,6 +19,8 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -39,7 +41,7 @@ func TestInMAPStaticCreateGrid(t *testing.T) {
 	if err := Startup("../configExample.toml"); err != nil {
 		t.Fatal(err)
 	}
-	if err := Run(dynamic, createGrid); err != nil {
+	if err := Run(dynamic, createGrid, "", "timestep"); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -51,7 +53,19 @@ func TestInMAPStaticLoadGrid(t *testing.T) {
 	if err := Startup("../configExample.toml"); err != nil {
 		t.Fatal(err)
 	}
-	if err := Run(dynamic, createGrid); err != nil {
+	if err := Run(dynamic, createGrid, "", "timestep"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInMAPStaticLinear(t *testing.T) {
+	dynamic := false
+	createGrid := false
+	os.Setenv("InMAPRunType", "staticLinear")
+	if err := Startup("../configExample.toml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(dynamic, createGrid, "", "linear"); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -63,7 +77,51 @@ func TestInMAPDynamic(t *testing.T) {
 	if err := Startup("../configExample.toml"); err != nil {
 		t.Fatal(err)
 	}
-	if err := Run(dynamic, createGrid); err != nil {
+	if err := Run(dynamic, createGrid, "", "timestep"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInMAPResume(t *testing.T) {
+	dynamic := false
+	createGrid := false
+	os.Setenv("InMAPRunType", "resume")
+	if err := Startup("../configExample.toml"); err != nil {
+		t.Fatal(err)
+	}
+	Config.CheckpointFile = "testCheckpoint.gob"
+	Config.CheckpointPeriod = 1
+	Config.NumIterations = 5
+	if err := Run(dynamic, createGrid, "", "timestep"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Config.CheckpointFile)
+	first, err := ioutil.ReadFile(Config.CheckpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.NumIterations = 10
+	if err := Run(dynamic, createGrid, Config.CheckpointFile, "timestep"); err != nil {
+		t.Fatal(err)
+	}
+	// The resumed simulation should have run more time steps, each of
+	// which replaces the checkpoint.
+	resumed, err := ioutil.ReadFile(Config.CheckpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, resumed) {
+		t.Error("the resumed simulation did not advance")
+	}
+}
+
+func TestInMAPTransient(t *testing.T) {
+	createGrid := false
+	os.Setenv("InMAPRunType", "transient")
+	if err := Startup("../configExample.toml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunTransient(createGrid); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -29,11 +29,19 @@ var (
 	// created on-the-fly for static runs rather than reading it from a file.
 	// For dynamic gridding, the grid is always created on-the-fly.
 	createGrid bool
+
+	// resume is the path to a checkpoint file that the simulation should be
+	// resumed from, if any.
+	resume string
+
+	// solver specifies how the steady-state concentrations are found.
+	solver string
 )
 
 func init() {
 	RootCmd.AddCommand(runCmd)
 	runCmd.AddCommand(steadyCmd)
+	runCmd.AddCommand(transientCmd)
 
 	steadyCmd.PersistentFlags().BoolVarP(&dynamic, "dynamic", "d", false,
 		"Run with a dynamic grid that changes resolution depending on spatial "+
@@ -42,6 +50,18 @@ func init() {
 		"Create the variable-resolution grid as specified in the configuration file"+
 			" before starting the simulation instead of reading it from a file. "+
 			"If --dynamic is set to true, then this flag will also be automatically set to true.")
+	steadyCmd.PersistentFlags().StringVar(&resume, "resume", "",
+		"Resume the simulation from the specified checkpoint file, which is created "+
+			"when the CheckpointFile configuration variable is set. Not available for dynamic grids.")
+	steadyCmd.PersistentFlags().StringVar(&solver, "solver", "timestep",
+		"How to find the steady-state concentrations: 'timestep' runs the simulation "+
+			"until it converges, and 'linear' solves the linear system of equations "+
+			"for the steady state directly. The linear solver is not available for "+
+			"dynamic grids, multiple time step classes, or flux-limited advection.")
+
+	transientCmd.PersistentFlags().BoolVar(&createGrid, "creategrid", false,
+		"Create the variable-resolution grid as specified in the configuration file"+
+			" before starting the simulation instead of reading it from a file.")
 
 }
 
@@ -49,7 +69,7 @@ var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run the model.",
 	Long: "run runs an InMAP simulation. Use the subcommands specified below to " +
-		" choose a run mode. (Currently 'steady' is the only avaible run mode.)",
+		" choose a run mode.",
 }
 
 // steadyCmd is a command that runs a steady-state simulation.
@@ -59,6 +79,20 @@ var steadyCmd = &cobra.Command{
 	Long: "steady runs InMAP in steady-state mode to calculate annual average " +
 		"concentrations with no temporal variability.",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return Run(dynamic, createGrid)
+		return Run(dynamic, createGrid, resume, solver)
+	},
+}
+
+// transientCmd is a command that runs a time-resolved simulation.
+var transientCmd = &cobra.Command{
+	Use:   "transient",
+	Short: "Run InMAP in time-resolved mode.",
+	Long: "transient runs InMAP in time-resolved mode to calculate a time series " +
+		"of concentrations between the start and end times specified in the " +
+		"Transient section of the configuration file. Emissions are varied " +
+		"using hourly, day-of-week, and monthly temporal profiles, and meteorology " +
+		"and baseline concentrations can be varied using a sequence of CTM data files.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return RunTransient(createGrid)
 	},
 }
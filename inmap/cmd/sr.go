@@ -28,6 +28,7 @@ import (
 	"github.com/spatialmodel/inmap"
 	"github.com/spatialmodel/inmap/sr"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -61,12 +62,15 @@ var srCmd = &cobra.Command{
     If $PBS_NODEFILE doesn't exist, the simulations will run on the
     local machine.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return RunSR(begin, end, layers)
+		ctx, _, stop := signalContexts()
+		defer stop()
+		return RunSR(ctx, begin, end, layers)
 	},
 }
 
-// RunSR runs the SR matrix creator.
-func RunSR(begin, end int, layers []int) error {
+// RunSR runs the SR matrix creator. No more simulations are started
+// after ctx is cancelled.
+func RunSR(ctx context.Context, begin, end int, layers []int) error {
 	nodes, err := rpccluster.PBSNodes()
 	if err != nil {
 		log.Printf("Problem reading $PBS_NODEFILE: %v. Continuing on local machine.", err)
@@ -84,7 +88,7 @@ func RunSR(begin, end int, layers []int) error {
 		return err
 	}
 
-	if err = sr.Run(Config.SROutputFile, layers, begin, end); err != nil {
+	if err = sr.RunContext(ctx, Config.SROutputFile, layers, begin, end); err != nil {
 		return err
 	}
 
@@ -101,7 +105,9 @@ var workerCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		return worker.Listen(sr.RPCPort)
+		ctx, _, stop := signalContexts()
+		defer stop()
+		return worker.ListenContext(ctx, sr.RPCPort)
 	},
 }
 
@@ -21,6 +21,8 @@ package cmd
 import (
 	"os"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 func TestSR(t *testing.T) {
@@ -31,7 +33,7 @@ func TestSR(t *testing.T) {
 	begin := 8
 	end := 9
 	layers := []int{0}
-	if err := RunSR(begin, end, layers); err != nil {
+	if err := RunSR(context.Background(), begin, end, layers); err != nil {
 		t.Fatal(err)
 	}
 	os.Remove(Config.SROutputFile)
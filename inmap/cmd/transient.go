@@ -0,0 +1,137 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spatialmodel/inmap"
+	"golang.org/x/net/context"
+)
+
+// RunTransient runs a time-resolved simulation using the settings in
+// Config.Transient. The simulation starts with no pollution in the domain,
+// so the first part of the simulation should be treated as spin-up time.
+func RunTransient(createGrid bool) error {
+	t := &Config.Transient
+	if err := t.parse(); err != nil {
+		return err
+	}
+
+	// Start a function to receive and print log messages.
+	cLog := make(chan *inmap.SimulationStatus)
+	cBudget := make(chan *inmap.MassBudget)
+	msgLog := make(chan string)
+	go func() {
+		for {
+			select {
+			case msg := <-cBudget:
+				fmt.Println(msg.String())
+			case msg := <-cLog:
+				fmt.Println(msg.String())
+			case msg := <-msgLog:
+				log.Println(msg)
+			}
+		}
+	}()
+
+	emis, _, err := readEmissions(msgLog)
+	if err != nil {
+		return err
+	}
+
+	// Only load the population if we're creating the grid.
+	var pop *inmap.Population
+	var mr *inmap.MortalityRates
+	var popIndices inmap.PopIndices
+	var ctmData *inmap.CTMData
+	if createGrid {
+		log.Println("Loading CTM data")
+		ctmData, err = getCTMData()
+		if err != nil {
+			return err
+		}
+		log.Println("Loading population and mortality rate data")
+		pop, popIndices, mr, err = Config.VarGrid.LoadPopMort()
+		if err != nil {
+			return err
+		}
+	}
+
+	initFuncs, err := staticGridInitFuncs(createGrid, ctmData, pop, popIndices, mr, emis)
+	if err != nil {
+		return err
+	}
+
+	periods := make([]inmap.CTMDataPeriod, len(t.CTMData))
+	for i, f := range t.CTMData {
+		file := f.File
+		periods[i] = inmap.CTMDataPeriod{
+			Start: f.start,
+			Load: func() (*inmap.CTMData, error) {
+				log.Printf("Loading CTM data from %s", file)
+				return loadCTMData(file)
+			},
+		}
+	}
+
+	// Report the mass budget at each output time.
+	budgetPeriod := t.outputInterval.Seconds()
+
+	d := &inmap.InMAP{
+		Time:      t.start,
+		InitFuncs: initFuncs,
+		RunFuncs: []inmap.DomainManipulator{
+			inmap.Log(cLog),
+			inmap.UpdateCTMData(periods, emis),
+			inmap.TemporalEmissions(t.profile),
+			scienceCalculations(),
+			inmap.AdvanceTime(),
+			inmap.TimeSeriesOutput(Config.OutputFile, t.start, t.outputInterval,
+				Config.OutputAllLayers, Config.OutputVariables...),
+			inmap.RunPeriodically(budgetPeriod, inmap.ReportMassBudget(cBudget)),
+			inmap.RunUntil(t.end),
+		},
+		CleanupFuncs: []inmap.DomainManipulator{
+			inmap.ReportMassBudget(cBudget),
+		},
+	}
+
+	ctx, cleanupCtx, stop := signalContexts()
+	defer stop()
+
+	if err = d.InitContext(ctx); err != nil {
+		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+	}
+
+	runErr := d.RunContext(ctx)
+	if runErr != nil && runErr != context.Canceled {
+		return fmt.Errorf("InMAP: problem running simulation: %v\n", runErr)
+	}
+
+	if err = d.CleanupContext(cleanupCtx); err != nil {
+		return fmt.Errorf("InMAP: problem shutting down model.: %v\n", err)
+	}
+	if runErr != nil {
+		return fmt.Errorf("InMAP: simulation was interrupted at %v; results have been "+
+			"written for the output times before then", d.Time)
+	}
+	return nil
+}
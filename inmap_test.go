@@ -20,12 +20,15 @@ package inmap
 
 import (
 	"math"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/index/rtree"
 	"github.com/gonum/floats"
+	"golang.org/x/net/context"
 )
 
 const E = 1000000. // emissions
@@ -567,6 +570,70 @@ func TestConverge(t *testing.T) {
 	}
 }
 
+// Test whether a cancelled simulation stops, still runs its cleanup
+// functions, and marks its output as not converged.
+func TestCancel(t *testing.T) {
+	const cancelIteration = 3
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	iterations := 0
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(
+				DryDeposition(),
+				WetDeposition(),
+			),
+			SteadyStateConvergenceCheck(-1, nil),
+			func(_ *InMAP) error {
+				iterations++
+				if iterations == cancelIteration {
+					cancel()
+				}
+				return nil
+			},
+		},
+		CleanupFuncs: []DomainManipulator{
+			Output(TestOutputFilename, false, "Primary PM2.5"),
+		},
+	}
+	if err := d.InitContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RunContext(ctx); err != context.Canceled {
+		t.Errorf("want error %v but have %v", context.Canceled, err)
+	}
+	if iterations != cancelIteration {
+		t.Errorf("simulation should have stopped after %d iterations but ran %d",
+			cancelIteration, iterations)
+	}
+	if d.Done {
+		t.Error("cancelled simulation should not be finished")
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	marker := strings.TrimSuffix(TestOutputFilename, ".shp") + notConvergedSuffix
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("output should be marked as not converged: %v", err)
+	}
+	os.Remove(marker)
+	DeleteShapefile(TestOutputFilename)
+}
+
 func BenchmarkRun(b *testing.B) {
 	const testTolerance = 1.e-8
 
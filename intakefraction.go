@@ -18,6 +18,16 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 
 package inmap
 
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 // IntakeFraction calculates intake fraction from InMAP results.
 // The input value is average breathing rate [m³/day].
 // The returned value is a map structure of intake fractions by
@@ -50,3 +60,162 @@ func (d *InMAP) IntakeFraction(
 	}
 	return iF
 }
+
+// TotalIntakeFraction calculates the intake fraction of the concentration in
+// output variable variable (for example, "Total PM2.5") caused by each
+// emitted pollutant, including the primary pollutant and all of the secondary
+// pollutants that it forms through reactions and gas-particle partitioning.
+// If the emissions are tagged, the intake fraction of each tagged pollutant
+// is calculated from the tagged version of variable (see Mechanism.Tagged).
+// The pathways of different emitted pollutants are assumed not to share
+// species, as is the case in DefaultMechanism. The intake fractions are the
+// mass of variable inhaled per unit mass of the pollutant as it is emitted,
+// for example per μg of NOx rather than of N.
+// The input value is average breathing rate [m³/day].
+// The returned value is a map structure of intake fractions by
+// emissions output variable name and population type
+// (map[emissions][population]iF).
+// This function will only give the correct results if run
+// after InMAP finishes calculating.
+func (d *InMAP) TotalIntakeFraction(breathingRate float64, variable string) (map[string]map[string]float64, error) {
+	if _, ok := PolLabels[variable]; !ok {
+		return nil, fmt.Errorf("inmap: intake fraction variable '%s' is not a concentration", variable)
+	}
+	conv := variableConversions(variable)
+
+	Qb := breathingRate / (24 * 60 * 60) // [m³/s]
+
+	iF := make(map[string]map[string]float64)
+	for l, ie := range emisLabels {
+		var pathway []int
+		for _, i := range formedSpecies(ie) {
+			if _, ok := conv[i]; ok {
+				pathway = append(pathway, i)
+			}
+		}
+		erate := 0. // emissions rate [μg/s of the emitted pollutant]
+		for _, c := range d.cells {
+			erate += c.EmisFlux[ie] * c.Volume
+		}
+		// EmisFlux is in units of the model species, for example N for NOx.
+		erate /= emisConversions[l]
+		iF[l] = make(map[string]float64)
+		for p, ip := range d.popIndices {
+			irate := 0. // inhalation rate [μg/s]
+			for _, c := range d.cells {
+				if c.Layer != 0 {
+					continue
+				}
+				var conc float64
+				for _, i := range pathway {
+					conc += c.Cf[i] * conv[i].conversion * conv[i].label.fractionIn(c)
+				}
+				irate += conc * Qb * c.PopData[ip]
+			}
+			if erate != 0 {
+				iF[l][p] = irate / erate
+			}
+		}
+	}
+	return iF, nil
+}
+
+// speciesConversion is the conversion of a species to the output variable
+// label.
+type speciesConversion struct {
+	conversion float64
+	label      polConv
+}
+
+// variableConversions returns the conversions of the species in output
+// variable variable and its tagged versions, by species index.
+func variableConversions(variable string) map[int]speciesConversion {
+	o := make(map[int]speciesConversion)
+	tagPrefix := strings.TrimSuffix(TagName(variable, ""), "]")
+	for name, pc := range PolLabels {
+		if name != variable && !strings.HasPrefix(name, tagPrefix) {
+			continue
+		}
+		for k, i := range pc.index {
+			o[i] = speciesConversion{conversion: pc.conversion[k], label: pc}
+		}
+	}
+	return o
+}
+
+// formedSpecies returns the index of species i and all of the species that
+// it forms through reactions and gas-particle partitioning.
+func formedSpecies(i int) []int {
+	found := map[int]bool{i: true}
+	o := []int{i}
+	for j := 0; j < len(o); j++ {
+		s := o[j]
+		var next []int
+		for _, r := range reactions {
+			if r.from == s {
+				next = append(next, r.to)
+			}
+		}
+		for _, p := range partitionings {
+			if p.gas == s {
+				next = append(next, p.particle)
+			} else if p.particle == s {
+				next = append(next, p.gas)
+			}
+		}
+		for _, n := range next {
+			if !found[n] {
+				found[n] = true
+				o = append(o, n)
+			}
+		}
+	}
+	return o
+}
+
+// intakeFractionSuffix is appended to the base name of an output file
+// to create the name of the file that holds the intake fractions.
+const intakeFractionSuffix = "_intakefraction.csv"
+
+// WriteIntakeFraction writes intake fractions in the form returned by
+// TotalIntakeFraction to a CSV file next to the output file fileName,
+// with the suffix "_intakefraction.csv". There is a row for each emissions
+// variable and a column for each population type.
+func WriteIntakeFraction(fileName string, iF map[string]map[string]float64) error {
+	f, err := os.Create(strings.TrimSuffix(fileName, filepath.Ext(fileName)) + intakeFractionSuffix)
+	if err != nil {
+		return fmt.Errorf("inmap: creating intake fraction file: %v", err)
+	}
+	var emis, pops []string
+	for e, m := range iF {
+		emis = append(emis, e)
+		if pops == nil {
+			for p := range m {
+				pops = append(pops, p)
+			}
+		}
+	}
+	sort.Strings(emis)
+	sort.Strings(pops)
+	w := csv.NewWriter(f)
+	if err = w.Write(append([]string{"Emissions"}, pops...)); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing intake fraction: %v", err)
+	}
+	for _, e := range emis {
+		line := []string{e}
+		for _, p := range pops {
+			line = append(line, strconv.FormatFloat(iF[e][p], 'g', -1, 64))
+		}
+		if err = w.Write(line); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing intake fraction: %v", err)
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing intake fraction: %v", err)
+	}
+	return f.Close()
+}
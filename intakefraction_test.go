@@ -0,0 +1,104 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestTotalIntakeFraction(t *testing.T) {
+	const (
+		testTolerance = 1.e-10
+		breathingRate = 15. // m³/day
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), DryDeposition(), Chemistry()),
+			SteadyStateConvergenceCheck(10, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	iF, err := d.TotalIntakeFraction(breathingRate, "Total PM2.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All of the Total PM2.5 is caused by the SOx emissions, which are
+	// E μg/s of SOx.
+	var irate float64 // μg/s
+	for _, c := range d.cells {
+		if c.Layer == 0 {
+			irate += c.getValue("Total PM2.5", d.popIndices) * breathingRate / (24 * 60 * 60) *
+				c.PopData[popIndices["TotalPop"]]
+		}
+	}
+	want := irate / E
+	if have := iF["SOx emissions"]["TotalPop"]; want == 0 || absDifferent(have, want, testTolerance*want) {
+		t.Errorf("SOx intake fraction: have %g, want %g", have, want)
+	}
+	if have := iF["PM2.5 emissions"]["TotalPop"]; have != 0 {
+		t.Errorf("PM2.5 intake fraction without emissions: have %g, want 0", have)
+	}
+
+	dir, err := ioutil.TempDir("", "inmap_intakefraction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = WriteIntakeFraction(filepath.Join(dir, "out.shp"), iF); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "out"+intakeFractionSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(iF)+1 || len(lines[0]) != len(popIndices)+1 {
+		t.Errorf("intake fraction file has %d rows and %d columns; want %d and %d",
+			len(lines), len(lines[0]), len(iF)+1, len(popIndices)+1)
+	}
+}
@@ -40,16 +40,30 @@ import (
 // and it should not be run in parallel with other CellManipulators.
 func AddEmissionsFlux() CellManipulator {
 	return func(c *Cell, Dt float64) {
-		for i := range PolNames {
-			c.Cf[i] += c.EmisFlux[i] * Dt
-			c.Ci[i] = c.Cf[i]
-		}
+		c.addEmissions(Dt)
+	}
+}
+
+// addEmissions adds the emissions that occur over time period Δt
+// to c.Cf and sets c.Ci equal to c.Cf.
+func (c *Cell) addEmissions(Δt float64) {
+	for i := range PolNames {
+		c.Cf[i] += c.EmisFlux[i] * Δt
+		c.Ci[i] = c.Cf[i]
+		c.budget[budgetEmitted][i] += c.EmisFlux[i] * Δt
 	}
 }
 
 // Emissions is a holder for input emissions data.
 type Emissions struct {
 	data *rtree.Rtree
+
+	// tags are the tags of the emissions records.
+	tags map[string]bool
+
+	// plume specifies how emissions from elevated sources are placed
+	// in the vertical layers (see SetPlume).
+	plume PlumeOptions
 }
 
 // EmisRecord is a holder for an emissions record.
@@ -57,22 +71,45 @@ type EmisRecord struct {
 	geom.Geom
 	VOC, NOx, NH3, SOx float64 // emissions [μg/s]
 	PM25               float64 `shp:"PM2_5"` // emissions [μg/s]
+	BVOC               float64 // biogenic VOC emissions [μg/s]
 	Height             float64 // stack height [m]
 	Diam               float64 // stack diameter [m]
 	Temp               float64 // stack temperature [K]
 	Velocity           float64 // stack velocity [m/s]
+
+	// Tag identifies the group of sources that the emissions belong to
+	// for source apportionment (see Mechanism.Tagged). It is read
+	// from the "Tag" attribute column of emissions shapefiles, if there is one.
+	Tag string
 }
 
 // NewEmissions Initializes a new emissions holder.
 func NewEmissions() *Emissions {
 	return &Emissions{
 		data: rtree.NewTree(25, 50),
+		tags: make(map[string]bool),
 	}
 }
 
 // Add adds an emissions record to e.
 func (e *Emissions) Add(er *EmisRecord) {
 	e.data.Insert(er)
+	if er.Tag != "" {
+		if e.tags == nil {
+			e.tags = make(map[string]bool)
+		}
+		e.tags[er.Tag] = true
+	}
+}
+
+// Tags returns the tags of the emissions records in e in sorted order.
+func (e *Emissions) Tags() []string {
+	o := make([]string, 0, len(e.tags))
+	for t := range e.tags {
+		o = append(o, t)
+	}
+	sort.Strings(o)
+	return o
 }
 
 // ReadEmissionShapefiles returns the emissions data in the specified shapefiles,
@@ -81,6 +118,18 @@ func (e *Emissions) Add(er *EmisRecord) {
 // c is a channel over which status updates will be sent. If c is nil,
 // no updates will be sent.
 func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, shapefiles ...string) (*Emissions, error) {
+	return ReadTaggedEmissionShapefiles(gridSR, units, c, shapefiles, nil)
+}
+
+// ReadTaggedEmissionShapefiles is the same as ReadEmissionShapefiles, except
+// that the emissions records in each shapefile that do not have a value in the
+// "Tag" attribute column are tagged with the tag at the same position in tags
+// for source apportionment. If tags is empty, no tags are added.
+func ReadTaggedEmissionShapefiles(gridSR *proj.SR, units string, c chan string, shapefiles, tags []string) (*Emissions, error) {
+	if len(tags) != 0 && len(tags) != len(shapefiles) {
+		return nil, fmt.Errorf("inmap: there are %d emissions shapefiles but %d tags",
+			len(shapefiles), len(tags))
+	}
 
 	var emisConv float64
 	switch units {
@@ -99,7 +148,7 @@ func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, shapef
 	// Add in emissions shapefiles
 	// Load emissions into rtree for fast searching
 	emis := NewEmissions()
-	for _, fname := range shapefiles {
+	for i, fname := range shapefiles {
 		if c != nil {
 			c <- fmt.Sprintf("Loading emissions shapefile: %s.", fname)
 		}
@@ -136,6 +185,10 @@ func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, shapef
 			e.NH3 *= emisConv
 			e.SOx *= emisConv
 			e.PM25 *= emisConv
+			e.BVOC *= emisConv
+			if e.Tag == "" && len(tags) != 0 {
+				e.Tag = tags[i]
+			}
 
 			if math.IsNaN(e.Height) {
 				e.Height = 0.
@@ -222,17 +275,20 @@ func calcWeightFactor(e geom.Geom, c *Cell) float64 {
 }
 
 // setEmissionsFlux sets the emissions flux for c based on the emissions in e.
-func (c *Cell) setEmissionsFlux(e *Emissions) {
+func (d *InMAP) setEmissionsFlux(c *Cell, e *Emissions) {
 	c.EmisFlux = make([]float64, len(PolNames))
+	plume := e.plume
 	for _, eTemp := range e.data.SearchIntersect(c.Bounds()) {
 		e := eTemp.(*EmisRecord)
+		plumeFraction := 1.
 		if e.Height > 0. {
-			// Figure out if this cell is at the right hight for the plume.
-			in, _, err := c.IsPlumeIn(e.Height, e.Diam, e.Temp, e.Velocity)
+			// Figure out how much of the plume is at the height of this cell.
+			var err error
+			plumeFraction, err = d.plumeFraction(c, e, plume)
 			if err != nil {
 				panic(err)
 			}
-			if !in {
+			if plumeFraction == 0 {
 				continue
 			}
 		} else if c.Layer != 0 {
@@ -243,12 +299,9 @@ func (c *Cell) setEmissionsFlux(e *Emissions) {
 			continue
 		}
 
-		// Emissions: all except PM2.5 go to gas phase
-		c.addEmisFlux(e.VOC, 1.*weightFactor, igOrg)
-		c.addEmisFlux(e.NOx, NOxToN*weightFactor, igNO)
-		c.addEmisFlux(e.NH3, NH3ToN*weightFactor, igNH)
-		c.addEmisFlux(e.SOx, SOxToS*weightFactor, igS)
-		c.addEmisFlux(e.PM25, 1.*weightFactor, iPM2_5)
+		for _, em := range emissions {
+			c.addEmisFlux(em.value(e), em.conversion*weightFactor*plumeFraction, em.species)
+		}
 	}
 }
 
@@ -257,6 +310,11 @@ func (c *Cell) setEmissionsFlux(e *Emissions) {
 // If  allLayers` is true, the function writes out data for all of the vertical
 // layers, otherwise only the ground-level layer is written.
 // outputVariables is a list of the names of the variables to be output.
+// If the simulation was stopped before it converged, a file with the
+// same base name as fileName and the suffix "_NOT_CONVERGED.txt" is written
+// alongside the shapefile to mark the results as incomplete, and if
+// any convergence checks were made, the convergence history is written to
+// a file with the suffix "_convergence.csv".
 func Output(fileName string, allLayers bool, outputVariables ...string) DomainManipulator {
 	return func(d *InMAP) error {
 
@@ -309,6 +367,37 @@ func Output(fileName string, allLayers bool, outputVariables ...string) DomainMa
 		fmt.Fprint(f, proj4)
 		f.Close()
 
+		if err = d.writeConvergenceHistory(fileBase); err != nil {
+			return err
+		}
+		return d.markConvergence(fileBase)
+	}
+}
+
+// notConvergedSuffix is appended to the base name of an output file to
+// create the name of the file that marks the output as not converged.
+const notConvergedSuffix = "_NOT_CONVERGED.txt"
+
+// markConvergence writes a file next to the output file with base name
+// fileBase if the simulation was stopped before converging, and removes
+// any such file left over from a previous simulation otherwise.
+func (d *InMAP) markConvergence(fileBase string) error {
+	fname := fileBase + notConvergedSuffix
+	if d.interrupted == nil {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("inmap: removing old convergence marker: %v", err)
+		}
 		return nil
 	}
+	log.Printf("inmap: simulation did not converge; marking output %s as not converged", fileBase)
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("inmap: creating convergence marker: %v", err)
+	}
+	fmt.Fprintf(f, "The simulation was stopped before it converged (%v).\n"+
+		"The results in the accompanying output files are incomplete.\n", d.interrupted)
+	if d.convergence != nil {
+		fmt.Fprintf(f, "Iterations completed: %d\n", d.convergence.Iteration)
+	}
+	return f.Close()
 }
@@ -0,0 +1,375 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// LinearSteadyState returns a function that calculates the steady-state
+// concentrations directly rather than by running the simulation
+// until it converges.
+//
+// funcs are the calculations that make up one time step, not including
+// AddEmissionsFlux. Because all of them are linear in concentration, one
+// time step can be written as Cf = S·Ci + f, where S is a sparse matrix and f
+// holds the contributions of the emissions and the domain boundaries. The
+// matrix is assembled by running funcs on the grid cells that depend on
+// each concentration in turn, as found from the cells' neighbor lists,
+// and the steady state, (I - S)·C = f, is solved for using the
+// BiCGSTAB method with a Jacobi preconditioner. The solution is
+// stored in Ci and Cf in each grid cell.
+//
+// funcs must be linear and must only use the concentrations in the cell
+// itself and its direct neighbors, so nonlinear calculations such as
+// FluxLimitedAdvection cannot be used. All cells must be in the same time
+// step class. tolerance is the relative residual at which the solution
+// is accepted, and an error is returned if it has not been reached after
+// maxIterations iterations. The relative residual is sent over c, if it
+// is not nil, and is kept in the convergence history. The mass budget
+// is not updated.
+//
+// LinearSteadyState should be used in RunFuncs without a convergence check;
+// it sets the Done flag once the steady state has been found.
+func LinearSteadyState(tolerance float64, maxIterations int, c chan ConvergenceRecord, funcs ...CellManipulator) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.maxTimestepClass > 0 {
+			return fmt.Errorf("inmap: the linear steady-state solver does not support multiple time step classes")
+		}
+		S, f, err := d.steadyStateSystem(funcs)
+		if err != nil {
+			return err
+		}
+		n := len(PolNames)
+		x := make([]float64, len(d.cells)*n)
+		for i, c := range d.cells {
+			copy(x[i*n:], c.Cf) // Start from the current concentrations.
+		}
+		if d.convergence == nil {
+			d.convergence = new(convergenceState)
+		}
+		s := d.convergence
+		report := func(iteration int, residual float64) {
+			status := ConvergenceRecord{
+				Iteration: iteration,
+				Names:     []string{"Relative residual"},
+				Change:    []float64{residual},
+			}
+			s.History = append(s.History, status)
+			if c != nil {
+				c <- status
+			}
+		}
+		if err := bicgstab(S, f, x, tolerance, maxIterations, report); err != nil {
+			return err
+		}
+		for i, c := range d.cells {
+			copy(c.Cf, x[i*n:(i+1)*n])
+			copy(c.Ci, c.Cf)
+		}
+		d.Done = true
+		return nil
+	}
+}
+
+// sparseMatrix is a square matrix in compressed sparse row format.
+type sparseMatrix struct {
+	rowPtr []int
+	cols   []int
+	vals   []float64
+}
+
+// mulVec sets y = x - m·x, which is the steady-state operator I - S.
+func (m *sparseMatrix) mulVec(x, y []float64) {
+	parallelRange(len(y), func(r int) {
+		v := x[r]
+		for k := m.rowPtr[r]; k < m.rowPtr[r+1]; k++ {
+			v -= m.vals[k] * x[m.cols[k]]
+		}
+		y[r] = v
+	})
+}
+
+// diagonal returns the diagonal of I - m.
+func (m *sparseMatrix) diagonal() []float64 {
+	o := make([]float64, len(m.rowPtr)-1)
+	for r := range o {
+		o[r] = 1
+		for k := m.rowPtr[r]; k < m.rowPtr[r+1]; k++ {
+			if m.cols[k] == r {
+				o[r] -= m.vals[k]
+			}
+		}
+	}
+	return o
+}
+
+// parallelRange runs f for every integer in [0, n) using all processors.
+func parallelRange(n int, f func(i int)) {
+	nprocs := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	wg.Add(nprocs)
+	for pp := 0; pp < nprocs; pp++ {
+		go func(pp int) {
+			for i := pp; i < n; i += nprocs {
+				f(i)
+			}
+			wg.Done()
+		}(pp)
+	}
+	wg.Wait()
+}
+
+// steadyStateSystem returns the matrix S and vector f such that one time
+// step calculated by funcs is Cf = S·Ci + f, where the concentrations
+// of pollutant ii in cell i are at index i*len(PolNames)+ii.
+// The states of the grid cells and boundary cells are not changed.
+func (d *InMAP) steadyStateSystem(funcs []CellManipulator) (*sparseMatrix, []float64, error) {
+	n := len(PolNames)
+	index := make(map[*Cell]int, len(d.cells))
+	for i, c := range d.cells {
+		index[c] = i
+	}
+
+	// dependents[j] are the cells whose calculations use the
+	// concentrations in cell j.
+	dependents := make([][]int, len(d.cells))
+	for i, c := range d.cells {
+		seen := make(map[int]bool)
+		for _, group := range [][]*Cell{{c}, c.west, c.east, c.north, c.south,
+			c.above, c.below, c.groundLevel} {
+			for _, nb := range group {
+				if nb.boundary {
+					continue
+				}
+				j, ok := index[nb]
+				if !ok {
+					return nil, nil, fmt.Errorf("inmap: the neighbor of the grid cell at %+v "+
+						"is not in the grid", c.Centroid())
+				}
+				if !seen[j] {
+					seen[j] = true
+					dependents[j] = append(dependents[j], i)
+				}
+			}
+		}
+	}
+
+	// Save the state of the cells so it can be restored afterwards.
+	type cellState struct {
+		ci, cf                 []float64
+		budget                 [numBudgetTerms][]float64
+		dryDepTime, wetDepTime float64
+	}
+	save := func(c *Cell) cellState {
+		s := cellState{ci: append([]float64{}, c.Ci...), cf: append([]float64{}, c.Cf...),
+			dryDepTime: c.dryDepTime, wetDepTime: c.wetDepTime}
+		for i, b := range c.budget {
+			s.budget[i] = append([]float64{}, b...)
+		}
+		return s
+	}
+	restore := func(c *Cell, s cellState) {
+		copy(c.Ci, s.ci)
+		copy(c.Cf, s.cf)
+		for i, b := range s.budget {
+			copy(c.budget[i], b)
+		}
+		c.dryDepTime, c.wetDepTime = s.dryDepTime, s.wetDepTime
+	}
+	var boundaryCells []*Cell
+	for _, b := range d.boundaries() {
+		boundaryCells = append(boundaryCells, b...)
+	}
+	cellStates := make([]cellState, len(d.cells))
+	for i, c := range d.cells {
+		cellStates[i] = save(c)
+	}
+	boundaryStates := make([]cellState, len(boundaryCells))
+	for i, c := range boundaryCells {
+		boundaryStates[i] = save(c)
+	}
+	defer func() {
+		for i, c := range d.cells {
+			restore(c, cellStates[i])
+		}
+		for i, c := range boundaryCells {
+			restore(c, boundaryStates[i])
+		}
+	}()
+
+	zero := func(c *Cell) {
+		for ii := range c.Ci {
+			c.Ci[ii] = 0
+			c.Cf[ii] = 0
+		}
+	}
+	for _, c := range d.cells {
+		zero(c)
+	}
+	for _, c := range boundaryCells {
+		zero(c)
+	}
+
+	// Find each column of S by setting one concentration to 1 and
+	// running the calculations on the cells that depend on it.
+	rows := make([][]int, len(d.cells)*n)
+	vals := make([][]float64, len(d.cells)*n)
+	for j, cj := range d.cells {
+		for p := 0; p < n; p++ {
+			cj.Ci[p] = 1
+			for _, i := range dependents[j] {
+				c := d.cells[i]
+				copy(c.Cf, c.Ci)
+				for _, f := range funcs {
+					f(c, d.Dt)
+				}
+			}
+			col := j*n + p
+			for _, i := range dependents[j] {
+				c := d.cells[i]
+				for q, v := range c.Cf {
+					if v != 0 {
+						r := i*n + q
+						rows[r] = append(rows[r], col)
+						vals[r] = append(vals[r], v)
+					}
+				}
+				zero(c)
+			}
+			cj.Ci[p] = 0
+			for _, c := range boundaryCells {
+				zero(c)
+			}
+		}
+	}
+	S := &sparseMatrix{rowPtr: make([]int, len(rows)+1)}
+	for r, cols := range rows {
+		S.rowPtr[r+1] = S.rowPtr[r] + len(cols)
+		S.cols = append(S.cols, cols...)
+		S.vals = append(S.vals, vals[r]...)
+	}
+
+	// Find f by running one time step starting from zero concentrations
+	// in the grid cells.
+	for i, c := range boundaryCells {
+		copy(c.Ci, boundaryStates[i].ci)
+	}
+	for _, c := range d.cells {
+		c.addEmissions(d.Dt)
+	}
+	if err := Calculations(funcs...)(d); err != nil {
+		return nil, nil, err
+	}
+	f := make([]float64, len(d.cells)*n)
+	for i, c := range d.cells {
+		copy(f[i*n:], c.Cf)
+	}
+	return S, f, nil
+}
+
+// bicgstab solves (I - S)·x = b for x using the BiCGSTAB method
+// (van der Vorst, 1992) with a Jacobi preconditioner, where x holds the
+// initial guess. report is called with the relative residual after
+// each iteration.
+func bicgstab(S *sparseMatrix, b, x []float64, tolerance float64, maxIterations int,
+	report func(iteration int, residual float64)) error {
+	n := len(b)
+	dot := func(u, w []float64) float64 {
+		var o float64
+		for i, v := range u {
+			o += v * w[i]
+		}
+		return o
+	}
+	bNorm := math.Sqrt(dot(b, b))
+	if bNorm == 0 {
+		for i := range x {
+			x[i] = 0
+		}
+		return nil
+	}
+	diag := S.diagonal()
+	precondition := func(v, o []float64) {
+		for i, vv := range v {
+			if diag[i] != 0 {
+				o[i] = vv / diag[i]
+			} else {
+				o[i] = vv
+			}
+		}
+	}
+
+	r := make([]float64, n)
+	S.mulVec(x, r)
+	for i := range r {
+		r[i] = b[i] - r[i]
+	}
+	r0 := append([]float64{}, r...)
+	p := make([]float64, n)
+	v := make([]float64, n)
+	y := make([]float64, n)
+	z := make([]float64, n)
+	s := make([]float64, n)
+	t := make([]float64, n)
+	ρ, α, ω := 1., 1., 1.
+	for k := 1; k <= maxIterations; k++ {
+		ρNew := dot(r0, r)
+		if ρNew == 0 {
+			return fmt.Errorf("inmap: linear steady-state solver broke down after %d iterations", k-1)
+		}
+		β := (ρNew / ρ) * (α / ω)
+		ρ = ρNew
+		for i := range p {
+			p[i] = r[i] + β*(p[i]-ω*v[i])
+		}
+		precondition(p, y)
+		S.mulVec(y, v)
+		α = ρ / dot(r0, v)
+		for i := range s {
+			s[i] = r[i] - α*v[i]
+		}
+		if res := math.Sqrt(dot(s, s)) / bNorm; res < tolerance {
+			for i := range x {
+				x[i] += α * y[i]
+			}
+			report(k, res)
+			return nil
+		}
+		precondition(s, z)
+		S.mulVec(z, t)
+		ω = dot(t, s) / dot(t, t)
+		for i := range x {
+			x[i] += α*y[i] + ω*z[i]
+			r[i] = s[i] - ω*t[i]
+		}
+		res := math.Sqrt(dot(r, r)) / bNorm
+		report(k, res)
+		if res < tolerance {
+			return nil
+		}
+		if ω == 0 {
+			return fmt.Errorf("inmap: linear steady-state solver broke down after %d iterations", k)
+		}
+	}
+	return fmt.Errorf("inmap: linear steady-state solver did not converge after %d iterations", maxIterations)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// The concentrations found by the linear solver should not change
+// when another time step is calculated.
+func TestLinearSteadyState(t *testing.T) {
+	const tolerance = 1.e-6
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	funcs := []CellManipulator{UpwindAdvection(), Mixing(), MeanderMixing(),
+		DryDeposition(), WetDeposition(), Chemistry()}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			LinearSteadyState(1.e-10, 1000, nil, funcs...),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.ConvergenceHistory()) == 0 {
+		t.Error("the solver did not record its progress")
+	}
+
+	steadyState := make([][]float64, len(d.cells))
+	for i, c := range d.cells {
+		steadyState[i] = append([]float64{}, c.Cf...)
+	}
+	if err := Calculations(AddEmissionsFlux())(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := Calculations(funcs...)(d); err != nil {
+		t.Fatal(err)
+	}
+	for ii, pol := range PolNames {
+		var diff, norm float64
+		for i, c := range d.cells {
+			diff += math.Pow(c.Cf[ii]-steadyState[i][ii], 2)
+			norm += math.Pow(steadyState[i][ii], 2)
+			if steadyState[i][ii] < -tolerance {
+				t.Errorf("%s: cell %d has negative concentration %g", pol, i, steadyState[i][ii])
+			}
+		}
+		if norm == 0 {
+			t.Errorf("%s: concentrations are all zero", pol)
+			continue
+		}
+		if r := math.Sqrt(diff / norm); r > tolerance {
+			t.Errorf("%s: relative change %g after one time step is too large", pol, r)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "fmt"
+
+// A Mechanism specifies the chemical species in the model and the
+// processes that affect them. The model uses the default mechanism
+// (see DefaultMechanism) unless a different one is set using SetMechanism.
+type Mechanism struct {
+	// Species are the species that are tracked by the model.
+	Species []Species
+
+	// Reactions are first-order reactions that convert one species to
+	// another. They are calculated in the given order, before Partitioning.
+	Reactions []Reaction
+
+	// Partitioning specifies pairs of species whose total mass is
+	// divided between the gas and particle phases.
+	// It is calculated in the given order.
+	Partitioning []Partitioning
+
+	// Emissions specify how emitted pollutants are added to the model species.
+	Emissions []EmittedPollutant
+
+	// Labels specify the concentration variables that can be output
+	// from the model.
+	Labels []Label
+
+	// BaselineLabels specify the baseline concentration variables that can
+	// be output from the model.
+	BaselineLabels []Label
+
+	// Deposition specify the deposition flux variables that can be output
+	// from the model.
+	Deposition []DepositionLabel
+}
+
+// Species is a chemical species that is tracked by the model.
+type Species struct {
+	// Name is the name of the species.
+	Name string
+
+	// DryDep returns the dry deposition velocity [m/s] of the species in
+	// a grid cell. If it is nil, the species does not dry deposit.
+	DryDep func(c *Cell) float64
+
+	// WetDep returns the wet deposition rate [1/s] of the species in
+	// a grid cell. If it is nil, the species does not wet deposit.
+	WetDep func(c *Cell) float64
+
+	// Baseline is the name of the CTM data variable holding the baseline
+	// concentration of the species. If it is "", the baseline concentration
+	// is zero.
+	Baseline string
+}
+
+// Reaction is a first-order reaction that converts species From to species To.
+type Reaction struct {
+	From, To string
+
+	// Rate returns the reaction rate [1/s] in a grid cell.
+	Rate func(c *Cell) float64
+
+	// Yield is the mass of To produced per unit mass of From that reacts.
+	Yield float64
+}
+
+// Partitioning specifies that the total mass of a gas-phase species
+// and a particle-phase species is divided between the two phases.
+type Partitioning struct {
+	Gas, Particle string
+
+	// Fraction returns the fraction of the total mass that is in the
+	// particle phase in a grid cell.
+	Fraction func(c *Cell) float64
+}
+
+// EmittedPollutant specifies how an emitted pollutant is added to
+// the model species.
+type EmittedPollutant struct {
+	// Name is the name of the pollutant, which is also the name of the
+	// emissions input field.
+	Name string
+
+	// Label is the name of the output variable for the pollutant's emissions.
+	Label string
+
+	// Species is the model species that the emissions are added to.
+	Species string
+
+	// Conversion is the mass of Species per unit mass of emissions.
+	Conversion float64
+
+	// Value returns the emissions of the pollutant [μg/s] in an
+	// emissions record.
+	Value func(e *EmisRecord) float64
+}
+
+// Label is a model output variable calculated as a weighted sum of the
+// concentrations of one or more species.
+type Label struct {
+	Name string
+
+	// Species are the species that are included in the variable.
+	Species []string
+
+	// Conversions are the factors that the concentration of each species
+	// is multiplied by, for example to convert N to NH4.
+	Conversions []float64
+
+	// Fraction, if it is not nil, is the fraction of the converted
+	// concentration in grid cell c that is included in the variable,
+	// for example the fraction of NOx that is NO2.
+	Fraction func(c *Cell) float64
+}
+
+// noFraction and no2Fraction are the fractions of the nitrogen in
+// gas-phase NOx that is NO and NO2, respectively.
+func noFraction(c *Cell) float64  { return 1 - c.NONO2partitioning }
+func no2Fraction(c *Cell) float64 { return c.NONO2partitioning }
+
+func particleDryDep(c *Cell) float64 { return c.ParticleDryDep }
+func particleWetDep(c *Cell) float64 { return c.ParticleWetDep }
+func otherGasWetDep(c *Cell) float64 { return c.OtherGasWetDep }
+
+// DefaultMechanism returns the default InMAP chemical mechanism. New species
+// and processes can be added to the returned mechanism before it is used
+// with SetMechanism. Species should be appended to the end of the list
+// so that the positions of the default species do not change.
+func DefaultMechanism() *Mechanism {
+	return &Mechanism{
+		Species: []Species{
+			{Name: "gOrg", Baseline: "aVOC", WetDep: otherGasWetDep,
+				DryDep: func(c *Cell) float64 { return c.VOCDryDep }},
+			{Name: "pOrg", Baseline: "aSOA", WetDep: particleWetDep, DryDep: particleDryDep},
+			{Name: "PM2_5", Baseline: "TotalPM25", WetDep: particleWetDep, DryDep: particleDryDep},
+			{Name: "gNH", Baseline: "gNH", WetDep: otherGasWetDep,
+				DryDep: func(c *Cell) float64 { return c.NH3DryDep }},
+			{Name: "pNH", Baseline: "pNH", WetDep: particleWetDep, DryDep: particleDryDep},
+			{Name: "gS", Baseline: "gS",
+				WetDep: func(c *Cell) float64 { return c.SO2WetDep },
+				DryDep: func(c *Cell) float64 { return c.SO2DryDep }},
+			{Name: "pS", Baseline: "pS", WetDep: particleWetDep, DryDep: particleDryDep},
+			{Name: "gNO", Baseline: "gNO", WetDep: otherGasWetDep,
+				DryDep: func(c *Cell) float64 { return c.NOxDryDep }},
+			{Name: "pNO", Baseline: "pNO", WetDep: particleWetDep, DryDep: particleDryDep},
+			{Name: "gBOrg", Baseline: "bVOC", WetDep: otherGasWetDep,
+				DryDep: func(c *Cell) float64 { return c.VOCDryDep }},
+			{Name: "pBOrg", Baseline: "bSOA", WetDep: particleWetDep, DryDep: particleDryDep},
+		},
+		Reactions: []Reaction{
+			// All SO4 forms particles, so sulfur particle formation is limited by the
+			// SO2 -> SO4 reaction.
+			{From: "gS", To: "pS", Yield: 1,
+				Rate: func(c *Cell) float64 { return c.SO2oxidation }},
+		},
+		Partitioning: []Partitioning{
+			{Gas: "gNH", Particle: "pNH",
+				Fraction: func(c *Cell) float64 { return c.NHPartitioning }},
+			{Gas: "gNO", Particle: "pNO",
+				Fraction: func(c *Cell) float64 { return c.NOPartitioning }},
+			{Gas: "gOrg", Particle: "pOrg",
+				Fraction: func(c *Cell) float64 { return c.AOrgPartitioning }},
+			{Gas: "gBOrg", Particle: "pBOrg",
+				Fraction: func(c *Cell) float64 { return c.BOrgPartitioning }},
+		},
+		// All emissions except PM2.5 go to the gas phase.
+		Emissions: []EmittedPollutant{
+			{Name: "VOC", Label: "VOC Emissions", Species: "gOrg", Conversion: 1,
+				Value: func(e *EmisRecord) float64 { return e.VOC }},
+			{Name: "NOx", Label: "NOx emissions", Species: "gNO", Conversion: NOxToN,
+				Value: func(e *EmisRecord) float64 { return e.NOx }},
+			{Name: "NH3", Label: "NH3 emissions", Species: "gNH", Conversion: NH3ToN,
+				Value: func(e *EmisRecord) float64 { return e.NH3 }},
+			{Name: "SOx", Label: "SOx emissions", Species: "gS", Conversion: SOxToS,
+				Value: func(e *EmisRecord) float64 { return e.SOx }},
+			{Name: "PM2_5", Label: "PM2.5 emissions", Species: "PM2_5", Conversion: 1,
+				Value: func(e *EmisRecord) float64 { return e.PM25 }},
+			{Name: "BVOC", Label: "BVOC emissions", Species: "gBOrg", Conversion: 1,
+				Value: func(e *EmisRecord) float64 { return e.BVOC }},
+		},
+		Labels: []Label{
+			{Name: "Total PM2.5", Species: []string{"PM2_5", "pOrg", "pNH", "pS", "pNO", "pBOrg"},
+				Conversions: []float64{1, 1, NtoNH4, StoSO4, NtoNO3, 1}},
+			{Name: "VOC", Species: []string{"gOrg"}, Conversions: []float64{1.}},
+			{Name: "BVOC", Species: []string{"gBOrg"}, Conversions: []float64{1.}},
+			{Name: "SOA", Species: []string{"pOrg"}, Conversions: []float64{1.}},
+			{Name: "BSOA", Species: []string{"pBOrg"}, Conversions: []float64{1.}},
+			{Name: "Total SOA", Species: []string{"pOrg", "pBOrg"}, Conversions: []float64{1., 1.}},
+			{Name: "Primary PM2.5", Species: []string{"PM2_5"}, Conversions: []float64{1.}},
+			{Name: "NH3", Species: []string{"gNH"}, Conversions: []float64{1. / NH3ToN}},
+			{Name: "pNH4", Species: []string{"pNH"}, Conversions: []float64{NtoNH4}},
+			{Name: "SOx", Species: []string{"gS"}, Conversions: []float64{1. / SOxToS}},
+			{Name: "pSO4", Species: []string{"pS"}, Conversions: []float64{StoSO4}},
+			{Name: "NOx", Species: []string{"gNO"}, Conversions: []float64{1. / NOxToN}},
+			{Name: "pNO3", Species: []string{"pNO"}, Conversions: []float64{NtoNO3}},
+			{Name: "NO2", Species: []string{"gNO"}, Conversions: []float64{NtoNO2}, Fraction: no2Fraction},
+			{Name: "NO", Species: []string{"gNO"}, Conversions: []float64{NtoNO}, Fraction: noFraction},
+		},
+		// The baseline labels are different than the concentration labels in
+		// that total PM2.5 is its own category and there is no primary PM2.5.
+		BaselineLabels: []Label{
+			{Name: "Baseline Total PM2.5", Species: []string{"PM2_5"}, Conversions: []float64{1}},
+			{Name: "Baseline VOC", Species: []string{"gOrg"}, Conversions: []float64{1.}},
+			{Name: "Baseline BVOC", Species: []string{"gBOrg"}, Conversions: []float64{1.}},
+			{Name: "Baseline SOA", Species: []string{"pOrg"}, Conversions: []float64{1.}},
+			{Name: "Baseline BSOA", Species: []string{"pBOrg"}, Conversions: []float64{1.}},
+			{Name: "Baseline Total SOA", Species: []string{"pOrg", "pBOrg"}, Conversions: []float64{1., 1.}},
+			{Name: "Baseline NH3", Species: []string{"gNH"}, Conversions: []float64{1. / NH3ToN}},
+			{Name: "Baseline pNH4", Species: []string{"pNH"}, Conversions: []float64{NtoNH4}},
+			{Name: "Baseline SOx", Species: []string{"gS"}, Conversions: []float64{1. / SOxToS}},
+			{Name: "Baseline pSO4", Species: []string{"pS"}, Conversions: []float64{StoSO4}},
+			{Name: "Baseline NOx", Species: []string{"gNO"}, Conversions: []float64{1. / NOxToN}},
+			{Name: "Baseline pNO3", Species: []string{"pNO"}, Conversions: []float64{NtoNO3}},
+			{Name: "Baseline NO2", Species: []string{"gNO"}, Conversions: []float64{NtoNO2}, Fraction: no2Fraction},
+			{Name: "Baseline NO", Species: []string{"gNO"}, Conversions: []float64{NtoNO}, Fraction: noFraction},
+		},
+		Deposition: []DepositionLabel{
+			{Name: "N", Units: "kg N/ha/yr", Species: []string{"gNH", "pNH", "gNO", "pNO"},
+				Conversions: []float64{1, 1, 1, 1}},
+			{Name: "S", Units: "kg S/ha/yr", Species: []string{"gS", "pS"},
+				Conversions: []float64{1, 1}},
+			{Name: "gNH", Units: "kg N/ha/yr", Species: []string{"gNH"}, Conversions: []float64{1}},
+			{Name: "pNH", Units: "kg N/ha/yr", Species: []string{"pNH"}, Conversions: []float64{1}},
+			{Name: "gNO", Units: "kg N/ha/yr", Species: []string{"gNO"}, Conversions: []float64{1}},
+			{Name: "pNO", Units: "kg N/ha/yr", Species: []string{"pNO"}, Conversions: []float64{1}},
+			{Name: "gS", Units: "kg S/ha/yr", Species: []string{"gS"}, Conversions: []float64{1}},
+			{Name: "pS", Units: "kg S/ha/yr", Species: []string{"pS"}, Conversions: []float64{1}},
+		},
+	}
+}
+
+// The variables below are derived from the current mechanism by
+// SetMechanism.
+var (
+	// PolNames are the names of pollutants within the model
+	PolNames []string
+
+	// EmisNames are the names of pollutants accepted as emissions [μg/s]
+	EmisNames []string
+
+	// emisLabels relate emissions output variable names to
+	// the indices of the species they are added to.
+	emisLabels map[string]int
+
+	// emisConversions are the masses of the emitted species per unit
+	// mass of emissions, by emissions output variable name.
+	emisConversions map[string]float64
+
+	// emissions holds information about each emitted pollutant.
+	emissions []emittedPollutant
+
+	// map relating emissions to the associated PM2.5 concentrations
+	gasParticleMap map[int]int
+
+	// PolLabels are labels and conversions for InMAP pollutants.
+	PolLabels map[string]polConv
+
+	// baselinePolLabels specifies labels for the baseline (i.e., background
+	// concentrations) pollutant species.
+	baselinePolLabels map[string]polConv
+
+	// depositionLabels specifies the deposition flux output variables.
+	depositionLabels map[string]depositionConv
+
+	// species, reactions, and partitionings hold the processes
+	// that affect each species.
+	species       []Species
+	reactions     []reaction
+	partitionings []partitioning
+)
+
+type polConv struct {
+	index      []int                 // index in concentration array
+	conversion []float64             // conversion from N to NH4, S to SO4, etc...
+	fraction   func(c *Cell) float64 // fraction of the total in the variable, or nil
+}
+
+// fractionIn returns the fraction of the converted concentration in
+// grid cell c that is included in the variable.
+func (p polConv) fractionIn(c *Cell) float64 {
+	if p.fraction == nil {
+		return 1
+	}
+	return p.fraction(c)
+}
+
+type reaction struct {
+	from, to int
+	rate     func(c *Cell) float64
+	yield    float64
+}
+
+type partitioning struct {
+	gas, particle int
+	fraction      func(c *Cell) float64
+}
+
+type emittedPollutant struct {
+	species    int
+	conversion float64
+	value      func(e *EmisRecord) float64
+}
+
+func init() {
+	if err := SetMechanism(DefaultMechanism()); err != nil {
+		panic(err)
+	}
+}
+
+// SetMechanism sets the chemical mechanism used by the model. It changes
+// PolNames, EmisNames, and the available output variables, so it must be
+// called before any simulations are created and must not be called
+// while a simulation is running.
+func SetMechanism(m *Mechanism) error {
+	index := make(map[string]int)
+	names := make([]string, len(m.Species))
+	for i, s := range m.Species {
+		if _, ok := index[s.Name]; ok {
+			return fmt.Errorf("inmap: species %s is defined more than once", s.Name)
+		}
+		index[s.Name] = i
+		names[i] = s.Name
+	}
+	lookup := func(name, context string) (int, error) {
+		i, ok := index[name]
+		if !ok {
+			return -1, fmt.Errorf("inmap: %s refers to undefined species %s", context, name)
+		}
+		return i, nil
+	}
+
+	rxns := make([]reaction, len(m.Reactions))
+	for i, r := range m.Reactions {
+		var err error
+		if rxns[i].from, err = lookup(r.From, "reaction"); err != nil {
+			return err
+		}
+		if rxns[i].to, err = lookup(r.To, "reaction"); err != nil {
+			return err
+		}
+		if r.Rate == nil {
+			return fmt.Errorf("inmap: reaction %s -> %s has no rate", r.From, r.To)
+		}
+		rxns[i].rate, rxns[i].yield = r.Rate, r.Yield
+	}
+
+	parts := make([]partitioning, len(m.Partitioning))
+	gpMap := make(map[int]int)
+	for i, p := range m.Partitioning {
+		var err error
+		if parts[i].gas, err = lookup(p.Gas, "partitioning"); err != nil {
+			return err
+		}
+		if parts[i].particle, err = lookup(p.Particle, "partitioning"); err != nil {
+			return err
+		}
+		if p.Fraction == nil {
+			return fmt.Errorf("inmap: partitioning %s/%s has no fraction", p.Gas, p.Particle)
+		}
+		parts[i].fraction = p.Fraction
+		gpMap[parts[i].gas] = parts[i].particle
+	}
+	// Species that react to form particles, such as SO2, are associated
+	// with the particles they form.
+	for _, r := range rxns {
+		if _, ok := gpMap[r.from]; !ok {
+			gpMap[r.from] = r.to
+		}
+	}
+
+	emis := make([]emittedPollutant, len(m.Emissions))
+	emisNames := make([]string, len(m.Emissions))
+	eLabels := make(map[string]int)
+	eConversions := make(map[string]float64)
+	for i, e := range m.Emissions {
+		var err error
+		if emis[i].species, err = lookup(e.Species, "emissions "+e.Name); err != nil {
+			return err
+		}
+		if e.Value == nil {
+			return fmt.Errorf("inmap: emissions %s have no value function", e.Name)
+		}
+		emis[i].conversion, emis[i].value = e.Conversion, e.Value
+		emisNames[i] = e.Name
+		eLabels[e.Label] = emis[i].species
+		eConversions[e.Label] = e.Conversion
+		// Emitted species that don't form particles are associated
+		// with themselves.
+		if _, ok := gpMap[emis[i].species]; !ok {
+			gpMap[emis[i].species] = emis[i].species
+		}
+	}
+
+	compileLabels := func(labels []Label) (map[string]polConv, error) {
+		o := make(map[string]polConv)
+		for _, l := range labels {
+			if len(l.Species) != len(l.Conversions) {
+				return nil, fmt.Errorf("inmap: label %s has %d species but %d conversions",
+					l.Name, len(l.Species), len(l.Conversions))
+			}
+			pc := polConv{index: make([]int, len(l.Species)), conversion: l.Conversions,
+				fraction: l.Fraction}
+			for i, s := range l.Species {
+				var err error
+				if pc.index[i], err = lookup(s, "label "+l.Name); err != nil {
+					return nil, err
+				}
+			}
+			o[l.Name] = pc
+		}
+		return o, nil
+	}
+	labels, err := compileLabels(m.Labels)
+	if err != nil {
+		return err
+	}
+	baselineLabels, err := compileLabels(m.BaselineLabels)
+	if err != nil {
+		return err
+	}
+	depLabels := make(map[string]depositionConv)
+	for _, l := range m.Deposition {
+		pc, err := compileLabels([]Label{{Name: l.Name, Species: l.Species, Conversions: l.Conversions}})
+		if err != nil {
+			return err
+		}
+		for _, t := range depositionTypes {
+			depLabels[l.Name+t.suffix] = depositionConv{polConv: pc[l.Name], units: l.Units,
+				dry: t.dry, wet: t.wet}
+		}
+	}
+
+	PolNames = names
+	EmisNames = emisNames
+	emisLabels = eLabels
+	emisConversions = eConversions
+	emissions = emis
+	gasParticleMap = gpMap
+	PolLabels = labels
+	baselinePolLabels = baselineLabels
+	depositionLabels = depLabels
+	species = append([]Species{}, m.Species...)
+	reactions = rxns
+	partitionings = parts
+	return nil
+}
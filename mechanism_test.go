@@ -0,0 +1,240 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestSetMechanismInvalid(t *testing.T) {
+	defer SetMechanism(DefaultMechanism())
+
+	m := DefaultMechanism()
+	m.Species = append(m.Species, Species{Name: "gOrg"})
+	if err := SetMechanism(m); err == nil {
+		t.Error("duplicate species should cause an error")
+	}
+
+	m = DefaultMechanism()
+	m.Labels = append(m.Labels, Label{Name: "Hg", Species: []string{"Hg"}, Conversions: []float64{1}})
+	if err := SetMechanism(m); err == nil {
+		t.Error("undefined species should cause an error")
+	}
+	if len(PolNames) != 11 {
+		t.Errorf("an invalid mechanism should not change PolNames: %v", PolNames)
+	}
+}
+
+// TestTracer adds a non-reactive tracer that is emitted along with
+// primary PM2.5 and checks that it is only affected by transport.
+func TestTracer(t *testing.T) {
+	const (
+		testTolerance = 1.e-10
+		numIterations = 10
+	)
+
+	m := DefaultMechanism()
+	m.Species = append(m.Species, Species{Name: "Tracer"})
+	m.Emissions = append(m.Emissions, EmittedPollutant{
+		Name: "Tracer", Label: "Tracer emissions", Species: "Tracer", Conversion: 1,
+		Value: func(e *EmisRecord) float64 { return e.PM25 },
+	})
+	m.Labels = append(m.Labels, Label{Name: "Tracer", Species: []string{"Tracer"},
+		Conversions: []float64{1}})
+	if err := SetMechanism(m); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMechanism(DefaultMechanism())
+	const iTracer = 9
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(
+				UpwindAdvection(),
+				Mixing(),
+				MeanderMixing(),
+				DryDeposition(),
+				WetDeposition(),
+				Chemistry(),
+			),
+			SteadyStateConvergenceCheck(numIterations, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := d.MassBudget()
+	if different(b.Emitted[iTracer], b.Emitted[iPM2_5], testTolerance) {
+		t.Errorf("emitted tracer %g should equal emitted PM2.5 %g",
+			b.Emitted[iTracer], b.Emitted[iPM2_5])
+	}
+	if b.DryDeposited[iTracer] != 0 || b.WetDeposited[iTracer] != 0 || b.Chemistry[iTracer] != 0 {
+		t.Errorf("tracer should not deposit or react: dry=%g, wet=%g, chem=%g",
+			b.DryDeposited[iTracer], b.WetDeposited[iTracer], b.Chemistry[iTracer])
+	}
+	if b.Chemistry[ipS] <= 0 {
+		t.Errorf("the default chemistry should still be included: pS=%g", b.Chemistry[ipS])
+	}
+
+	r, err := d.Results(false, "Tracer", "Primary PM2.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracer, pm25 float64
+	for i, v := range r["Tracer"] {
+		tracer += v
+		pm25 += r["Primary PM2.5"][i]
+	}
+	if tracer <= pm25 {
+		t.Errorf("tracer concentration %g should be greater than primary PM2.5 "+
+			"concentration %g because it does not deposit", tracer, pm25)
+	}
+}
+
+// The NO and NO2 concentrations should add up to the NOx concentration.
+func TestNO2(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		NOx:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), Chemistry()),
+			SteadyStateConvergenceCheck(2, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Results(true, "NOx", "NO2", "NO", "Baseline NOx", "Baseline NO2", "Baseline NO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for i, c := range d.cells {
+		if c.NONO2partitioning <= 0 || c.NONO2partitioning >= 1 {
+			t.Errorf("cell %d: NO/NO2 partitioning %g is not between 0 and 1", i, c.NONO2partitioning)
+		}
+		for _, prefix := range []string{"", "Baseline "} {
+			nox := r[prefix+"NOx"][i] * NOxToN
+			n := r[prefix+"NO2"][i]/NtoNO2 + r[prefix+"NO"][i]/NtoNO
+			if absDifferent(n, nox, testTolerance*nox) {
+				t.Errorf("cell %d: %sNO + NO2 nitrogen %g != NOx nitrogen %g", i, prefix, n, nox)
+			}
+			if want := nox * c.NONO2partitioning * NtoNO2; absDifferent(r[prefix+"NO2"][i], want, testTolerance*want) {
+				t.Errorf("cell %d: %sNO2 = %g but should be %g", i, prefix, r[prefix+"NO2"][i], want)
+			}
+		}
+		total += r["NO2"][i]
+	}
+	if total == 0 {
+		t.Error("NO2 concentrations are all zero")
+	}
+}
+
+// TestBiogenicSOA checks that biogenic VOC emissions form biogenic SOA
+// using the biogenic partitioning, separately from anthropogenic SOA.
+func TestBiogenicSOA(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		BVOC: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), Chemistry()),
+			SteadyStateConvergenceCheck(2, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Results(true, "SOA", "BSOA", "Total SOA", "BVOC", "VOC", "Total PM2.5",
+		"Baseline SOA", "Baseline BSOA", "Baseline Total SOA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for i, c := range d.cells {
+		if r["SOA"][i] != 0 || r["VOC"][i] != 0 {
+			t.Errorf("cell %d: biogenic emissions formed anthropogenic VOC %g or SOA %g",
+				i, r["VOC"][i], r["SOA"][i])
+		}
+		if r["Total SOA"][i] != r["BSOA"][i] || r["Total PM2.5"][i] != r["BSOA"][i] {
+			t.Errorf("cell %d: Total SOA %g and Total PM2.5 %g should equal BSOA %g",
+				i, r["Total SOA"][i], r["Total PM2.5"][i], r["BSOA"][i])
+		}
+		want := (r["BVOC"][i] + r["BSOA"][i]) * c.BOrgPartitioning
+		if absDifferent(r["BSOA"][i], want, testTolerance*want) {
+			t.Errorf("cell %d: BSOA = %g but should be %g", i, r["BSOA"][i], want)
+		}
+		baseline := r["Baseline SOA"][i] + r["Baseline BSOA"][i]
+		if absDifferent(r["Baseline Total SOA"][i], baseline, testTolerance*baseline) {
+			t.Errorf("cell %d: Baseline Total SOA %g != SOA + BSOA %g", i, r["Baseline Total SOA"][i], baseline)
+		}
+		total += r["BSOA"][i]
+	}
+	if total == 0 {
+		t.Error("BSOA concentrations are all zero")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// SetTimestepClasses returns a function that groups the grid cells into
+// as many as n time step classes based on the largest stable time step for
+// each cell (see SetTimestepCFL). Cells in class 0 are advanced using the
+// smallest stable time step in the domain, and cells in class k are advanced
+// using a time step that is 2^k times as long. Neighboring cells are never
+// more than one class apart, and cells that exchange mass through the
+// non-local convective mixing in Mixing are always in the same class.
+// d.Dt is set to the time step of the largest class
+// in use, and cells in smaller classes take several steps for every step
+// of d.Dt.
+//
+// SetTimestepClasses should be used together with MultirateCalculations;
+// with Calculations, all cells are advanced with the (possibly unstable)
+// time step d.Dt. SetTimestepClasses(1) is equivalent to SetTimestepCFL().
+func SetTimestepClasses(n int) DomainManipulator {
+	return setTimestepClasses(n, true)
+}
+
+// setTimestepClasses returns a function that assigns time step classes
+// as described in the documentation for SetTimestepClasses. The
+// stability of vertical diffusion is only considered if verticalDiffusion
+// is true.
+func setTimestepClasses(n int, verticalDiffusion bool) DomainManipulator {
+	return func(d *InMAP) error {
+		if n < 1 {
+			return fmt.Errorf("inmap: the number of time step classes must be at least 1 but is %d", n)
+		}
+		dt := make([]float64, len(d.cells))
+		var dtMin float64
+		for i, c := range d.cells {
+			dt[i] = c.cflTimestep(verticalDiffusion)
+			if i == 0 || dt[i] < dtMin {
+				dtMin = dt[i]
+			}
+		}
+		for i, c := range d.cells {
+			c.dtClass = 0
+			for c.dtClass < n-1 && dtMin*float64(int(2)<<uint(c.dtClass)) <= dt[i] {
+				c.dtClass++
+			}
+		}
+		// Limit the difference between neighbors to one class to avoid
+		// large differences in accuracy at the class interfaces.
+		for changed := true; changed; {
+			changed = false
+			for _, c := range d.cells {
+				// Convective mixing is not split into fluxes between pairs
+				// of cells, so it is only conservative when all of the cells
+				// involved use the same time step.
+				for _, nb := range c.convectiveNeighbors() {
+					if c.dtClass > nb.dtClass {
+						c.dtClass = nb.dtClass
+						changed = true
+					} else if nb.dtClass > c.dtClass {
+						nb.dtClass = c.dtClass
+						changed = true
+					}
+				}
+				for _, group := range [][]*Cell{c.west, c.east, c.north, c.south, c.below, c.above} {
+					for _, nb := range group {
+						if !nb.boundary && c.dtClass > nb.dtClass+1 {
+							c.dtClass = nb.dtClass + 1
+							changed = true
+						}
+					}
+				}
+			}
+		}
+		d.maxTimestepClass = 0
+		for _, c := range d.cells {
+			if c.dtClass > d.maxTimestepClass {
+				d.maxTimestepClass = c.dtClass
+			}
+		}
+		d.timestepClasses = n
+		d.noVerticalDiffusionTimestep = !verticalDiffusion
+		d.Dt = dtMin * float64(int(1)<<uint(d.maxTimestepClass)) // seconds
+		return nil
+	}
+}
+
+// resetTimestep recalculates the time step using the number of
+// time step classes and the treatment of vertical diffusion most recently
+// requested.
+func (d *InMAP) resetTimestep() error {
+	n := d.timestepClasses
+	if n < 1 {
+		n = 1
+	}
+	return setTimestepClasses(n, !d.noVerticalDiffusionTimestep)(d)
+}
+
+// MultirateCalculations returns a function that advances all of the model
+// grid cells by one time step d.Dt using calculators, like Calculations
+// does, but where each cell is advanced using the time step
+// of its time step class (see SetTimestepClasses). d.Dt is split into
+// substeps as long as the time step of class 0. Each cell is advanced
+// at the beginning of every substep that begins a step of its class.
+//
+// The flux across the interface between two cells in different classes is
+// calculated only by the cell in the smaller class, which adds the opposite
+// flux to the neighboring cell at the end of each of its substeps
+// so that mass is conserved. The non-local convective mixing in Mixing is
+// the exception: it is calculated by each cell using its own time step,
+// which SetTimestepClasses makes the same for all of the cells that
+// exchange mass through it. Like BlockCalculations, MultirateCalculations does not lock the grid cells.
+func MultirateCalculations(calculators ...CellManipulator) DomainManipulator {
+	nprocs := runtime.GOMAXPROCS(0) // number of processors
+
+	return func(d *InMAP) error {
+		nSubsteps := 1 << uint(d.maxTimestepClass)
+		dt0 := d.Dt / float64(nSubsteps)
+		for s := 0; s < nSubsteps; s++ {
+			active := func(c *Cell) bool {
+				return s%(1<<uint(c.dtClass)) == 0
+			}
+			d.forEachBlock(nprocs, func(c *Cell) {
+				if active(c) {
+					Δt := dt0 * float64(int(1)<<uint(c.dtClass))
+					for _, f := range calculators {
+						f(c, Δt)
+					}
+				}
+			})
+			d.applyFluxRegisters()
+			if s == nSubsteps-1 {
+				break
+			}
+			// Make the results of this substep available to the
+			// calculations in the next one.
+			d.forEachBlock(nprocs, func(c *Cell) {
+				if active(c) {
+					copy(c.Ci, c.Cf)
+				}
+			})
+		}
+		return nil
+	}
+}
+
+// convectiveNeighbors returns the grid cells that c exchanges mass with
+// through the non-local convective mixing in Mixing.
+func (c *Cell) convectiveNeighbors() []*Cell {
+	var o []*Cell
+	if c.M2u != 0 {
+		for _, g := range c.groundLevel {
+			if g != c {
+				o = append(o, g)
+			}
+		}
+	}
+	for _, a := range c.above {
+		if !a.boundary && (c.M2d != 0 || a.M2d != 0) {
+			o = append(o, a)
+		}
+	}
+	return o
+}
+
+// calculatesFlux returns whether c should calculate the flux between itself
+// and neighbor nb. It is false when nb is in a smaller time step
+// class than c, in which case nb calculates the flux instead.
+func (c *Cell) calculatesFlux(nb *Cell) bool {
+	return nb.boundary || nb.dtClass <= c.dtClass
+}
+
+// fluxRegister returns the array that changes in the concentration of
+// neighbor nb caused by fluxes calculated by c should be added to.
+// For boundary cells, this is nb.Cf, which keeps track of mass that leaves
+// the domain. For cells in larger time step classes than c, it is a
+// register that is added to nb.Cf by applyFluxRegisters. Otherwise, nb calculates
+// the flux itself and fluxRegister returns nil.
+func (c *Cell) fluxRegister(nb *Cell) []float64 {
+	if nb.boundary {
+		return nb.Cf
+	}
+	if nb.dtClass <= c.dtClass {
+		return nil
+	}
+	if c.fluxRegisters == nil {
+		c.fluxRegisters = make(map[*Cell][]float64)
+	}
+	r, ok := c.fluxRegisters[nb]
+	if !ok {
+		r = make([]float64, len(c.Cf))
+		c.fluxRegisters[nb] = r
+	}
+	return r
+}
+
+// applyFluxRegisters adds the fluxes that have been calculated for
+// neighboring cells in larger time step classes to those cells.
+// It is not run concurrently because several cells can have
+// the same neighbor.
+func (d *InMAP) applyFluxRegisters() {
+	for _, c := range d.cells {
+		for nb, r := range c.fluxRegisters {
+			for i, v := range r {
+				nb.Cf[i] += v
+				nb.Ci[i] = nb.Cf[i]
+				r[i] = 0
+			}
+		}
+	}
+}
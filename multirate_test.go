@@ -0,0 +1,148 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestMultirate(t *testing.T) {
+	const (
+		testTolerance = 1.e-10
+		numIterations = 10
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	newModel := func(setTimestep, calculations DomainManipulator) *InMAP {
+		return &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+				setTimestep,
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				calculations,
+				SteadyStateConvergenceCheck(numIterations, nil),
+			},
+		}
+	}
+	scienceFuncs := []CellManipulator{UpwindAdvection(), Mixing(), MeanderMixing(),
+		DryDeposition(), WetDeposition(), Chemistry()}
+
+	// With a single time step class, the results should be the
+	// same as when all cells use the same time step.
+	d1 := newModel(SetTimestepCFL(), Calculations(scienceFuncs...))
+	d2 := newModel(SetTimestepClasses(1), MultirateCalculations(scienceFuncs...))
+	for _, d := range []*InMAP{d1, d2} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d1.Dt != d2.Dt {
+		t.Errorf("time step: %g != %g", d1.Dt, d2.Dt)
+	}
+	for i, c := range d1.cells {
+		for ii, v := range c.Cf {
+			if v != d2.cells[i].Cf[ii] {
+				t.Fatalf("cell %d %s: %g != %g", i, PolNames[ii], v, d2.cells[i].Cf[ii])
+			}
+		}
+	}
+
+	// Each cell should be in the largest stable class, unless
+	// it is limited by its neighbors.
+	const nClasses = 4
+	d := newModel(SetTimestepClasses(nClasses), MultirateCalculations(scienceFuncs...))
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	dt0 := d.Dt / float64(int(1)<<uint(d.maxTimestepClass))
+	if different(dt0, d1.Dt, testTolerance) {
+		t.Errorf("smallest time step %g should equal CFL time step %g", dt0, d1.Dt)
+	}
+	for i, c := range d.cells {
+		if c.dtClass < 0 || c.dtClass >= nClasses {
+			t.Fatalf("cell %d: class %d is out of range", i, c.dtClass)
+		}
+		if dt := dt0 * float64(int(1)<<uint(c.dtClass)); dt > c.cflTimestep(true)*(1+testTolerance) {
+			t.Errorf("cell %d: time step %g is larger than the stable time step %g",
+				i, dt, c.cflTimestep(true))
+		}
+		for _, group := range [][]*Cell{c.west, c.east, c.north, c.south, c.below, c.above} {
+			for _, nb := range group {
+				if !nb.boundary && c.dtClass > nb.dtClass+1 {
+					t.Errorf("cell %d: class %d is more than one larger than neighbor class %d",
+						i, c.dtClass, nb.dtClass)
+				}
+			}
+		}
+		for _, nb := range c.convectiveNeighbors() {
+			if c.dtClass != nb.dtClass {
+				t.Errorf("cell %d: class %d is different from convective neighbor class %d",
+					i, c.dtClass, nb.dtClass)
+			}
+		}
+	}
+	var convective int
+	for _, c := range d.cells {
+		convective += len(c.convectiveNeighbors())
+	}
+	if convective == 0 {
+		t.Error("no grid cells are mixed by convection")
+	}
+
+	// To test the exchange of fluxes between classes regardless of the
+	// meteorology, put every other layer in class 1. Advection and meander
+	// mixing are conservative, so all of the mass should be accounted for.
+	d = newModel(SetTimestepCFL(), MultirateCalculations(UpwindAdvection(),
+		MeanderMixing(), DryDeposition(), WetDeposition(), Chemistry()))
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.cells {
+		c.dtClass = c.Layer % 2
+	}
+	d.maxTimestepClass = 1
+	d.Dt *= 2
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range d.MassBudget().RelativeResidual() {
+		if math.Abs(r) > testTolerance {
+			t.Errorf("%s: relative residual %g is too large", PolNames[i], r)
+		}
+	}
+}
@@ -57,7 +57,7 @@ func (d *InMAP) neighbors(c *Cell, bboxOffset float64) {
 	c.west = getCells(d.index, westbox, c.Layer)
 	for _, w := range c.west {
 		if len(w.east) == 1 && w.east[0].boundary {
-			deleteCellFromSlice(w.east[0], &d.eastBoundary)
+			d.deleteBoundaryCell(w.east[0], &d.eastBoundary)
 			deleteCellFromSlice(w.east[0], &w.east)
 		}
 		w.east = append(w.east, c)
@@ -69,7 +69,7 @@ func (d *InMAP) neighbors(c *Cell, bboxOffset float64) {
 	c.east = getCells(d.index, eastbox, c.Layer)
 	for _, e := range c.east {
 		if len(e.west) == 1 && e.west[0].boundary {
-			deleteCellFromSlice(e.west[0], &d.westBoundary)
+			d.deleteBoundaryCell(e.west[0], &d.westBoundary)
 			deleteCellFromSlice(e.west[0], &e.west)
 		}
 		e.west = append(e.west, c)
@@ -81,7 +81,7 @@ func (d *InMAP) neighbors(c *Cell, bboxOffset float64) {
 	c.south = getCells(d.index, southbox, c.Layer)
 	for _, s := range c.south {
 		if len(s.north) == 1 && s.north[0].boundary {
-			deleteCellFromSlice(s.north[0], &d.northBoundary)
+			d.deleteBoundaryCell(s.north[0], &d.northBoundary)
 			deleteCellFromSlice(s.north[0], &s.north)
 		}
 		s.north = append(s.north, c)
@@ -93,7 +93,7 @@ func (d *InMAP) neighbors(c *Cell, bboxOffset float64) {
 	c.north = getCells(d.index, northbox, c.Layer)
 	for _, n := range c.north {
 		if len(n.south) == 1 && n.south[0].boundary {
-			deleteCellFromSlice(n.south[0], &d.southBoundary)
+			d.deleteBoundaryCell(n.south[0], &d.southBoundary)
 			deleteCellFromSlice(n.south[0], &n.south)
 		}
 		n.south = append(n.south, c)
@@ -118,7 +118,7 @@ func (d *InMAP) neighbors(c *Cell, bboxOffset float64) {
 	c.below = getCells(d.index, belowbox, c.Layer-1)
 	for _, b := range c.below {
 		if len(b.above) == 1 && b.above[0].boundary {
-			deleteCellFromSlice(b.above[0], &d.topBoundary)
+			d.deleteBoundaryCell(b.above[0], &d.topBoundary)
 			deleteCellFromSlice(b.above[0], &b.above)
 		}
 		b.above = append(b.above, c)
@@ -223,28 +223,28 @@ func (c *Cell) neighborInfo() {
 func (c *Cell) dereferenceNeighbors(d *InMAP) {
 	for _, w := range c.west {
 		if w.boundary {
-			deleteCellFromSlice(w, &d.westBoundary)
+			d.deleteBoundaryCell(w, &d.westBoundary)
 		} else {
 			deleteCellFromSlice(c, &w.east, &w.eastFrac, &w.kxxEast, &w.dxPlusHalf)
 		}
 	}
 	for _, e := range c.east {
 		if e.boundary {
-			deleteCellFromSlice(e, &d.eastBoundary)
+			d.deleteBoundaryCell(e, &d.eastBoundary)
 		} else {
 			deleteCellFromSlice(c, &e.west, &e.westFrac, &e.kxxWest, &e.dxMinusHalf)
 		}
 	}
 	for _, s := range c.south {
 		if s.boundary {
-			deleteCellFromSlice(s, &d.southBoundary)
+			d.deleteBoundaryCell(s, &d.southBoundary)
 		} else {
 			deleteCellFromSlice(c, &s.north, &s.northFrac, &s.kyyNorth, &s.dyPlusHalf)
 		}
 	}
 	for _, n := range c.north {
 		if n.boundary {
-			deleteCellFromSlice(n, &d.northBoundary)
+			d.deleteBoundaryCell(n, &d.northBoundary)
 		} else {
 			deleteCellFromSlice(c, &n.south, &n.southFrac, &n.kyySouth, &n.dyMinusHalf)
 		}
@@ -254,7 +254,7 @@ func (c *Cell) dereferenceNeighbors(d *InMAP) {
 	}
 	for _, a := range c.above {
 		if a.boundary {
-			deleteCellFromSlice(a, &d.topBoundary)
+			d.deleteBoundaryCell(a, &d.topBoundary)
 		} else {
 			deleteCellFromSlice(c, &a.below, &a.belowFrac, &a.kzzBelow, &a.dzMinusHalf)
 		}
@@ -18,7 +18,56 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 
 package inmap
 
-import "github.com/ctessum/atmos/plumerise"
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/atmos/plumerise"
+)
+
+// PlumeOptions specify how emissions from elevated sources are placed
+// in the vertical layers of the grid.
+type PlumeOptions struct {
+	// Rise is the plume rise parameterization that is used to calculate
+	// the effective height of the plume: "ASME" (the default) or "Briggs".
+	Rise string
+
+	// Profile is the vertical distribution of the emissions around the
+	// effective height. "layer" (the default) puts all of the emissions in
+	// the layer that contains the effective height; "tophat" spreads them
+	// evenly over Depth; and "gaussian" spreads them in a normal distribution
+	// with a standard deviation of Depth/4, so that 95% of the emissions
+	// are within Depth.
+	Profile string
+
+	// Depth is the vertical thickness of the plume [m]. It must be greater
+	// than zero if Profile is "tophat" or "gaussian".
+	Depth float64
+}
+
+// SetPlume sets the way the emissions in e from elevated sources are
+// placed in the vertical layers of the grid. It should be called before
+// the grid is created.
+func (e *Emissions) SetPlume(p PlumeOptions) error {
+	switch p.Rise {
+	case "", "ASME", "Briggs":
+	default:
+		return fmt.Errorf("inmap: invalid plume rise parameterization '%s'; "+
+			"options are 'ASME' and 'Briggs'", p.Rise)
+	}
+	switch p.Profile {
+	case "", "layer":
+	case "tophat", "gaussian":
+		if p.Depth <= 0 {
+			return fmt.Errorf("inmap: the depth of a '%s' plume must be greater than zero", p.Profile)
+		}
+	default:
+		return fmt.Errorf("inmap: invalid plume profile '%s'; "+
+			"options are 'layer', 'tophat', and 'gaussian'", p.Profile)
+	}
+	e.plume = p
+	return nil
+}
 
 // IsPlumeIn calculates whether the plume rise from an emission is at the height
 // of c when given stack information
@@ -26,46 +75,24 @@ import "github.com/ctessum/atmos/plumerise"
 // The return values are whether the plume rise ends within the current cell,
 // the height of the plume rise in meters, and whether there was an error.
 func (c *Cell) IsPlumeIn(stackHeight, stackDiam, stackTemp, stackVel float64) (bool, float64, error) {
+	col := newPlumeColumn(c.column())
+	return c.plumeIn(col.asmeRise(plumeStack{stackHeight, stackDiam, stackTemp, stackVel}))
+}
 
-	// Find the cells in the vertical column below c.
-	var cellStack []*Cell
-	cc := c
-	for {
-		cellStack = append(cellStack, cc)
-		if cc.groundLevel[0] == cc {
-			break
-		}
-		cc = cc.below[0]
-	}
-	// reverse the order of the stack so it starts at ground level.
-	for left, right := 0, len(cellStack)-1; left < right; left, right = left+1, right-1 {
-		cellStack[left], cellStack[right] = cellStack[right], cellStack[left]
-	}
-
-	layerHeights := make([]float64, len(cellStack)+1)
-	temperature := make([]float64, len(cellStack))
-	windSpeed := make([]float64, len(cellStack))
-	windSpeedInverse := make([]float64, len(cellStack))
-	windSpeedMinusThird := make([]float64, len(cellStack))
-	windSpeedMinusOnePointFour := make([]float64, len(cellStack))
-	sClass := make([]float64, len(cellStack))
-	s1 := make([]float64, len(cellStack))
+// IsPlumeIn is the same as Cell.IsPlumeIn, except that the meteorology in
+// the vertical column of grid cells that c is in, and the plume rise from
+// each stack in the column, are only calculated once until the grid changes.
+// It is safe for concurrent use.
+func (d *InMAP) IsPlumeIn(c *Cell, stackHeight, stackDiam, stackTemp, stackVel float64) (bool, float64, error) {
+	d.plumeMu.Lock()
+	defer d.plumeMu.Unlock()
+	col := d.plumeColumn(c)
+	return c.plumeIn(col.asmeRise(plumeStack{stackHeight, stackDiam, stackTemp, stackVel}))
+}
 
-	for i, cell := range cellStack {
-		layerHeights[i+1] = layerHeights[i] + cell.Dz
-		temperature[i] = cell.Temperature
-		windSpeed[i] = cell.WindSpeed
-		windSpeedInverse[i] = cell.WindSpeedInverse
-		windSpeedMinusThird[i] = cell.WindSpeedMinusThird
-		windSpeedMinusOnePointFour[i] = cell.WindSpeedMinusOnePointFour
-		sClass[i] = cell.SClass
-		s1[i] = cell.S1
-	}
-
-	plumeIndex, plumeHeight, err := plumerise.ASMEPrecomputed(stackHeight, stackDiam,
-		stackTemp, stackVel, layerHeights, temperature, windSpeed,
-		sClass, s1, windSpeedMinusOnePointFour, windSpeedMinusThird,
-		windSpeedInverse)
+// plumeIn returns whether an ASME plume rise calculation with the given
+// results ends within c.
+func (c *Cell) plumeIn(plumeIndex int, plumeHeight float64, err error) (bool, float64, error) {
 	if err != nil {
 		if err == plumerise.ErrAboveModelTop {
 			// If the plume is above the top of our stack, return true if c is
@@ -87,3 +114,234 @@ func (c *Cell) IsPlumeIn(stackHeight, stackDiam, stackTemp, stackVel float64) (b
 	}
 	return false, plumeHeight, nil
 }
+
+// column returns the cells in the vertical column below c, including c,
+// starting at ground level.
+func (c *Cell) column() []*Cell {
+	var cellStack []*Cell
+	cc := c
+	for {
+		cellStack = append(cellStack, cc)
+		if cc.groundLevel[0] == cc {
+			break
+		}
+		cc = cc.below[0]
+	}
+	// reverse the order of the stack so it starts at ground level.
+	for left, right := 0, len(cellStack)-1; left < right; left, right = left+1, right-1 {
+		cellStack[left], cellStack[right] = cellStack[right], cellStack[left]
+	}
+	return cellStack
+}
+
+// plumeStack holds the stack parameters of an elevated emissions source.
+type plumeStack struct {
+	height, diam, temp, vel float64
+}
+
+// asmeResult holds the results of an ASME plume rise calculation.
+type asmeResult struct {
+	index  int
+	height float64
+	err    error
+}
+
+// plumeColumn holds the meteorology in a vertical column of grid cells,
+// starting at ground level, and the plume rise that has already been
+// calculated for stacks in the column.
+type plumeColumn struct {
+	cells []*Cell
+
+	layerHeights, temperature, windSpeed, windSpeedInverse,
+	windSpeedMinusThird, windSpeedMinusOnePointFour, sClass, s1 []float64
+
+	asme   map[plumeStack]asmeResult
+	briggs map[plumeStack]float64
+}
+
+// newPlumeColumn creates a new plume column from cellStack, which
+// should start at ground level.
+func newPlumeColumn(cellStack []*Cell) *plumeColumn {
+	col := &plumeColumn{
+		cells:                      cellStack,
+		layerHeights:               make([]float64, len(cellStack)+1),
+		temperature:                make([]float64, len(cellStack)),
+		windSpeed:                  make([]float64, len(cellStack)),
+		windSpeedInverse:           make([]float64, len(cellStack)),
+		windSpeedMinusThird:        make([]float64, len(cellStack)),
+		windSpeedMinusOnePointFour: make([]float64, len(cellStack)),
+		sClass:                     make([]float64, len(cellStack)),
+		s1:                         make([]float64, len(cellStack)),
+		asme:                       make(map[plumeStack]asmeResult),
+		briggs:                     make(map[plumeStack]float64),
+	}
+	for i, cell := range cellStack {
+		col.layerHeights[i+1] = col.layerHeights[i] + cell.Dz
+		col.temperature[i] = cell.Temperature
+		col.windSpeed[i] = cell.WindSpeed
+		col.windSpeedInverse[i] = cell.WindSpeedInverse
+		col.windSpeedMinusThird[i] = cell.WindSpeedMinusThird
+		col.windSpeedMinusOnePointFour[i] = cell.WindSpeedMinusOnePointFour
+		col.sClass[i] = cell.SClass
+		col.s1[i] = cell.S1
+	}
+	return col
+}
+
+// asmeRise calculates the plume rise from stack s using the ASME
+// parameterization. It returns the index of the layer that contains
+// the plume and the plume height in meters.
+func (col *plumeColumn) asmeRise(s plumeStack) (int, float64, error) {
+	r, ok := col.asme[s]
+	if !ok {
+		r.index, r.height, r.err = plumerise.ASMEPrecomputed(s.height, s.diam,
+			s.temp, s.vel, col.layerHeights, col.temperature, col.windSpeed,
+			col.sClass, col.s1, col.windSpeedMinusOnePointFour, col.windSpeedMinusThird,
+			col.windSpeedInverse)
+		col.asme[s] = r
+	}
+	return r.index, r.height, r.err
+}
+
+// briggsRise returns the plume height in meters from stack s using the
+// Briggs parameterization.
+func (col *plumeColumn) briggsRise(s plumeStack) float64 {
+	h, ok := col.briggs[s]
+	if !ok {
+		h = briggsPlumeRise(col.cells, s.height, s.diam, s.temp, s.vel)
+		col.briggs[s] = h
+	}
+	return h
+}
+
+// plumeColumn returns the plume column for c, creating it if it is
+// not in the cache. d.plumeMu must be locked by the caller.
+func (d *InMAP) plumeColumn(c *Cell) *plumeColumn {
+	if col, ok := d.plumeColumns[c]; ok {
+		return col
+	}
+	if d.plumeColumns == nil {
+		d.plumeColumns = make(map[*Cell]*plumeColumn)
+	}
+	// The column continues above c so that it can be shared with the cells
+	// above c. The plume rise at and below each layer does not depend on
+	// the layers above it, so this does not change whether the plume is in c.
+	cellStack := c.column()
+	for cc := c.above[0]; !cc.boundary; cc = cc.above[0] {
+		cellStack = append(cellStack, cc)
+	}
+	col := newPlumeColumn(cellStack)
+	for i, cc := range cellStack {
+		if i > 0 && cc.below[0] != cellStack[i-1] {
+			break // The cells below cc are in a different column.
+		}
+		if _, ok := d.plumeColumns[cc]; !ok {
+			d.plumeColumns[cc] = col
+		}
+	}
+	return col
+}
+
+// briggsPlumeRise calculates the plume height in meters using the
+// Briggs (1975) final plume rise equations, with the meteorology in
+// the layer of cellStack that contains the top of the stack. The rise is
+// the larger of the buoyancy and momentum rise.
+func briggsPlumeRise(cellStack []*Cell, stackHeight, stackDiam, stackTemp, stackVel float64) float64 {
+	const g = 9.80665 // m/s²
+
+	cell := cellStack[len(cellStack)-1]
+	var z float64
+	for _, cc := range cellStack {
+		if stackHeight < z+cc.Dz {
+			cell = cc
+			break
+		}
+		z += cc.Dz
+	}
+	if stackTemp <= 0 {
+		return stackHeight
+	}
+
+	u := math.Max(cell.WindSpeed, 1) // Limit the rise in calm conditions.
+	ta := cell.Temperature
+	// Buoyancy and momentum fluxes [m⁴/s³ and m⁴/s²].
+	fb := g * stackVel * stackDiam * stackDiam / 4 * math.Max(stackTemp-ta, 0) / stackTemp
+	fm := stackVel * stackVel * stackDiam * stackDiam / 4 * ta / stackTemp
+
+	var rise float64
+	if cell.SClass > 0.5 && cell.S1 > 0 { // stable
+		rise = math.Max(2.6*math.Cbrt(fb/(u*cell.S1)),
+			1.5*math.Cbrt(fm/(u*math.Sqrt(cell.S1))))
+	} else { // unstable or neutral
+		if fb < 55 {
+			rise = 21.425 * math.Pow(fb, 0.75) / u
+		} else {
+			rise = 38.71 * math.Pow(fb, 0.6) / u
+		}
+		rise = math.Max(rise, 3*stackDiam*stackVel/u)
+	}
+	return stackHeight + rise
+}
+
+// plumeFraction returns the fraction of the emissions from elevated
+// source e that are in c, given plume options p. Emissions that would be
+// below the ground or above the top of the model are put in the bottom
+// or top layer, respectively.
+func (d *InMAP) plumeFraction(c *Cell, e *EmisRecord, p PlumeOptions) (float64, error) {
+	d.plumeMu.Lock()
+	defer d.plumeMu.Unlock()
+	col := d.plumeColumn(c)
+	s := plumeStack{e.Height, e.Diam, e.Temp, e.Velocity}
+
+	if p.Rise != "Briggs" && p.Profile != "tophat" && p.Profile != "gaussian" {
+		in, _, err := c.plumeIn(col.asmeRise(s))
+		if err != nil || !in {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	var h float64
+	if p.Rise == "Briggs" {
+		h = col.briggsRise(s)
+	} else {
+		var err error
+		_, h, err = col.asmeRise(s)
+		if err != nil && err != plumerise.ErrAboveModelTop {
+			return 0, err
+		}
+	}
+
+	lower, upper := math.Inf(-1), math.Inf(1)
+	if c.Layer != 0 {
+		lower = c.LayerHeight
+	}
+	if !c.above[0].boundary {
+		upper = c.LayerHeight + c.Dz
+	}
+	cdf := p.cdf(h)
+	return cdf(upper) - cdf(lower), nil
+}
+
+// cdf returns the cumulative distribution function of the vertical
+// profile of a plume with effective height h [m].
+func (p PlumeOptions) cdf(h float64) func(z float64) float64 {
+	switch p.Profile {
+	case "tophat":
+		return func(z float64) float64 {
+			return math.Min(math.Max((z-h)/p.Depth+0.5, 0), 1)
+		}
+	case "gaussian":
+		sigma := p.Depth / 4
+		return func(z float64) float64 {
+			return 0.5 * math.Erfc(-(z-h)/(sigma*math.Sqrt2))
+		}
+	default:
+		return func(z float64) float64 {
+			if z > h {
+				return 1
+			}
+			return 0
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestPlumeDistribution(t *testing.T) {
+	const testTolerance = 1.e-8
+
+	p := PlumeOptions{Profile: "tophat", Depth: 100}
+	cdf := p.cdf(200)
+	if have := cdf(225) - cdf(175); absDifferent(have, 0.5, testTolerance) {
+		t.Errorf("tophat fraction: have %g, want 0.5", have)
+	}
+	p.Profile = "gaussian"
+	cdf = p.cdf(200)
+	if have := cdf(250) - cdf(150); absDifferent(have, 0.9545, 1.e-4) {
+		t.Errorf("gaussian fraction: have %g, want 0.9545", have)
+	}
+
+	for _, p := range []PlumeOptions{{Rise: "xxx"}, {Profile: "xxx"}, {Profile: "gaussian"}} {
+		if err := NewEmissions().SetPlume(p); err == nil {
+			t.Errorf("no error for invalid plume options %+v", p)
+		}
+	}
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	for _, p := range []PlumeOptions{
+		{},
+		{Rise: "Briggs"},
+		{Profile: "tophat", Depth: 1000},
+		{Rise: "Briggs", Profile: "gaussian", Depth: 300},
+	} {
+		emis := NewEmissions()
+		if err := emis.SetPlume(p); err != nil {
+			t.Fatal(err)
+		}
+		emis.Add(&EmisRecord{
+			PM25:     E,
+			Height:   150,
+			Diam:     2,
+			Temp:     400,
+			Velocity: 10,
+			Geom:     geom.Point{X: -3999, Y: -3999.},
+		})
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		var total float64
+		var layers int
+		for _, c := range d.cells {
+			if c.EmisFlux[iPM2_5] != 0 {
+				total += c.EmisFlux[iPM2_5] * c.Volume
+				layers++
+			}
+		}
+		if absDifferent(total, E, testTolerance*E) {
+			t.Errorf("%+v: emitted %g, want %g", p, total, E)
+		}
+		if p.Profile == "" && layers != 1 {
+			t.Errorf("%+v: emissions in %d layers, want 1", p, layers)
+		} else if p.Profile != "" && layers < 2 {
+			t.Errorf("%+v: emissions in %d layers, want more than 1", p, layers)
+		}
+	}
+}
+
+func TestPlumeRiseCache(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, NewEmissions()),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, height := range []float64{20, 150, 2000, 3000} {
+		var n int
+		for _, c := range d.cells {
+			want, wantHeight, err := c.IsPlumeIn(height, 2, 400, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, haveHeight, err := d.IsPlumeIn(c, height, 2, 400, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != want || (have && haveHeight != wantHeight) {
+				t.Errorf("stack height %g, layer %d: have %v (%g m), want %v (%g m)",
+					height, c.Layer, have, haveHeight, want, wantHeight)
+			}
+			if have {
+				n++
+			}
+		}
+		if n != len(d.cells)/d.nlayers {
+			t.Errorf("stack height %g: plume is in %d cells, want %d", height, n, len(d.cells)/d.nlayers)
+		}
+	}
+	if len(d.plumeColumns) != len(d.cells) {
+		t.Errorf("%d cells have cached columns, want %d", len(d.plumeColumns), len(d.cells))
+	}
+	columns := make(map[*plumeColumn]bool)
+	for _, col := range d.plumeColumns {
+		columns[col] = true
+	}
+	if len(columns) != len(d.cells)/d.nlayers {
+		t.Errorf("%d cached columns, want %d", len(columns), len(d.cells)/d.nlayers)
+	}
+
+	// The cache is cleared when the grid changes.
+	d.DeleteCells(len(d.cells) - 1)
+	if d.plumeColumns != nil {
+		t.Error("the plume rise cache was not cleared")
+	}
+}
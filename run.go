@@ -29,6 +29,7 @@ import (
 // Molar masses [grams per mole]
 const (
 	mwNOx = 46.0055
+	mwNO  = 30.0061
 	mwN   = 14.0067
 	mwNO3 = 62.00501
 	mwNH3 = 17.03056
@@ -46,74 +47,21 @@ const (
 	StoSO4 = mwS / mwSO4
 	NH3ToN = mwN / mwNH3
 	NtoNH4 = mwNH4 / mwN
+	NtoNO  = mwNO / mwN
+	NtoNO2 = mwNOx / mwN
 )
 
 const daysPerSecond = 1. / 3600. / 24.
 
-// EmisNames are the names of pollutants accepted as emissions [μg/s]
-var EmisNames = []string{"VOC", "NOx", "NH3", "SOx", "PM2_5"}
-
-var emisLabels = map[string]int{"VOC Emissions": igOrg,
-	"NOx emissions":   igNO,
-	"NH3 emissions":   igNH,
-	"SOx emissions":   igS,
-	"PM2.5 emissions": iPM2_5,
-}
-
-// PolNames are the names of pollutants within the model
-var PolNames = []string{"gOrg", "pOrg", // gaseous and particulate organic matter
-	"PM2_5",      // PM2.5
-	"gNH", "pNH", // gaseous and particulate N in ammonia
-	"gS", "pS", // gaseous and particulate S in sulfur
-	"gNO", "pNO", // gaseous and particulate N in nitrate
-}
-
-// Indicies of individual pollutants in arrays.
+// Indicies of individual pollutants in arrays when the default chemical
+// mechanism (see DefaultMechanism) is in use.
 const (
-	igOrg, ipOrg, iPM2_5, igNH, ipNH, igS, ipS, igNO, ipNO = 0, 1, 2, 3, 4, 5, 6, 7, 8
+	igOrg, ipOrg, iPM2_5, igNH, ipNH, igS, ipS, igNO, ipNO, igBOrg, ipBOrg = 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10
 )
 
-// map relating emissions to the associated PM2.5 concentrations
-var gasParticleMap = map[int]int{igOrg: ipOrg,
-	igNO: ipNO, igNH: ipNH, igS: ipS, iPM2_5: iPM2_5}
-
-type polConv struct {
-	index      []int     // index in concentration array
-	conversion []float64 // conversion from N to NH4, S to SO4, etc...
-}
-
-// PolLabels are labels and conversions for InMAP pollutants.
-var PolLabels = map[string]polConv{
-	"Total PM2.5": {[]int{iPM2_5, ipOrg, ipNH, ipS, ipNO},
-		[]float64{1, 1, NtoNH4, StoSO4, NtoNO3}},
-	"VOC":           {[]int{igOrg}, []float64{1.}},
-	"SOA":           {[]int{ipOrg}, []float64{1.}},
-	"Primary PM2.5": {[]int{iPM2_5}, []float64{1.}},
-	"NH3":           {[]int{igNH}, []float64{1. / NH3ToN}},
-	"pNH4":          {[]int{ipNH}, []float64{NtoNH4}},
-	"SOx":           {[]int{igS}, []float64{1. / SOxToS}},
-	"pSO4":          {[]int{ipS}, []float64{StoSO4}},
-	"NOx":           {[]int{igNO}, []float64{1. / NOxToN}},
-	"pNO3":          {[]int{ipNO}, []float64{NtoNO3}},
-}
-
-// baselinePolLabels specifies labels for the baseline (i.e., background
-// concentrations) pollutant species. It is different than polLabels in that
-// TotalPM2_5 is its own category and there is no PrimaryPM2_5.
-var baselinePolLabels = map[string]polConv{
-	"Baseline Total PM2.5": {[]int{iPM2_5}, []float64{1}},
-	"Baseline VOC":         {[]int{igOrg}, []float64{1.}},
-	"Baseline SOA":         {[]int{ipOrg}, []float64{1.}},
-	"Baseline NH3":         {[]int{igNH}, []float64{1. / NH3ToN}},
-	"Baseline pNH4":        {[]int{ipNH}, []float64{NtoNH4}},
-	"Baseline SOx":         {[]int{igS}, []float64{1. / SOxToS}},
-	"Baseline pSO4":        {[]int{ipS}, []float64{StoSO4}},
-	"Baseline NOx":         {[]int{igNO}, []float64{1. / NOxToN}},
-	"Baseline pNO3":        {[]int{ipNO}, []float64{NtoNO3}},
-}
-
 // ResetCells clears concentration and emissions information from all of the
-// grid cells and boundary cells.
+// grid cells and boundary cells. Boundary conditions set by
+// SetBoundaryConditions are restored afterwards.
 func ResetCells() DomainManipulator {
 	return func(d *InMAP) error {
 		for _, g := range [][]*Cell{d.cells, d.westBoundary, d.eastBoundary,
@@ -122,8 +70,14 @@ func ResetCells() DomainManipulator {
 				c.Ci = make([]float64, len(PolNames))
 				c.Cf = make([]float64, len(PolNames))
 				c.EmisFlux = make([]float64, len(PolNames))
+				c.makeBudget()
 			}
 		}
+		d.retiredBudget = nil
+		d.extrapolation = nil
+		if d.boundaryConditions != nil {
+			return SetBoundaryConditions(d.boundaryConditions)(d)
+		}
 		return nil
 	}
 }
@@ -187,58 +141,162 @@ func (c ConvergenceStatus) String() string {
 	return s
 }
 
+// ConvergenceRecord holds the relative change in each of the quantities
+// measured by a ConvergenceCriterion between the last convergence check
+// and this one.
+type ConvergenceRecord struct {
+	// Iteration is the number of iterations that had been completed
+	// at the time of the check.
+	Iteration int
+
+	// SimulationTime is the simulation time [s] at the time of the check.
+	SimulationTime float64
+
+	// Names are the names of the measured quantities.
+	Names []string
+
+	// Change is the relative change in each quantity.
+	Change []float64
+}
+
+func (c ConvergenceRecord) String() string {
+	s := "Percent change since last convergence check:"
+	for i, n := range c.Names {
+		s += fmt.Sprintf("\n%s: %.2g%%", n, c.Change[i]*100)
+	}
+	return s
+}
+
+// convergenceState holds the internal state of SteadyStateConvergenceCheck.
+// It is stored in the InMAP object rather than in the convergence check
+// function so that it can be saved in checkpoints.
+type convergenceState struct {
+	// OldMeasurement is the measurement by the convergence criterion
+	// at the last check.
+	OldMeasurement []float64
+
+	// TimeSinceLastCheck is the simulation time [s] since the last check.
+	TimeSinceLastCheck float64
+
+	// SimulationTime is the simulation time [s] since the beginning
+	// of the simulation.
+	SimulationTime float64
+
+	// Iteration is the number of iterations that have been completed.
+	Iteration int
+
+	// History holds the results of each check.
+	History []ConvergenceRecord
+}
+
+// convergenceCheckPeriod is the simulation time [s] between
+// convergence checks.
+const convergenceCheckPeriod = 3600.
+
 // SteadyStateConvergenceCheck checks whether a steady-state
 // simulation is finished and sets the Done
 // flag if it is. If numIterations > 0, the simulation is finished after
 // that number of iterations have completed. Otherwise, the simulation has
 // finished if the change in mass in the domain since the last check is less
 // than 0.1%. c is a channel over which the percent change between checks is
-// sent. If c is nil, no status updates will be sent.
+// sent. If c is nil, no status updates will be sent. The results of each
+// check are also kept in the convergence history (see ConvergenceHistory).
 func SteadyStateConvergenceCheck(numIterations int, c chan ConvergenceStatus) DomainManipulator {
+	const tolerance = 0.001 // tolerance for convergence
+	check := func(oldSum, sum []float64) ([]float64, bool) {
+		if len(oldSum) != len(sum) {
+			oldSum = make([]float64, len(sum))
+		}
+		timeToQuit := true
+		status := make([]float64, len(sum))
+		for ii := range sum {
+			bias, converged := checkConvergence(sum[ii], oldSum[ii], tolerance)
+			if !converged {
+				timeToQuit = false
+			}
+			status[ii] = bias
+		}
+		return status, timeToQuit
+	}
+	var send func(ConvergenceRecord)
+	if c != nil {
+		send = func(r ConvergenceRecord) { c <- ConvergenceStatus(r.Change) }
+	}
+	return convergenceCheck(numIterations, MassConvergence(), check, send)
+}
 
-	const tolerance = 0.001   // tolerance for convergence
-	const checkPeriod = 3600. // seconds, how often to check for convergence
-
-	// oldSum is the sum of mass in the domain at the last check
-	oldSum := make([]float64, len(PolNames))
+func checkConvergence(newSum, oldSum, tolerance float64) (float64, bool) {
+	bias := (newSum - oldSum) / oldSum
+	if math.Abs(bias) > tolerance || math.IsInf(bias, 0) {
+		return bias, false
+	}
+	return bias, true
+}
 
-	timeSinceLastCheck := 0.
-	iteration := 0
+// ConvergenceCheck is the same as SteadyStateConvergenceCheck, except
+// that, if numIterations < 1, the simulation has finished when the relative
+// change in all of the quantities measured by criterion since the last
+// check is less than tolerance, and that the result of each check is sent
+// over c as a ConvergenceRecord. Checks are made every hour of simulation
+// time.
+func ConvergenceCheck(numIterations int, criterion ConvergenceCriterion, tolerance float64, c chan ConvergenceRecord) DomainManipulator {
+	check := func(old, current []float64) ([]float64, bool) {
+		change := criterion.Change(old, current)
+		return change, converged(change, tolerance)
+	}
+	var send func(ConvergenceRecord)
+	if c != nil {
+		send = func(r ConvergenceRecord) { c <- r }
+	}
+	return convergenceCheck(numIterations, criterion, check, send)
+}
 
+// convergenceCheck returns a function that checks for convergence as
+// described in the documentation for ConvergenceCheck, where check returns
+// the change between the old and current measurements by criterion and
+// whether the simulation has converged. If send is not nil, it is called
+// with the result of each check.
+func convergenceCheck(numIterations int, criterion ConvergenceCriterion,
+	check func(old, current []float64) ([]float64, bool), send func(ConvergenceRecord)) DomainManipulator {
 	return func(d *InMAP) error {
 
 		if d.Dt == 0 {
 			return fmt.Errorf("inmap: timestep is zero")
 		}
 
-		timeSinceLastCheck += d.Dt
-		iteration++
+		if d.convergence == nil {
+			d.convergence = new(convergenceState)
+		}
+		s := d.convergence
+
+		s.TimeSinceLastCheck += d.Dt
+		s.SimulationTime += d.Dt
+		s.Iteration++
 		// If NumIterations has been set, used it to determine when to
 		// stop the model.
 		if numIterations > 0 {
-			if iteration >= numIterations {
+			if s.Iteration >= numIterations {
 				d.Done = true
 			}
 			// Otherwise, occasionally check to see if the pollutant
 			// concentrations have converged
-		} else if timeSinceLastCheck >= checkPeriod {
-			timeToQuit := true
-			timeSinceLastCheck = 0.
-			status := make(ConvergenceStatus, len(PolNames))
-			for ii := range PolNames {
-				var sum float64
-				for _, c := range d.cells {
-					sum += c.Cf[ii]
-				}
-				bias, converged := checkConvergence(sum, oldSum[ii], tolerance)
-				if !converged {
-					timeToQuit = false
-				}
-				status[ii] = bias
-				oldSum[ii] = sum
+		} else if s.TimeSinceLastCheck >= convergenceCheckPeriod {
+			s.TimeSinceLastCheck = 0.
+			measurement, err := criterion.Measure(d)
+			if err != nil {
+				return err
+			}
+			change, timeToQuit := check(s.OldMeasurement, measurement)
+			record := ConvergenceRecord{
+				Iteration:      s.Iteration,
+				SimulationTime: s.SimulationTime,
+				Names:          criterion.Names(),
+				Change:         change,
 			}
-			if c != nil {
-				c <- status
+			s.OldMeasurement = measurement
+			s.History = append(s.History, record)
+			if send != nil {
+				send(record)
 			}
 			if timeToQuit {
 				d.Done = true
@@ -248,12 +306,14 @@ func SteadyStateConvergenceCheck(numIterations int, c chan ConvergenceStatus) Do
 	}
 }
 
-func checkConvergence(newSum, oldSum, tolerance float64) (float64, bool) {
-	bias := (newSum - oldSum) / oldSum
-	if math.Abs(bias) > tolerance || math.IsInf(bias, 0) {
-		return bias, false
+// converged returns whether all of the relative changes are within tolerance.
+func converged(change []float64, tolerance float64) bool {
+	for _, bias := range change {
+		if math.Abs(bias) > tolerance || math.IsInf(bias, 0) {
+			return false
+		}
 	}
-	return bias, true
+	return true
 }
 
 // SimulationStatus holds information about the progress of a simulation.
@@ -281,24 +341,50 @@ func (s SimulationStatus) String() string {
 		s.StepWalltime.Hours(), s.Dt, s.SimulationDays)
 }
 
+// logState holds the internal state of Log. Like convergenceState, it is
+// stored in the InMAP object so that it can be checkpointed.
+type logState struct {
+	// Iteration is the number of iterations that have been completed.
+	Iteration int
+
+	// NDaysRun is the number of days in simulation time that have been run.
+	NDaysRun float64
+
+	// Walltime is the total wall time of the simulation as of the most
+	// recent iteration, including time spent before the simulation was
+	// resumed from a checkpoint.
+	Walltime time.Duration
+}
+
 // Log sends simulation status messages to c.
 func Log(c chan *SimulationStatus) DomainManipulator {
 	startTime := time.Now()
 	timeStepTime := time.Now()
 
-	iteration := 0
-	nDaysRun := 0.
+	// priorWalltime is the wall time spent before the simulation was resumed
+	// from a checkpoint, if any.
+	var priorWalltime time.Duration
+	first := true
 
 	return func(d *InMAP) error {
-		iteration++
-		nDaysRun += d.Dt * daysPerSecond
+		if d.log == nil {
+			d.log = new(logState)
+		}
+		s := d.log
+		if first {
+			priorWalltime = s.Walltime
+			first = false
+		}
+		s.Iteration++
+		s.NDaysRun += d.Dt * daysPerSecond
+		s.Walltime = priorWalltime + time.Since(startTime)
 
 		c <- &SimulationStatus{
-			Iteration:      iteration,
-			Walltime:       time.Since(startTime),
+			Iteration:      s.Iteration,
+			Walltime:       s.Walltime,
 			StepWalltime:   time.Since(timeStepTime),
 			Dt:             d.Dt,
-			SimulationDays: nDaysRun,
+			SimulationDays: s.NDaysRun,
 		}
 		timeStepTime = time.Now()
 		return nil
@@ -84,15 +84,36 @@ func (d *InMAP) initFromCells(cells []*Cell, emis *Emissions, config *VarGridCon
 		d.popIndices[p] = i
 	}
 	d.index = rtree.NewTree(25, 50)
+	for _, c := range cells {
+		c.resizeArrays()
+		c.makeBudget()
+	}
 	d.AddCells(cells...)
 	d.sort()
 	// Add emissions to new cells.
 	if emis != nil {
 		for _, c := range d.cells {
-			c.setEmissionsFlux(emis) // This needs to be called after setNeighbors.
+			d.setEmissionsFlux(c, emis) // This needs to be called after setNeighbors.
 			if c.Layer > d.nlayers-1 {
 				d.nlayers = c.Layer + 1
 			}
 		}
 	}
 }
+
+// resizeArrays makes sure the concentration arrays in c have an
+// element for each species in PolNames, which may not be the case if
+// c was saved using a different chemical mechanism. Any
+// added elements are set to zero.
+func (c *Cell) resizeArrays() {
+	resize := func(a []float64) []float64 {
+		if len(a) >= len(PolNames) {
+			return a[:len(PolNames)]
+		}
+		return append(a, make([]float64, len(PolNames)-len(a))...)
+	}
+	c.Ci = resize(c.Ci)
+	c.Cf = resize(c.Cf)
+	c.CBaseline = resize(c.CBaseline)
+	c.EmisFlux = resize(c.EmisFlux)
+}
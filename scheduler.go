@@ -0,0 +1,96 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// blocksPerProc is the number of blocks of grid cells that are created for
+// each processor by BlockCalculations. Using more than one block per
+// processor allows processors that finish early to help with the
+// remaining work.
+const blocksPerProc = 8
+
+// BlockCalculations returns a function that runs a series of calculations
+// on all of the model grid cells, like Calculations does, but without locking
+// each cell. The grid cells, which are sorted by layer and location,
+// are divided into blocks of adjacent cells, and the blocks are handed out
+// to the processors as they become available.
+//
+// This relies on calculators following the rules that the
+// science functions in this package follow: they can read the
+// initial concentrations (Ci) and other fields of neighboring cells,
+// but they only change the final concentrations (Cf) and other fields of the
+// cell they are given and of the boundary cells next to it. Because each
+// cell is only changed by the processor it is assigned to, and the values
+// it reads do not change during the calculations, the results do not
+// depend on the number of processors. AddEmissionsFlux, which sets Ci, must
+// be run separately from calculators that read Ci from neighboring cells,
+// as with Calculations.
+//
+// Cells are not locked, so other goroutines, such as the
+// HTML user interface, may read partially updated values while the
+// calculations are running.
+func BlockCalculations(calculators ...CellManipulator) DomainManipulator {
+	return blockCalculations(runtime.GOMAXPROCS(0), calculators...)
+}
+
+// blockCalculations is the same as BlockCalculations but uses
+// nprocs processors.
+func blockCalculations(nprocs int, calculators ...CellManipulator) DomainManipulator {
+	return func(d *InMAP) error {
+		d.forEachBlock(nprocs, func(c *Cell) {
+			for _, f := range calculators {
+				f(c, d.Dt)
+			}
+		})
+		return nil
+	}
+}
+
+// forEachBlock concurrently runs f on each of the grid cells using nprocs
+// processors, as described in the documentation for BlockCalculations.
+func (d *InMAP) forEachBlock(nprocs int, f func(c *Cell)) {
+	cells := d.cells
+	nblocks := nprocs * blocksPerProc
+	if nblocks > len(cells) {
+		nblocks = len(cells)
+	}
+	var next int64 = -1 // The index of the last block that has been handed out.
+	var wg sync.WaitGroup
+	wg.Add(nprocs)
+	for pp := 0; pp < nprocs; pp++ {
+		go func() {
+			for {
+				b := int(atomic.AddInt64(&next, 1))
+				if b >= nblocks {
+					break
+				}
+				for _, c := range cells[b*len(cells)/nblocks : (b+1)*len(cells)/nblocks] {
+					f(c)
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// schedulerTestModel returns a model on the variable-resolution test grid
+// that uses calculations to run the science functions.
+func schedulerTestModel(calculations func(...CellManipulator) DomainManipulator,
+	numIterations int) *InMAP {
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	return &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			calculations(AddEmissionsFlux()),
+			calculations(
+				UpwindAdvection(),
+				Mixing(),
+				MeanderMixing(),
+				DryDeposition(),
+				WetDeposition(),
+				Chemistry(),
+			),
+			SteadyStateConvergenceCheck(numIterations, nil),
+		},
+	}
+}
+
+// The results of BlockCalculations should not depend on the number
+// of processors and should match the results of Calculations.
+func TestBlockCalculations(t *testing.T) {
+	const numIterations = 10
+
+	run := func(calculations func(...CellManipulator) DomainManipulator) *InMAP {
+		d := schedulerTestModel(calculations, numIterations)
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	want := run(Calculations)
+	for _, nprocs := range []int{1, 2, 3, 8, 1000} {
+		have := run(func(f ...CellManipulator) DomainManipulator {
+			return blockCalculations(nprocs, f...)
+		})
+		for i, c := range want.cells {
+			for ii, v := range c.Cf {
+				if v != have.cells[i].Cf[ii] {
+					t.Fatalf("%d processors: cell %d %s: %g != %g", nprocs, i,
+						PolNames[ii], have.cells[i].Cf[ii], v)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkCalculations(b *testing.B, calculations func(...CellManipulator) DomainManipulator) {
+	d := schedulerTestModel(calculations, 1)
+	if err := d.Init(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, f := range d.RunFuncs[0:2] {
+			if err := f(d); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCalculations(b *testing.B) {
+	benchmarkCalculations(b, Calculations)
+}
+
+func BenchmarkBlockCalculations(b *testing.B) {
+	benchmarkCalculations(b, BlockCalculations)
+}
@@ -25,6 +25,13 @@ import "github.com/ctessum/atmos/advect"
 // boundary layer and based on Wilson (2004) for above the boundary layer.
 // Also calculate horizontal mixing.
 func Mixing() CellManipulator {
+	return mixing(true)
+}
+
+// mixing returns a function that calculates mixing as described in the
+// documentation for Mixing, excluding vertical diffusion
+// if verticalDiffusion is false.
+func mixing(verticalDiffusion bool) CellManipulator {
 	return func(c *Cell, Δt float64) {
 		for ii := range c.Cf {
 			// Pleim (2007) Equation 10.
@@ -33,47 +40,77 @@ func Mixing() CellManipulator {
 			}
 			for i, a := range c.above {
 				// Convection balancing downward mixing
-				c.Cf[ii] += (a.M2d*a.Ci[ii]*a.Dz/c.Dz - c.M2d*c.Ci[ii]) *
+				convection := (a.M2d*a.Ci[ii]*a.Dz/c.Dz - c.M2d*c.Ci[ii]) *
 					Δt * c.aboveFrac[i]
+				c.Cf[ii] += convection
+				if a.boundary { // keep track of mass that leaves the domain.
+					a.Cf[ii] -= convection * c.Volume / a.Volume
+				}
+				if !verticalDiffusion || !c.calculatesFlux(a) {
+					continue
+				}
 				// Mixing with above
-				c.Cf[ii] += 1. / c.Dz * (c.kzzAbove[i] * (a.Ci[ii] - c.Ci[ii]) /
+				mixing := 1. / c.Dz * (c.kzzAbove[i] * (a.Ci[ii] - c.Ci[ii]) /
 					c.dzPlusHalf[i]) * Δt * c.aboveFrac[i]
+				c.Cf[ii] += mixing
+				if r := c.fluxRegister(a); r != nil {
+					r[ii] -= mixing * c.Volume / a.Volume
+				}
 			}
 			for i, b := range c.below { // Mixing with below
-				c.Cf[ii] += 1. / c.Dz * (c.kzzBelow[i] * (b.Ci[ii] - c.Ci[ii]) /
+				if !verticalDiffusion || !c.calculatesFlux(b) {
+					continue
+				}
+				flux := 1. / c.Dz * (c.kzzBelow[i] * (b.Ci[ii] - c.Ci[ii]) /
 					c.dzMinusHalf[i]) * Δt * c.belowFrac[i]
+				c.Cf[ii] += flux
+				if r := c.fluxRegister(b); r != nil {
+					r[ii] -= flux * c.Volume / b.Volume
+				}
 			}
 			// Horizontal mixing
 			for i, w := range c.west { // Mixing with West
+				if !c.calculatesFlux(w) {
+					continue
+				}
 				flux := 1. / c.Dx * (c.kxxWest[i] *
 					(w.Ci[ii] - c.Ci[ii]) / c.dxMinusHalf[i]) * Δt * c.westFrac[i]
 				c.Cf[ii] += flux * w.Dz / c.Dz
-				if w.boundary { // keep track of mass that leaves the domain.
-					w.Cf[ii] -= flux * c.Volume / w.Volume
+				if r := c.fluxRegister(w); r != nil {
+					r[ii] -= flux * w.Dz / c.Dz * c.Volume / w.Volume
 				}
 			}
 			for i, e := range c.east { // Mixing with East
+				if !c.calculatesFlux(e) {
+					continue
+				}
 				flux := 1. / c.Dx * (c.kxxEast[i] *
 					(e.Ci[ii] - c.Ci[ii]) / c.dxPlusHalf[i]) * Δt * c.eastFrac[i]
 				c.Cf[ii] += flux
-				if e.boundary { // keep track of mass that leaves the domain.
-					e.Cf[ii] -= flux * c.Volume / e.Volume
+				if r := c.fluxRegister(e); r != nil {
+					r[ii] -= flux * c.Volume / e.Volume
 				}
 			}
 			for i, s := range c.south { // Mixing with South
+				if !c.calculatesFlux(s) {
+					continue
+				}
 				flux := 1. / c.Dy * (c.kyySouth[i] *
 					(s.Ci[ii] - c.Ci[ii]) / c.dyMinusHalf[i]) * Δt * c.southFrac[i]
 				c.Cf[ii] += flux * s.Dz / c.Dz
-				if s.boundary { // keep track of mass that leaves the domain.
-					s.Cf[ii] -= flux * c.Volume / s.Volume
+				if r := c.fluxRegister(s); r != nil {
+					r[ii] -= flux * s.Dz / c.Dz * c.Volume / s.Volume
 				}
 			}
 			for i, n := range c.north { // Mixing with North
+				if !c.calculatesFlux(n) {
+					continue
+				}
 				flux := 1. / c.Dy * (c.kyyNorth[i] *
 					(n.Ci[ii] - c.Ci[ii]) / c.dyPlusHalf[i]) * Δt * c.northFrac[i]
 				c.Cf[ii] += flux
-				if n.boundary { // keep track of mass that leaves the domain.
-					n.Cf[ii] -= flux * c.Volume / n.Volume
+				if r := c.fluxRegister(n); r != nil {
+					r[ii] -= flux * c.Volume / n.Volume
 				}
 			}
 		}
@@ -86,58 +123,76 @@ func UpwindAdvection() CellManipulator {
 	return func(c *Cell, Δt float64) {
 		for ii := range c.Cf {
 			for i, w := range c.west {
+				if !c.calculatesFlux(w) {
+					continue
+				}
 				flux := advect.UpwindFlux(c.UAvg, w.Ci[ii], c.Ci[ii], c.Dx) *
 					c.westFrac[i] * Δt
 				// Multiply by Dz ratio to correct for differences in cell heights.
 				c.Cf[ii] += flux * w.Dz / c.Dz
-				if w.boundary { // keep track of mass that leaves the domain.
-					w.Cf[ii] -= flux * c.Volume / w.Volume
+				// Keep track of mass that leaves the domain or the time step class.
+				if r := c.fluxRegister(w); r != nil {
+					r[ii] -= flux * w.Dz / c.Dz * c.Volume / w.Volume
 				}
 			}
 
 			for i, e := range c.east {
+				if !c.calculatesFlux(e) {
+					continue
+				}
 				flux := advect.UpwindFlux(e.UAvg, c.Ci[ii], e.Ci[ii], c.Dx) *
 					c.eastFrac[i] * Δt
 				c.Cf[ii] -= flux
-				if e.boundary { // keep track of mass that leaves the domain.
-					e.Cf[ii] += flux * c.Volume / e.Volume
+				if r := c.fluxRegister(e); r != nil {
+					r[ii] += flux * c.Volume / e.Volume
 				}
 			}
 
 			for i, s := range c.south {
+				if !c.calculatesFlux(s) {
+					continue
+				}
 				flux := advect.UpwindFlux(c.VAvg, s.Ci[ii], c.Ci[ii], c.Dy) *
 					c.southFrac[i] * Δt
 				// Multiply by Dz ratio to correct for differences in cell heights.
 				c.Cf[ii] += flux * s.Dz / c.Dz
-				if s.boundary { // keep track of mass that leaves the domain.
-					s.Cf[ii] -= flux * c.Volume / s.Volume
+				if r := c.fluxRegister(s); r != nil {
+					r[ii] -= flux * s.Dz / c.Dz * c.Volume / s.Volume
 				}
 			}
 
 			for i, n := range c.north {
+				if !c.calculatesFlux(n) {
+					continue
+				}
 				flux := advect.UpwindFlux(n.VAvg, c.Ci[ii], n.Ci[ii], c.Dy) *
 					c.northFrac[i] * Δt
 				c.Cf[ii] -= flux
-				if n.boundary { // keep track of mass that leaves the domain.
-					n.Cf[ii] += flux * c.Volume / n.Volume
+				if r := c.fluxRegister(n); r != nil {
+					r[ii] += flux * c.Volume / n.Volume
 				}
 			}
 
 			for i, b := range c.below {
-				if c.Layer > 0 {
+				if c.Layer > 0 && c.calculatesFlux(b) {
 					flux := advect.UpwindFlux(c.WAvg, b.Ci[ii], c.Ci[ii], c.Dz) *
 						c.belowFrac[i] * Δt
-					// Multiply by Dz ratio to correct for differences in cell heights.
 					c.Cf[ii] += flux
+					if r := c.fluxRegister(b); r != nil {
+						r[ii] -= flux * c.Volume / b.Volume
+					}
 				}
 			}
 
 			for i, a := range c.above {
+				if !c.calculatesFlux(a) {
+					continue
+				}
 				flux := advect.UpwindFlux(a.WAvg, c.Ci[ii], a.Ci[ii], c.Dz) *
 					c.aboveFrac[i] * Δt
 				c.Cf[ii] -= flux
-				if a.boundary { // keep track of mass that leaves the domain.
-					a.Cf[ii] += flux * c.Volume / a.Volume
+				if r := c.fluxRegister(a); r != nil {
+					r[ii] += flux * c.Volume / a.Volume
 				}
 			}
 
@@ -153,70 +208,86 @@ func MeanderMixing() CellManipulator {
 		for ii := range c.Ci {
 
 			for i, w := range c.west { // Mixing with West
+				if !c.calculatesFlux(w) {
+					continue
+				}
 				flux := 1. / c.Dx * c.UDeviation *
 					(w.Ci[ii] - c.Ci[ii]) * Δt * c.westFrac[i]
 				// Multiply by Dz ratio to correct for differences in cell heights.
 				c.Cf[ii] += flux * w.Dz / c.Dz
-				if w.boundary {
-					w.Cf[ii] -= flux * c.Volume / w.Volume
+				if r := c.fluxRegister(w); r != nil {
+					r[ii] -= flux * w.Dz / c.Dz * c.Volume / w.Volume
 				}
 			}
 			for i, e := range c.east { // Mixing with East
+				if !c.calculatesFlux(e) {
+					continue
+				}
 				flux := 1. / c.Dx * (e.UDeviation *
 					(e.Ci[ii] - c.Ci[ii])) * Δt * c.eastFrac[i]
 				c.Cf[ii] += flux
-				if e.boundary {
-					e.Cf[ii] -= flux * c.Volume / e.Volume
+				if r := c.fluxRegister(e); r != nil {
+					r[ii] -= flux * c.Volume / e.Volume
 				}
 			}
 			for i, s := range c.south { // Mixing with South
+				if !c.calculatesFlux(s) {
+					continue
+				}
 				flux := 1. / c.Dy * (c.VDeviation *
 					(s.Ci[ii] - c.Ci[ii])) * Δt * c.southFrac[i]
 				c.Cf[ii] += flux * s.Dz / c.Dz
-				if s.boundary {
-					s.Cf[ii] -= flux * c.Volume / s.Volume
+				if r := c.fluxRegister(s); r != nil {
+					r[ii] -= flux * s.Dz / c.Dz * c.Volume / s.Volume
 				}
 			}
 			for i, n := range c.north { // Mixing with North
+				if !c.calculatesFlux(n) {
+					continue
+				}
 				flux := 1. / c.Dy * (n.VDeviation *
 					(n.Ci[ii] - c.Ci[ii])) * Δt * c.northFrac[i]
 				c.Cf[ii] += flux
-				if n.boundary {
-					n.Cf[ii] -= flux * c.Volume / n.Volume
+				if r := c.fluxRegister(n); r != nil {
+					r[ii] -= flux * c.Volume / n.Volume
 				}
 			}
 		}
 	}
 }
 
-// Chemistry returns a function that calculates the secondary formation of PM2.5.
-// It explicitly calculates formation of particulate sulfate
-// from gaseous and aqueous SO2.
+// Chemistry returns a function that calculates the secondary formation of PM2.5
+// using the reactions and gas/particle partitioning in the current
+// chemical mechanism (see SetMechanism).
+// In the default mechanism, it explicitly calculates formation of particulate
+// sulfate from gaseous and aqueous SO2.
 // It partitions organic matter ("gOrg" and "pOrg"), the
 // nitrogen in nitrate ("gNO and pNO"), and the nitrogen in ammonia ("gNH" and
 // "pNH) between gaseous and particulate phase
 // based on the spatially explicit partioning present in the baseline data.
 func Chemistry() CellManipulator {
 	return func(c *Cell, Δt float64) {
-		// All SO4 forms particles, so sulfur particle formation is limited by the
-		// SO2 -> SO4 reaction.
-		ΔS := c.SO2oxidation * c.Cf[igS] * Δt
-		c.Cf[ipS] += ΔS
-		c.Cf[igS] -= ΔS
-		// NH3 / pNH4 partitioning
-		totalNH := c.Cf[igNH] + c.Cf[ipNH]
-		c.Cf[ipNH] = totalNH * c.NHPartitioning
-		c.Cf[igNH] = totalNH * (1 - c.NHPartitioning)
+		// Keep track of the net change caused by chemistry.
+		for i, v := range c.Cf {
+			c.budget[budgetChem][i] -= v
+		}
 
-		// NOx / pN0 partitioning
-		totalNO := c.Cf[igNO] + c.Cf[ipNO]
-		c.Cf[ipNO] = totalNO * c.NOPartitioning
-		c.Cf[igNO] = totalNO * (1 - c.NOPartitioning)
+		for _, r := range reactions {
+			Δ := r.rate(c) * c.Cf[r.from] * Δt
+			c.Cf[r.to] += Δ * r.yield
+			c.Cf[r.from] -= Δ
+		}
+
+		for _, p := range partitionings {
+			frac := p.fraction(c)
+			total := c.Cf[p.gas] + c.Cf[p.particle]
+			c.Cf[p.particle] = total * frac
+			c.Cf[p.gas] = total * (1 - frac)
+		}
 
-		// VOC/SOA partitioning
-		totalOrg := c.Cf[igOrg] + c.Cf[ipOrg]
-		c.Cf[ipOrg] = totalOrg * c.AOrgPartitioning
-		c.Cf[igOrg] = totalOrg * (1 - c.AOrgPartitioning)
+		for i, v := range c.Cf {
+			c.budget[budgetChem][i] += v
+		}
 	}
 }
 
@@ -224,21 +295,13 @@ func Chemistry() CellManipulator {
 func DryDeposition() CellManipulator {
 	return func(c *Cell, Δt float64) {
 		if c.Layer == 0 {
+			c.dryDepTime += Δt
 			fac := 1. / c.Dz * Δt
-			noxfac := c.NOxDryDep * fac
-			so2fac := c.SO2DryDep * fac
-			vocfac := c.VOCDryDep * fac
-			nh3fac := c.NH3DryDep * fac
-			pm25fac := c.ParticleDryDep * fac
-			c.Cf[igOrg] -= c.Ci[igOrg] * vocfac
-			c.Cf[ipOrg] -= c.Ci[ipOrg] * pm25fac
-			c.Cf[iPM2_5] -= c.Ci[iPM2_5] * pm25fac
-			c.Cf[igNH] -= c.Ci[igNH] * nh3fac
-			c.Cf[ipNH] -= c.Ci[ipNH] * pm25fac
-			c.Cf[igS] -= c.Ci[igS] * so2fac
-			c.Cf[ipS] -= c.Ci[ipS] * pm25fac
-			c.Cf[igNO] -= c.Ci[igNO] * noxfac
-			c.Cf[ipNO] -= c.Ci[ipNO] * pm25fac
+			for i, s := range species {
+				if s.DryDep != nil {
+					c.depositDry(i, c.Ci[i]*(s.DryDep(c)*fac))
+				}
+			}
 		}
 	}
 }
@@ -246,18 +309,12 @@ func DryDeposition() CellManipulator {
 // WetDeposition returns a function that calculates particle removal by wet deposition.
 func WetDeposition() CellManipulator {
 	return func(c *Cell, Δt float64) {
-		particleFrac := c.ParticleWetDep * Δt
-		SO2Frac := c.SO2WetDep * Δt
-		otherGasFrac := c.OtherGasWetDep * Δt
-		c.Cf[igOrg] -= c.Ci[igOrg] * otherGasFrac
-		c.Cf[ipOrg] -= c.Ci[ipOrg] * particleFrac
-		c.Cf[iPM2_5] -= c.Ci[iPM2_5] * particleFrac
-		c.Cf[igNH] -= c.Ci[igNH] * otherGasFrac
-		c.Cf[ipNH] -= c.Ci[ipNH] * particleFrac
-		c.Cf[igS] -= c.Ci[igS] * SO2Frac
-		c.Cf[ipS] -= c.Ci[ipS] * particleFrac
-		c.Cf[igNO] -= c.Ci[igNO] * otherGasFrac
-		c.Cf[ipNO] -= c.Ci[ipNO] * particleFrac
+		c.wetDepTime += Δt
+		for i, s := range species {
+			if s.WetDep != nil {
+				c.depositWet(i, c.Ci[i]*(s.WetDep(c)*Δt))
+			}
+		}
 	}
 }
 
@@ -28,6 +28,7 @@ import (
 
 	"github.com/ctessum/geom"
 	"github.com/spatialmodel/inmap"
+	"golang.org/x/net/context"
 )
 
 // Empty is used for passing content-less messages.
@@ -46,6 +47,10 @@ type Worker struct {
 	PopIndices inmap.PopIndices
 	MR         *inmap.MortalityRates
 	GridGeom   []geom.Polygonal // Geometry of the output grid.
+
+	// ctx is the context that simulations requested over RPC are run
+	// with (see ListenContext).
+	ctx context.Context
 }
 
 // IOData holds the input to and output from a simulation request.
@@ -61,11 +66,23 @@ func (io *IOData) Result() (interface{}, error) {
 }
 
 // Calculate performs an InMAP simulation. It meets the requirements for
-// use with rpc.Call.
+// use with rpc.Call. If s was started using ListenContext, the simulation
+// is stopped when the listening context is cancelled.
 func (s *Worker) Calculate(input *IOData, output *IOData) error {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.CalculateContext(ctx, input, output)
+}
+
+// CalculateContext is the same as Calculate, except that the simulation
+// is stopped and ctx.Err() is returned if ctx is cancelled before the
+// simulation finishes.
+func (s *Worker) CalculateContext(ctx context.Context, input *IOData, output *IOData) error {
 	log.Printf("Slave calculating row=%v, layer=%v\n", input.Row, input.Layer)
 
-	scienceFuncs := inmap.Calculations(
+	scienceFuncs := inmap.BlockCalculations(
 		inmap.UpwindAdvection(),
 		inmap.Mixing(),
 		inmap.MeanderMixing(),
@@ -80,7 +97,7 @@ func (s *Worker) Calculate(input *IOData, output *IOData) error {
 	}
 	const gridMutateInterval = 3600. // seconds
 	runFuncs := []inmap.DomainManipulator{
-		inmap.Calculations(inmap.AddEmissionsFlux()),
+		inmap.BlockCalculations(inmap.AddEmissionsFlux()),
 		scienceFuncs,
 		inmap.RunPeriodically(gridMutateInterval,
 			s.Config.MutateGrid(inmap.PopConcMutator(
@@ -95,18 +112,24 @@ func (s *Worker) Calculate(input *IOData, output *IOData) error {
 		RunFuncs:  runFuncs,
 	}
 
-	if err := d.Init(); err != nil {
+	if err := d.InitContext(ctx); err != nil {
+		if err == ctx.Err() {
+			return err
+		}
 		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
 	}
 
-	if err := d.Run(); err != nil {
+	if err := d.RunContext(ctx); err != nil {
+		if err == ctx.Err() {
+			return err
+		}
 		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
 	}
 
 	output.Output = make(map[string][]float64)
 	output.Row = input.Row
 	output.Layer = input.Layer
-	o, err := d.Results(false, outputVars...)
+	o, err := d.Results(false, outputVars()...)
 	if err != nil {
 		return err
 	}
@@ -155,12 +178,28 @@ func NewWorker(config *inmap.VarGridConfig, InMAPDataFile string, GridGeom []geo
 
 // Listen directs s to start listening for requests over RPCPort
 func (s *Worker) Listen(RPCPort string) error {
+	return s.ListenContext(context.Background(), RPCPort)
+}
+
+// ListenContext is the same as Listen, except that when ctx is cancelled
+// s stops listening, any simulation in progress is stopped, and
+// ctx.Err() is returned.
+func (s *Worker) ListenContext(ctx context.Context, RPCPort string) error {
+	s.ctx = ctx
 	rpc.Register(s)
 	rpc.HandleHTTP()
 	l, err := net.Listen("tcp", ":"+RPCPort)
 	if err != nil {
 		return err
 	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
 	log.Println("Started slave")
-	return http.Serve(l, nil)
+	err = http.Serve(l, nil)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
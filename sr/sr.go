@@ -121,10 +121,28 @@ type resulter interface {
 // outfile is the location of the output file. The units of the SR matrix will
 // be μg/m3 PM2.5 concentration at each receptor per μg/s emission at each source.
 func (sr *SR) Run(outfile string, layers []int, begin, end int) error {
+	return sr.RunContext(context.Background(), outfile, layers, begin, end)
+}
+
+// RunContext is the same as Run, except that no more simulations are
+// started after ctx is cancelled, the simulations in progress are stopped,
+// and ctx.Err() is returned. The results of the simulations that
+// had already finished are kept in the output file.
+func (sr *SR) RunContext(ctx context.Context, outfile string, layers []int, begin, end int) error {
+	if err := checkMechanism(); err != nil {
+		return err
+	}
 
 	errChan := make(chan error)
 	reqChan := make(chan resulter, sr.numNodes+1)
-	ctx := context.TODO()
+
+	// stop waits for the results that have already been requested to be
+	// written and then returns ctx.Err().
+	stop := func() error {
+		close(reqChan)
+		<-errChan
+		return ctx.Err()
+	}
 
 	go sr.writeResults(outfile, layers, reqChan, errChan) // Start process to write results to file
 
@@ -143,6 +161,9 @@ func (sr *SR) Run(outfile string, layers []int, begin, end int) error {
 			return fmt.Errorf("sr.writeOutput: %v", err)
 		default:
 		}
+		if ctx.Err() != nil {
+			return stop()
+		}
 
 		cell := sr.d.Cells()[i]
 		_, layerok := layersMap[cell.Layer]
@@ -158,14 +179,21 @@ func (sr *SR) Run(outfile string, layers []int, begin, end int) error {
 			reqChan <- r
 		} else {
 			o := new(IOData)
-			if err := sr.localWorker.Calculate(rp, o); err != nil {
+			if err := sr.localWorker.CalculateContext(ctx, rp, o); err != nil {
+				if ctx.Err() != nil {
+					return stop()
+				}
 				return err
 			}
 			reqChan <- o
 		}
 	}
 	close(reqChan)
-	return <-errChan // Wait for writer to finish.
+	err := <-errChan // Wait for writer to finish.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
 func (sr *SR) newRequestPayload(i int, cell *inmap.Cell) *IOData {
@@ -180,12 +208,63 @@ func (sr *SR) newRequestPayload(i int, cell *inmap.Cell) *IOData {
 		NH3:    1,
 		SOx:    1,
 		PM25:   1,
+		BVOC:   1,
 		Geom:   cell.Centroid(),
 	})
 	return requestPayload
 }
 
-var outputVars = []string{"SOA", "Primary PM2.5", "pNH4", "pSO4", "pNO3"}
+// srPollutant relates an emitted pollutant to the SR matrix variable
+// holding the concentrations of the PM2.5 species it forms.
+type srPollutant struct {
+	emis     string // name of the emitted pollutant in inmap.EmisNames
+	variable string // name of the SR matrix variable
+	label    string // name of the InMAP output variable
+
+	// value returns the emissions of the pollutant in an emissions record.
+	value func(e *inmap.EmisRecord) float64
+}
+
+// srPollutants are the emitted pollutants included in the SR matrix.
+// Because all pollutants are emitted in the same simulation, each output
+// variable must only include the species formed by one of them.
+var srPollutants = []srPollutant{
+	{emis: "NH3", variable: "pNH4", label: "pNH4", value: func(e *inmap.EmisRecord) float64 { return e.NH3 }},
+	{emis: "NOx", variable: "pNO3", label: "pNO3", value: func(e *inmap.EmisRecord) float64 { return e.NOx }},
+	{emis: "SOx", variable: "pSO4", label: "pSO4", value: func(e *inmap.EmisRecord) float64 { return e.SOx }},
+	{emis: "VOC", variable: "SOA", label: "SOA", value: func(e *inmap.EmisRecord) float64 { return e.VOC }},
+	{emis: "PM2_5", variable: "Primary PM2.5", label: "Primary PM2.5", value: func(e *inmap.EmisRecord) float64 { return e.PM25 }},
+	{emis: "BVOC", variable: "BSOA", label: "BSOA", value: func(e *inmap.EmisRecord) float64 { return e.BVOC }},
+}
+
+// checkMechanism returns an error if the emitted pollutants or output
+// variables of the current chemical mechanism do not match srPollutants,
+// in which case emissions would be silently left out of the SR matrix.
+func checkMechanism() error {
+	included := make(map[string]bool)
+	for _, p := range srPollutants {
+		included[p.emis] = true
+		if _, ok := inmap.PolLabels[p.label]; !ok {
+			return fmt.Errorf("sr: output variable %s for %s emissions is not in the chemical mechanism", p.label, p.emis)
+		}
+	}
+	for _, e := range inmap.EmisNames {
+		if !included[e] {
+			return fmt.Errorf("sr: emitted pollutant %s is not supported by the SR matrix", e)
+		}
+	}
+	return nil
+}
+
+// outputVars returns the names of the InMAP output variables held in
+// the SR matrix.
+func outputVars() []string {
+	o := make([]string, len(srPollutants))
+	for i, p := range srPollutants {
+		o[i] = p.label
+	}
+	return o
+}
 
 func (sr *SR) writeResults(outfile string, layers []int, requestChan chan resulter, errChan chan error) {
 	nGridCells, err := sr.layerGridCells(layers)
@@ -221,8 +300,8 @@ func (sr *SR) writeResults(outfile string, layers []int, requestChan chan result
 
 		h.AddVariable("layers", []string{"layers"}, []int32{0})
 
-		for _, vs := range outputVars {
-			h.AddVariable(vs, []string{"layer", "source", "receptor"},
+		for _, p := range srPollutants {
+			h.AddVariable(p.variable, []string{"layer", "source", "receptor"},
 				[]float32{0})
 		}
 		// InMAP data.
@@ -312,6 +391,16 @@ func (sr *SR) writeResults(outfile string, layers []int, requestChan chan result
 		}
 		defer cdf.UpdateNumRecs(ff)
 		defer ff.Close()
+		variables := make(map[string]bool)
+		for _, v := range f.Header.Variables() {
+			variables[v] = true
+		}
+		for _, p := range srPollutants {
+			if !variables[p.variable] {
+				errChan <- fmt.Errorf("existing SR netcdf file has no variable %s for %s emissions", p.variable, p.emis)
+				return
+			}
+		}
 	}
 
 	for req := range requestChan {
@@ -322,15 +411,15 @@ func (sr *SR) writeResults(outfile string, layers []int, requestChan chan result
 		}
 		result := resultI.(*IOData)
 
-		for _, v := range outputVars {
-			data := result.Output[v]
+		for _, p := range srPollutants {
+			data := result.Output[p.label]
 			data32 := make([]float32, len(data))
 			for i, val := range data {
 				data32[i] = float32(val)
 			}
 			begin := []int{result.Layer, result.Row, 0}
 			end := []int{result.Layer, result.Row, len(data32)}
-			w := f.Writer(v, begin, end)
+			w := f.Writer(p.variable, begin, end)
 			if _, err := w.Write(data32); err != nil {
 				errChan <- fmt.Errorf("writing results for for row=%v, layer=%v: %v\n",
 					result.Row, result.Layer, err)
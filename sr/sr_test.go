@@ -28,6 +28,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/spatialmodel/inmap"
+	"golang.org/x/net/context"
 )
 
 type config struct {
@@ -98,3 +99,24 @@ func TestSR(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSRCancel(t *testing.T) {
+	cfg, err := loadConfig("../inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.VariableGridData = strings.TrimSuffix(cfg.VariableGridData, ".gob") + "_SR.gob"
+	var nodes []string // no nodes means it will run locally.
+	sr, err := NewSR(cfg.VariableGridData, cfg.InMAPData, "nocommand",
+		"noLogs", &cfg.VarGrid, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outfile := "tempSRCancel.ncf"
+	defer os.Remove(outfile)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = sr.RunContext(ctx, outfile, []int{0}, 0, 2); err != context.Canceled {
+		t.Errorf("have error %v, want %v", err, context.Canceled)
+	}
+}
@@ -35,7 +35,8 @@ type Reader struct {
 	indices           map[*inmap.Cell]int
 	layers            []int // layers are the vertical layers that are represented in the SR matrix.
 	extraData         map[string][]float64
-	nCellsGroundLevel int // number of cells in the lowest model layer
+	variables         map[string]bool // names of the variables in the file
+	nCellsGroundLevel int             // number of cells in the lowest model layer
 }
 
 // NewReader creates a new SR reader from the netcdf database specified by r.
@@ -83,8 +84,10 @@ func NewReader(r cdf.ReaderWriterAt) (*Reader, error) {
 
 	// Get InMAP data
 	varMap := make(map[string]string)
+	sr.variables = make(map[string]bool)
 	for _, v := range sr.File.Header.Variables() {
 		varMap[v] = ""
+		sr.variables[v] = true
 	}
 	cellVarMap := make(map[string]string)
 	cVal := reflect.ValueOf(cells[0]).Elem()
@@ -173,9 +176,18 @@ func (sr *Reader) Variables(names ...string) (map[string][]float64, error) {
 
 // Concentrations returns the change in Total PM2.5 concentrations caused
 // by the emissions specified by e, after accounting for plume rise.
-//  As specified in the EmisRecord documentation
-// emission units should be in μg/s.
+//
+//	As specified in the EmisRecord documentation
+//
+// emission units should be in μg/s. An error is returned if e
+// includes emissions of a pollutant that is not in the SR matrix, such as
+// biogenic VOC in SR matrices created before it was supported.
 func (sr *Reader) Concentrations(e *inmap.EmisRecord) ([]float64, error) {
+	for _, p := range srPollutants {
+		if p.value(e) != 0 && !sr.variables[p.variable] {
+			return nil, fmt.Errorf("sr: the SR matrix does not include %s emissions", p.emis)
+		}
+	}
 
 	out := make([]float64, sr.nCellsGroundLevel)
 
@@ -187,7 +199,7 @@ func (sr *Reader) Concentrations(e *inmap.EmisRecord) ([]float64, error) {
 		if e.Height != 0 {
 			var in bool
 			var err error
-			in, plumeHeight, err = c.IsPlumeIn(e.Height, e.Diam, e.Temp, e.Velocity)
+			in, plumeHeight, err = sr.d.IsPlumeIn(c, e.Height, e.Diam, e.Temp, e.Velocity)
 			if err != nil {
 				return nil, err
 			}
@@ -213,10 +225,9 @@ func (sr *Reader) Concentrations(e *inmap.EmisRecord) ([]float64, error) {
 			start := []int{layer, index, 0}
 			end := []int{layer, index, sr.nCellsGroundLevel - 1}
 
-			polNames := []string{"pNH4", "pNO3", "pSO4", "SOA", "Primary PM2.5"}
-			for i, emis := range []float64{e.NH3, e.NOx, e.SOx, e.VOC, e.PM25} {
-				if emis != 0 {
-					v, err := sr.get(polNames[i], start, end)
+			for _, p := range srPollutants {
+				if emis := p.value(e); emis != 0 {
+					v, err := sr.get(p.variable, start, end)
 					if err != nil {
 						return nil, err
 					}
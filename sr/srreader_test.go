@@ -26,6 +26,7 @@ import (
 	"testing"
 
 	"github.com/ctessum/geom"
+	"github.com/gonum/floats"
 	"github.com/spatialmodel/inmap"
 )
 
@@ -240,3 +241,32 @@ func TestConcentrations(t *testing.T) {
 		}
 	}
 }
+
+func TestConcentrationsBVOC(t *testing.T) {
+	r, err := os.Open("../inmap/testdata/testSR.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := sr.Concentrations(&inmap.EmisRecord{Geom: geom.Point{X: -3500, Y: -3500}, BVOC: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if floats.Sum(c) <= 0 {
+		t.Errorf("biogenic VOC emissions do not cause any concentrations: %v", c)
+	}
+
+	delete(sr.variables, "BSOA")
+	if _, err = sr.Concentrations(&inmap.EmisRecord{Geom: geom.Point{X: -3500, Y: -3500}, BVOC: 1}); err == nil {
+		t.Error("no error for emissions that are not in the SR matrix")
+	}
+}
+
+func TestCheckMechanism(t *testing.T) {
+	if err := checkMechanism(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+// TagName returns the name of the version of species, emitted pollutant,
+// or output variable name that is tagged with tag, for example
+// "Total PM2.5[tag=power]".
+func TagName(name, tag string) string {
+	return name + "[tag=" + tag + "]"
+}
+
+// Tagged returns a copy of m that can be used for source apportionment.
+// For each tag, it includes a tagged copy (see TagName) of each species that
+// undergoes the same processes as the original species, but that only
+// receives the emissions from the emissions records that have that tag
+// (see EmisRecord). The original species still receive all of the
+// emissions, so the tagged concentrations are the contributions of each
+// group of sources to the total. Tagged copies of the emitted pollutants
+// and concentration output variables are also included, but there are
+// no tagged baseline concentrations or deposition variables.
+//
+// Because the concentrations of the tagged species are calculated
+// independently, the contributions only add up to the total when all of the
+// calculations are linear, as they are in Chemistry.
+// InorganicEquilibrium only affects the original species.
+func (m *Mechanism) Tagged(tags ...string) *Mechanism {
+	o := &Mechanism{
+		Species:        append([]Species{}, m.Species...),
+		Reactions:      append([]Reaction{}, m.Reactions...),
+		Partitioning:   append([]Partitioning{}, m.Partitioning...),
+		Emissions:      append([]EmittedPollutant{}, m.Emissions...),
+		Labels:         append([]Label{}, m.Labels...),
+		BaselineLabels: append([]Label{}, m.BaselineLabels...),
+		Deposition:     append([]DepositionLabel{}, m.Deposition...),
+	}
+	for _, tag := range tags {
+		tag := tag
+		tagAll := func(names []string) []string {
+			t := make([]string, len(names))
+			for i, n := range names {
+				t[i] = TagName(n, tag)
+			}
+			return t
+		}
+		for _, s := range m.Species {
+			s.Name = TagName(s.Name, tag)
+			s.Baseline = ""
+			o.Species = append(o.Species, s)
+		}
+		for _, r := range m.Reactions {
+			r.From, r.To = TagName(r.From, tag), TagName(r.To, tag)
+			o.Reactions = append(o.Reactions, r)
+		}
+		for _, p := range m.Partitioning {
+			p.Gas, p.Particle = TagName(p.Gas, tag), TagName(p.Particle, tag)
+			o.Partitioning = append(o.Partitioning, p)
+		}
+		for _, e := range m.Emissions {
+			value := e.Value
+			e.Name, e.Label = TagName(e.Name, tag), TagName(e.Label, tag)
+			e.Species = TagName(e.Species, tag)
+			if value != nil {
+				e.Value = func(r *EmisRecord) float64 {
+					if r.Tag != tag {
+						return 0
+					}
+					return value(r)
+				}
+			}
+			o.Emissions = append(o.Emissions, e)
+		}
+		for _, l := range m.Labels {
+			l.Name = TagName(l.Name, tag)
+			l.Species = tagAll(l.Species)
+			o.Labels = append(o.Labels, l)
+		}
+	}
+	return o
+}
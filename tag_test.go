@@ -0,0 +1,120 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+)
+
+// TestTagged checks that the contributions of tagged emissions add up
+// to the total concentrations.
+func TestTagged(t *testing.T) {
+	const testTolerance = 1.e-8
+
+	if err := SetMechanism(DefaultMechanism().Tagged("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMechanism(DefaultMechanism())
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		PM25: E,
+		Tag:  "a",
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	emis.Add(&EmisRecord{
+		NH3:    E,
+		NOx:    E,
+		PM25:   E,
+		Height: 20,
+		Tag:    "b",
+		Geom:   geom.Point{X: 1000, Y: 1000},
+	})
+	if tags := emis.Tags(); len(tags) != 2 || tags[0] != "a" || tags[1] != "b" {
+		t.Errorf("tags: have %v, want [a b]", tags)
+	}
+
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing(),
+				DryDeposition(), WetDeposition(), Chemistry()),
+			SteadyStateConvergenceCheck(20, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := []string{"Total PM2.5", "pSO4", "pNH4", "pNO3", "Primary PM2.5"}
+	var names []string
+	for _, v := range vars {
+		names = append(names, v, TagName(v, "a"), TagName(v, "b"))
+	}
+	r, err := d.Results(true, names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vars {
+		var total float64
+		for i, want := range r[v] {
+			have := r[TagName(v, "a")][i] + r[TagName(v, "b")][i]
+			if absDifferent(have, want, testTolerance*want) {
+				t.Errorf("%s cell %d: sum of contributions %g != total %g", v, i, have, want)
+			}
+			total += want
+		}
+		if total == 0 {
+			t.Errorf("%s: concentrations are all zero", v)
+		}
+	}
+	for i := range d.cells {
+		if v := r[TagName("pSO4", "b")][i]; v != 0 {
+			t.Errorf("cell %d: tag b contributes %g to pSO4 but does not emit SOx", i, v)
+		}
+		if v := r[TagName("pNH4", "a")][i]; v != 0 {
+			t.Errorf("cell %d: tag a contributes %g to pNH4 but does not emit NH3", i, v)
+		}
+	}
+}
+
+// TestEmissionsTags checks that tags can be added to an Emissions value
+// that was not created by NewEmissions.
+func TestEmissionsTags(t *testing.T) {
+	e := &Emissions{data: rtree.NewTree(25, 50)}
+	e.Add(&EmisRecord{Geom: geom.Point{X: 1, Y: 1}, PM25: 1, Tag: "b"})
+	e.Add(&EmisRecord{Geom: geom.Point{X: 2, Y: 2}, PM25: 1, Tag: "a"})
+	e.Add(&EmisRecord{Geom: geom.Point{X: 3, Y: 3}, PM25: 1})
+	if have, want := e.Tags(), []string{"a", "b"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("tags: have %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TemporalProfile holds factors for scaling annual average emissions
+// to a specific time. Each set of factors should average to one so that
+// the total annual emissions are preserved.
+type TemporalProfile struct {
+	// Hourly holds factors for each hour of the day, starting at midnight.
+	Hourly [24]float64
+
+	// Weekly holds factors for each day of the week, starting on Sunday.
+	Weekly [7]float64
+
+	// Monthly holds factors for each month of the year, starting in January.
+	Monthly [12]float64
+}
+
+// UniformTemporalProfile returns a temporal profile that does not vary
+// with time.
+func UniformTemporalProfile() *TemporalProfile {
+	p := new(TemporalProfile)
+	for i := range p.Hourly {
+		p.Hourly[i] = 1
+	}
+	for i := range p.Weekly {
+		p.Weekly[i] = 1
+	}
+	for i := range p.Monthly {
+		p.Monthly[i] = 1
+	}
+	return p
+}
+
+// Factor returns the factor that annual average emissions should be
+// multiplied by to get the emissions at time t. Hours and days are
+// determined in the time zone of t.
+func (p *TemporalProfile) Factor(t time.Time) float64 {
+	return p.Hourly[t.Hour()] * p.Weekly[t.Weekday()] * p.Monthly[t.Month()-1]
+}
+
+// TemporalEmissions returns a function that adds emissions to all of the
+// grid cells, scaling them by the factor in p at the beginning of each
+// time step. It replaces Calculations(AddEmissionsFlux()) in transient
+// simulations.
+func TemporalEmissions(p *TemporalProfile) DomainManipulator {
+	var factor float64
+	addEmissions := Calculations(func(c *Cell, Dt float64) {
+		c.addEmissions(Dt * factor)
+	})
+	return func(d *InMAP) error {
+		factor = p.Factor(d.Time)
+		return addEmissions(d)
+	}
+}
+
+// AdvanceTime returns a function that advances the simulation time by
+// one time step. It should be included in RunFuncs after the functions
+// that calculate the changes during the time step.
+func AdvanceTime() DomainManipulator {
+	return func(d *InMAP) error {
+		if d.Dt == 0 {
+			return fmt.Errorf("inmap: timestep is zero")
+		}
+		d.Time = d.Time.Add(time.Duration(d.Dt * float64(time.Second)))
+		return nil
+	}
+}
+
+// RunUntil returns a function that sets the Done flag when the
+// simulation time reaches end.
+func RunUntil(end time.Time) DomainManipulator {
+	return func(d *InMAP) error {
+		if !d.Time.Before(end) {
+			d.Done = true
+		}
+		return nil
+	}
+}
+
+// CTMDataPeriod holds CTM data that applies during a period of time,
+// for example a single month.
+type CTMDataPeriod struct {
+	// Start is the beginning of the period. The period ends at the start
+	// of the next period.
+	Start time.Time
+
+	// Load returns the data for the period. It is not called until the
+	// simulation reaches the start of the period, so that only the data
+	// that is currently needed is kept in memory.
+	Load func() (*CTMData, error)
+}
+
+// UpdateCTMData returns a function that replaces the meteorology and
+// baseline concentrations in the grid cells with those from the period in
+// periods that the current simulation time falls in. periods must be sorted
+// by start time. emis are the emissions used in the simulation,
+// which are reallocated to the grid cells because the cell volumes
+// and plume rise can change with the meteorology. The time step
+// (and time step classes, if SetTimestepClasses is in use)
+// and the boundary conditions set by SetBoundaryConditions
+// are also recalculated after each update.
+// UpdateCTMData only works with static grids.
+func UpdateCTMData(periods []CTMDataPeriod, emis *Emissions) DomainManipulator {
+	current := -1
+	return func(d *InMAP) error {
+		i := -1
+		for j, p := range periods {
+			if !p.Start.After(d.Time) {
+				i = j
+			}
+		}
+		if i == current || i < 0 {
+			return nil
+		}
+		data, err := periods[i].Load()
+		if err != nil {
+			return fmt.Errorf("inmap: loading CTM data for period starting %v: %v",
+				periods[i].Start, err)
+		}
+		if err := d.setCTMData(data, emis); err != nil {
+			return err
+		}
+		current = i
+		return d.resetTimestep()
+	}
+}
+
+// setCTMData replaces the meteorology and baseline concentrations in
+// all of the grid cells with data and recalculates the boundary
+// conditions.
+func (d *InMAP) setCTMData(data *CTMData, emis *Emissions) error {
+	d.plumeColumns = nil
+	for _, c := range d.cells {
+		oldVolume := c.Volume
+		c.resetCTMData()
+		if err := c.loadData(data, c.Layer); err != nil {
+			return err
+		}
+		c.Volume = c.Dx * c.Dy * c.Dz
+		// Conserve the mass in the cell when the volume changes.
+		c.scaleConcentrations(oldVolume / c.Volume)
+		for _, group := range [][]*Cell{c.west, c.east, c.north, c.south, c.above} {
+			for _, b := range group {
+				if b.boundary {
+					oldVolume = b.Volume
+					c.setBoundaryData(b)
+					// Only the outflow is rescaled: the inflow
+					// concentrations are boundary conditions.
+					for i := range b.Cf {
+						b.Cf[i] *= oldVolume / b.Volume
+					}
+				}
+			}
+		}
+	}
+	// The boundary conditions may depend on the new data.
+	if d.boundaryConditions != nil {
+		if err := SetBoundaryConditions(d.boundaryConditions)(d); err != nil {
+			return err
+		}
+	}
+	for _, c := range d.cells {
+		c.updateNeighborInfo()
+		if emis != nil {
+			d.setEmissionsFlux(c, emis)
+		}
+	}
+	return nil
+}
+
+// resetCTMData sets all of the fields in c that are calculated from
+// CTM data to zero.
+func (c *Cell) resetCTMData() {
+	c.UAvg, c.VAvg, c.WAvg = 0, 0, 0
+	c.UDeviation, c.VDeviation = 0, 0
+	c.AOrgPartitioning, c.BOrgPartitioning = 0, 0
+	c.NOPartitioning, c.SPartitioning, c.NHPartitioning = 0, 0, 0
+	c.SO2oxidation, c.NONO2partitioning = 0, 0
+	c.ParticleDryDep, c.SO2DryDep, c.NOxDryDep, c.NH3DryDep, c.VOCDryDep = 0, 0, 0, 0, 0
+	c.Kxxyy, c.Kzz, c.M2u, c.M2d = 0, 0, 0, 0
+	c.LayerHeight, c.Dz = 0, 0
+	c.ParticleWetDep, c.SO2WetDep, c.OtherGasWetDep = 0, 0, 0
+	c.WindSpeed, c.WindSpeedInverse = 0, 0
+	c.WindSpeedMinusThird, c.WindSpeedMinusOnePointFour = 0, 0
+	c.Temperature, c.RelativeHumidity, c.S1, c.SClass = 0, 0, 0, 0
+	for i := range c.CBaseline {
+		c.CBaseline[i] = 0
+	}
+}
+
+// scaleConcentrations multiplies the concentrations and budget
+// terms in c by factor.
+func (c *Cell) scaleConcentrations(factor float64) {
+	for i := range c.Cf {
+		c.Ci[i] *= factor
+		c.Cf[i] *= factor
+	}
+	for _, b := range c.budget {
+		for i := range b {
+			b[i] *= factor
+		}
+	}
+}
+
+// updateNeighborInfo recalculates the center-to-center distances and
+// staggered-grid diffusivities that depend on meteorology after the
+// meteorology has changed. Unlike neighborInfo, it does not change the
+// data stored in the neighboring cells.
+func (c *Cell) updateNeighborInfo() {
+	for i, e := range c.east {
+		c.kxxEast[i] = harmonicMean(c.Kxxyy, e.Kxxyy)
+	}
+	for i, w := range c.west {
+		c.kxxWest[i] = harmonicMean(c.Kxxyy, w.Kxxyy)
+	}
+	for i, n := range c.north {
+		c.kyyNorth[i] = harmonicMean(c.Kxxyy, n.Kxxyy)
+	}
+	for i, s := range c.south {
+		c.kyySouth[i] = harmonicMean(c.Kxxyy, s.Kxxyy)
+	}
+	for i, a := range c.above {
+		c.dzPlusHalf[i] = (c.Dz + a.Dz) / 2.
+		c.kzzAbove[i] = harmonicMean(c.Kzz, a.Kzz)
+	}
+	for i, b := range c.below {
+		c.dzMinusHalf[i] = (c.Dz + b.Dz) / 2.
+		c.kzzBelow[i] = harmonicMean(c.Kzz, b.Kzz)
+	}
+}
+
+// TimeSeriesOutput returns a function that writes simulation results to
+// a series of shapefiles, one for each time that is a multiple of
+// interval after start, which should be the start time of the simulation.
+// The time is added to the name of each file, so for example if fileName
+// is "output.shp", the results at 1 AM on January 1, 2005 would be written
+// to "output_20050101T0100.shp". The other arguments are the same as
+// for Output. TimeSeriesOutput should be included in RunFuncs after
+// AdvanceTime. Results are written at the end of the first time step
+// that reaches each output time.
+func TimeSeriesOutput(fileName string, start time.Time, interval time.Duration,
+	allLayers bool, outputVariables ...string) DomainManipulator {
+	next := start.Add(interval)
+	return func(d *InMAP) error {
+		if d.Time.Before(next) {
+			return nil
+		}
+		for !next.After(d.Time) {
+			next = next.Add(interval)
+		}
+		ext := filepath.Ext(fileName)
+		f := strings.TrimSuffix(fileName, ext) + "_" + d.Time.Format("20060102T1504") + ext
+		return Output(f, allLayers, outputVariables...)(d)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctessum/geom"
+)
+
+func TestTemporalProfile(t *testing.T) {
+	p := UniformTemporalProfile()
+	p.Hourly[13] = 2
+	p.Weekly[time.Saturday] = 0.5
+	p.Monthly[time.July-1] = 3
+
+	tests := []struct {
+		t    time.Time
+		want float64
+	}{
+		{t: time.Date(2005, time.January, 3, 12, 0, 0, 0, time.UTC), want: 1},   // Monday
+		{t: time.Date(2005, time.January, 3, 13, 30, 0, 0, time.UTC), want: 2},  // Monday
+		{t: time.Date(2005, time.January, 1, 13, 0, 0, 0, time.UTC), want: 1},   // Saturday
+		{t: time.Date(2005, time.July, 4, 0, 0, 0, 0, time.UTC), want: 3},       // Monday
+		{t: time.Date(2005, time.July, 2, 13, 59, 0, 0, time.UTC), want: 3},     // Saturday
+		{t: time.Date(2005, time.February, 5, 1, 0, 0, 0, time.UTC), want: 0.5}, // Saturday
+	}
+	for _, test := range tests {
+		if have := p.Factor(test.t); have != test.want {
+			t.Errorf("%v: have %g, want %g", test.t, have, test.want)
+		}
+	}
+}
+
+func TestTransient(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(3 * time.Hour)
+
+	// Emissions only occur at night.
+	profile := UniformTemporalProfile()
+	for h := 6; h < 18; h++ {
+		profile.Hourly[h] = 0
+	}
+
+	// Use the same CTM data for two periods to make sure that
+	// updating the CTM data doesn't change anything it shouldn't.
+	ctmLoads := 0
+	load := func() (*CTMData, error) {
+		ctmLoads++
+		return ctmdata, nil
+	}
+	periods := []CTMDataPeriod{
+		{Start: start, Load: load},
+		{Start: start.Add(time.Hour), Load: load},
+	}
+
+	outFile := filepath.Join(os.TempDir(), "inmapTransientTest.shp")
+
+	var uAvg []float64
+	d := &InMAP{
+		Time: start,
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+			func(d *InMAP) error {
+				for _, c := range d.cells {
+					uAvg = append(uAvg, c.UAvg)
+				}
+				return nil
+			},
+		},
+		RunFuncs: []DomainManipulator{
+			UpdateCTMData(periods, emis),
+			TemporalEmissions(profile),
+			Calculations(
+				UpwindAdvection(),
+				Mixing(),
+				MeanderMixing(),
+				DryDeposition(),
+				WetDeposition(),
+				Chemistry(),
+			),
+			AdvanceTime(),
+			TimeSeriesOutput(outFile, start, time.Hour, false, "Primary PM2.5"),
+			RunUntil(end),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Time.Before(end) {
+		t.Errorf("simulation ended at %v, before %v", d.Time, end)
+	}
+	if ctmLoads != len(periods) {
+		t.Errorf("CTM data should have been loaded %d times but was loaded %d times",
+			len(periods), ctmLoads)
+	}
+	for i, c := range d.cells {
+		if absDifferent(c.UAvg, uAvg[i], testTolerance) {
+			t.Errorf("cell %d UAvg changed from %g to %g after updating CTM data",
+				i, uAvg[i], c.UAvg)
+		}
+	}
+
+	b := d.MassBudget()
+	wantEmitted := E * d.Time.Sub(start).Seconds()
+	if different(b.Emitted[iPM2_5], wantEmitted, 1.e-6) {
+		t.Errorf("emitted PM2.5: have %g, want %g", b.Emitted[iPM2_5], wantEmitted)
+	}
+
+	files, err := filepath.Glob(strings.TrimSuffix(outFile, ".shp") + "_*.shp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("there should be 3 output files but there are %d: %v", len(files), files)
+	}
+	for _, f := range files {
+		DeleteShapefile(f)
+	}
+}
+
+// The inflow boundary conditions should be recalculated from the new data
+// rather than rescaled when the CTM data changes.
+func TestTransientBoundaryConditions(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+
+	// The second period has deeper layers and higher baseline
+	// concentrations.
+	ctmdata2 := &CTMData{
+		gridTree: ctmdata.gridTree,
+		data:     make(map[string]ctmVariable),
+	}
+	for name, v := range ctmdata.data {
+		ctmdata2.data[name] = v
+	}
+	scale := func(name string) {
+		v := ctmdata2.data[name]
+		v.data = v.data.Copy()
+		v.data.Scale(2)
+		ctmdata2.data[name] = v
+	}
+	scale("Dz")
+	for _, s := range species {
+		if s.Baseline != "" {
+			scale(s.Baseline)
+		}
+	}
+
+	start := time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC)
+	periods := []CTMDataPeriod{
+		{Start: start, Load: func() (*CTMData, error) { return ctmdata, nil }},
+		{Start: start.Add(time.Hour), Load: func() (*CTMData, error) { return ctmdata2, nil }},
+	}
+	bc := BaselineBoundaryConditions()
+	d := &InMAP{
+		Time: start,
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+			SetBoundaryConditions(bc),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	update := UpdateCTMData(periods, emis)
+	check := func(period int) {
+		n := 0
+		for _, c := range d.cells {
+			for i, nbs := range [][]*Cell{c.west, c.east, c.north, c.south, c.above} {
+				if len(nbs) != 1 || !nbs[0].boundary {
+					continue
+				}
+				b := nbs[0]
+				want := bc(boundaryFaces[i], b, c)
+				for j, v := range b.Ci {
+					if absDifferent(v, want[j], testTolerance*want[j]) {
+						t.Errorf("period %d: %s boundary %s = %g but should be %g",
+							period, boundaryFaces[i], PolNames[j], v, want[j])
+					}
+					if v > 0 {
+						n++
+					}
+				}
+			}
+		}
+		if n == 0 {
+			t.Errorf("period %d: boundary concentrations are all zero", period)
+		}
+	}
+	for i, p := range periods {
+		d.Time = p.Start
+		if err := update(d); err != nil {
+			t.Fatal(err)
+		}
+		check(i)
+	}
+}
@@ -0,0 +1,327 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Uncertainty specifies a Monte Carlo analysis of the uncertainty in the
+// health impact output variables (see HealthImpact).
+type Uncertainty struct {
+	// Samples is the number of Monte Carlo samples. If it is zero,
+	// the uncertainty is not calculated.
+	Samples int
+
+	// Seed is the seed for the random number generator.
+	Seed int64
+
+	// Percentiles are the percentiles (between 0 and 100) of the
+	// distributions that are reported, for example [2.5, 50, 97.5].
+	Percentiles []float64
+
+	// DepositionGSD and PartitioningGSD are the geometric standard
+	// deviations of lognormally distributed factors that the dry and wet
+	// deposition rates of all species and the particle fractions of the
+	// gas-particle partitioning are multiplied by, respectively.
+	// If both are 0 or 1, the concentrations from the simulation
+	// are reused for all of the samples and only the concentration–response
+	// functions are sampled. Otherwise, the simulation is rerun for
+	// each sample.
+	DepositionGSD, PartitioningGSD float64
+}
+
+// UncertaintyResults holds the percentiles of the distributions of
+// the health impact output variables.
+type UncertaintyResults struct {
+	// Percentiles are the percentiles that are included.
+	Percentiles []float64
+
+	// Cells holds the percentiles of the deaths in each ground-level grid
+	// cell, in the same order as the ground-level output of Results,
+	// in the form map[health impact][percentile][cell].
+	Cells map[string][][]float64
+
+	// Totals holds the percentiles of the total deaths in the ground-level
+	// grid cells, in the form map[health impact][percentile].
+	Totals map[string][]float64
+}
+
+// Scaled returns a copy of m where the dry and wet deposition rates of all
+// species are multiplied by deposition and the particle fractions of the
+// gas-particle partitioning are multiplied by partitioning, without
+// exceeding one.
+func (m *Mechanism) Scaled(deposition, partitioning float64) *Mechanism {
+	o := *m
+	o.Species = make([]Species, len(m.Species))
+	for i, s := range m.Species {
+		if dry := s.DryDep; dry != nil {
+			s.DryDep = func(c *Cell) float64 { return dry(c) * deposition }
+		}
+		if wet := s.WetDep; wet != nil {
+			s.WetDep = func(c *Cell) float64 { return wet(c) * deposition }
+		}
+		o.Species[i] = s
+	}
+	o.Partitioning = make([]Partitioning, len(m.Partitioning))
+	for i, p := range m.Partitioning {
+		if f := p.Fraction; f != nil {
+			p.Fraction = func(c *Cell) float64 { return math.Min(1, f(c)*partitioning) }
+		}
+		o.Partitioning[i] = p
+	}
+	return &o
+}
+
+// Uncertainty runs a Monte Carlo analysis of the health impact output
+// variables, where m is the mechanism that the simulation was run with.
+// If the simulation needs to be rerun for each sample (see Uncertainty),
+// d.RunFuncs are used, starting from zero concentrations, and the
+// concentrations and mechanism are restored afterwards. It should be run
+// after the simulation has finished.
+func (d *InMAP) Uncertainty(u *Uncertainty, m *Mechanism) (*UncertaintyResults, error) {
+	if u.Samples <= 0 {
+		return nil, fmt.Errorf("inmap: the number of uncertainty samples must be greater than zero")
+	}
+	for _, p := range u.Percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("inmap: uncertainty percentile %g is not between 0 and 100", p)
+		}
+	}
+	if len(d.healthImpacts) == 0 {
+		return nil, fmt.Errorf("inmap: there are no health impacts to calculate the uncertainty of")
+	}
+	rerun := u.DepositionGSD > 1 || u.PartitioningGSD > 1
+	r := rand.New(rand.NewSource(u.Seed))
+
+	var ground []*Cell
+	for _, c := range d.cells {
+		if c.Layer == 0 {
+			ground = append(ground, c)
+		}
+	}
+	var names []string
+	for n := range d.healthImpacts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var saved [][]float64
+	if rerun {
+		saved = d.saveConcentrations()
+		defer func() {
+			d.restoreConcentrations(saved)
+			SetMechanism(m)
+		}()
+	}
+
+	// samples holds the deaths in each sample in the form
+	// [health impact][cell][sample].
+	samples := make(map[string][][]float64)
+	totals := make(map[string][]float64)
+	for _, n := range names {
+		samples[n] = make([][]float64, len(ground))
+		for i := range ground {
+			samples[n][i] = make([]float64, u.Samples)
+		}
+		totals[n] = make([]float64, u.Samples)
+	}
+	for s := 0; s < u.Samples; s++ {
+		if rerun {
+			dep, part := lognormal(r, u.DepositionGSD), lognormal(r, u.PartitioningGSD)
+			if err := SetMechanism(m.Scaled(dep, part)); err != nil {
+				return nil, err
+			}
+			if err := d.rerun(); err != nil {
+				return nil, err
+			}
+		}
+		for _, n := range names {
+			h := d.healthImpacts[n]
+			if h.CR.Sample != nil {
+				h.CR = h.CR.Sample(r)
+			}
+			i := d.popIndices[h.Population]
+			for j, c := range ground {
+				v := h.deaths(c, i)
+				samples[n][j][s] = v
+				totals[n][s] += v
+			}
+		}
+	}
+
+	o := &UncertaintyResults{
+		Percentiles: u.Percentiles,
+		Cells:       make(map[string][][]float64),
+		Totals:      make(map[string][]float64),
+	}
+	for _, n := range names {
+		o.Cells[n] = make([][]float64, len(u.Percentiles))
+		for k := range u.Percentiles {
+			o.Cells[n][k] = make([]float64, len(ground))
+		}
+		for j, cs := range samples[n] {
+			for k, v := range percentiles(cs, u.Percentiles) {
+				o.Cells[n][k][j] = v
+			}
+		}
+		o.Totals[n] = percentiles(totals[n], u.Percentiles)
+	}
+	return o, nil
+}
+
+// lognormal returns a sample from a lognormal distribution with
+// a geometric mean of one and geometric standard deviation gsd,
+// or one if gsd is not greater than one.
+func lognormal(r *rand.Rand, gsd float64) float64 {
+	if gsd <= 1 {
+		return 1
+	}
+	return math.Exp(math.Log(gsd) * r.NormFloat64())
+}
+
+// percentiles returns the percentiles p (between 0 and 100) of x,
+// interpolating linearly between the sorted values. x is sorted in place.
+func percentiles(x []float64, p []float64) []float64 {
+	sort.Float64s(x)
+	o := make([]float64, len(p))
+	for i, pp := range p {
+		pos := pp / 100 * float64(len(x)-1)
+		lo := int(math.Floor(pos))
+		if lo >= len(x)-1 {
+			o[i] = x[len(x)-1]
+			continue
+		}
+		frac := pos - float64(lo)
+		o[i] = x[lo]*(1-frac) + x[lo+1]*frac
+	}
+	return o
+}
+
+// saveConcentrations returns a copy of the final concentrations in all
+// of the grid cells and boundary cells.
+func (d *InMAP) saveConcentrations() [][]float64 {
+	var o [][]float64
+	for _, g := range append([][]*Cell{d.cells}, d.boundaries()...) {
+		for _, c := range g {
+			o = append(o, append([]float64{}, c.Cf...))
+		}
+	}
+	return o
+}
+
+// restoreConcentrations restores concentrations saved by
+// saveConcentrations. The concentrations in the boundary cells
+// are the boundary conditions, which are not changed.
+func (d *InMAP) restoreConcentrations(saved [][]float64) {
+	i := 0
+	for j, g := range append([][]*Cell{d.cells}, d.boundaries()...) {
+		for _, c := range g {
+			copy(c.Cf, saved[i])
+			if j == 0 {
+				copy(c.Ci, saved[i])
+			}
+			i++
+		}
+	}
+	d.Done = true
+}
+
+// rerun runs the simulation again from zero concentrations, keeping the
+// emissions and boundary conditions.
+func (d *InMAP) rerun() error {
+	for j, g := range append([][]*Cell{d.cells}, d.boundaries()...) {
+		for _, c := range g {
+			for i := range c.Cf {
+				c.Cf[i] = 0
+				if j == 0 {
+					c.Ci[i] = 0
+				}
+			}
+			c.makeBudget()
+		}
+	}
+	d.retiredBudget = nil
+	d.extrapolation = nil
+	d.convergence = nil
+	d.Done = false
+	return d.Run()
+}
+
+// uncertaintySuffix is appended to the base name of an output file
+// to create the name of the file that holds the uncertainty results.
+const uncertaintySuffix = "_uncertainty.csv"
+
+// WriteCSV writes the percentiles of the deaths in each ground-level grid
+// cell to a CSV file next to the output file fileName, with the suffix
+// "_uncertainty.csv". The rows are in the same order as the ground-level
+// output shapefile, and the columns are named for the health impact and
+// percentile, for example "TotalPop deaths[GEMM] p97.5".
+func (r *UncertaintyResults) WriteCSV(fileName string) error {
+	f, err := os.Create(strings.TrimSuffix(fileName, filepath.Ext(fileName)) + uncertaintySuffix)
+	if err != nil {
+		return fmt.Errorf("inmap: creating uncertainty file: %v", err)
+	}
+	var names []string
+	for n := range r.Cells {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	w := csv.NewWriter(f)
+	header := []string{"Cell"}
+	var columns [][]float64
+	for _, n := range names {
+		for k, p := range r.Percentiles {
+			header = append(header, n+" p"+strconv.FormatFloat(p, 'g', -1, 64))
+			columns = append(columns, r.Cells[n][k])
+		}
+	}
+	if err = w.Write(header); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing uncertainty: %v", err)
+	}
+	var nCells int
+	if len(columns) > 0 {
+		nCells = len(columns[0])
+	}
+	for j := 0; j < nCells; j++ {
+		line := []string{strconv.Itoa(j)}
+		for _, col := range columns {
+			line = append(line, strconv.FormatFloat(col[j], 'g', -1, 64))
+		}
+		if err = w.Write(line); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing uncertainty: %v", err)
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing uncertainty: %v", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestPercentiles(t *testing.T) {
+	p := percentiles([]float64{4, 1, 3, 2, 5}, []float64{0, 12.5, 50, 100})
+	want := []float64{1, 1.5, 3, 5}
+	for i, v := range p {
+		if v != want[i] {
+			t.Errorf("percentile %d: have %g, want %g", i, v, want[i])
+		}
+	}
+}
+
+func TestUncertainty(t *testing.T) {
+	const testTolerance = 1.e-8
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	fixed := HealthImpact{Population: "TotalPop", CR: LogLinear("fixed", 0.006)}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+			SetHealthImpacts(HealthImpact{Population: "TotalPop", CR: GEMM()}, fixed),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing(),
+				DryDeposition(), WetDeposition(), Chemistry()),
+			SteadyStateConvergenceCheck(20, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	totals := d.HealthTotals()
+
+	// Only the concentration–response functions are sampled.
+	u := &Uncertainty{Samples: 500, Seed: 1, Percentiles: []float64{2.5, 50, 97.5}}
+	r, err := d.Uncertainty(u, DefaultMechanism())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gemm := r.Totals["TotalPop deaths[GEMM]"]
+	if !(gemm[0] < gemm[1] && gemm[1] < gemm[2]) {
+		t.Errorf("GEMM percentiles are not increasing: %v", gemm)
+	}
+	if want := totals["TotalPop deaths[GEMM]"]; absDifferent(gemm[1], want, 0.05*want) {
+		t.Errorf("GEMM median %g is not close to the central estimate %g", gemm[1], want)
+	}
+	want := totals[fixed.Name()]
+	for i, v := range r.Totals[fixed.Name()] {
+		if absDifferent(v, want, testTolerance*want) {
+			t.Errorf("function without uncertainty percentile %g: have %g, want %g", u.Percentiles[i], v, want)
+		}
+	}
+	if len(r.Cells[fixed.Name()][1]) != len(d.toArray("TotalPop", 0)) {
+		t.Errorf("wrong number of cells in uncertainty results")
+	}
+
+	// The simulation is rerun with different deposition rates.
+	before := d.toArray("Total PM2.5", -1)
+	u = &Uncertainty{Samples: 3, Seed: 1, Percentiles: []float64{0, 100}, DepositionGSD: 2}
+	if r, err = d.Uncertainty(u, DefaultMechanism()); err != nil {
+		t.Fatal(err)
+	}
+	if f := r.Totals[fixed.Name()]; !(f[0] < f[1]) {
+		t.Errorf("deposition uncertainty does not change deaths: %v", f)
+	}
+	for i, v := range d.toArray("Total PM2.5", -1) {
+		if v != before[i] {
+			t.Errorf("cell %d: concentration was not restored: have %g, want %g", i, v, before[i])
+			break
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Valuation specifies how the deaths output variables are monetized.
+// For each deaths variable, there is a damages variable with "deaths"
+// replaced by "damages" in the name, for example "TotalPop damages" or
+// "TotalPop damages[GEMM]".
+type Valuation struct {
+	// VSL is the value of a statistical life in CurrencyYear currency.
+	// If it is zero, damages are not calculated.
+	VSL float64
+
+	// CurrencyYear is the year of the currency and of the income that
+	// VSL is based on.
+	CurrencyYear int
+
+	// Year is the year when the deaths occur. It must not be earlier
+	// than CurrencyYear. If it is zero, it is the same as CurrencyYear.
+	Year int
+
+	// IncomeGrowth is the annual rate of growth in real income
+	// between CurrencyYear and Year, for example 0.02 for 2%.
+	IncomeGrowth float64
+
+	// IncomeElasticity is the elasticity of VSL with respect to income.
+	IncomeElasticity float64
+
+	// DiscountRate is the annual rate used to discount deaths that occur
+	// after the exposure, for example 0.03 for 3%.
+	DiscountRate float64
+
+	// CessationLag is the fraction of the deaths that occur in each year
+	// after the exposure, starting with the year of the exposure, which is
+	// not discounted. It must sum to one. If it is empty, all of the deaths
+	// occur in the year of the exposure.
+	CessationLag []float64
+}
+
+// valuePerDeath returns the value of each death caused by exposure in Year,
+// adjusted for income growth since CurrencyYear and discounted over
+// the cessation lag.
+func (v *Valuation) valuePerDeath() float64 {
+	years := float64(v.Year - v.CurrencyYear)
+	vsl := v.VSL * math.Pow(1+v.IncomeGrowth, v.IncomeElasticity*years)
+	if len(v.CessationLag) == 0 {
+		return vsl
+	}
+	var discount float64
+	for i, f := range v.CessationLag {
+		discount += f / math.Pow(1+v.DiscountRate, float64(i))
+	}
+	return vsl * discount
+}
+
+// units returns the units of the damages variables.
+func (v *Valuation) units() string {
+	return fmt.Sprintf("%d $/grid cell", v.CurrencyYear)
+}
+
+// SetValuation returns a function that adds damages output variables
+// for each of the deaths output variables. If v is nil or v.VSL is zero,
+// it does nothing. It should be run after SetHealthImpacts.
+func SetValuation(v *Valuation) DomainManipulator {
+	return func(d *InMAP) error {
+		if v == nil || v.VSL == 0 {
+			return nil
+		}
+		if v.VSL < 0 {
+			return fmt.Errorf("inmap: the value of a statistical life must not be negative")
+		}
+		if v.Year == 0 {
+			vv := *v
+			vv.Year = vv.CurrencyYear
+			v = &vv
+		}
+		if v.Year < v.CurrencyYear {
+			return fmt.Errorf("inmap: the valuation year %d is earlier than the currency year %d",
+				v.Year, v.CurrencyYear)
+		}
+		if len(v.CessationLag) != 0 {
+			var sum float64
+			for _, f := range v.CessationLag {
+				if f < 0 {
+					return fmt.Errorf("inmap: cessation lag fractions must not be negative")
+				}
+				sum += f
+			}
+			if math.Abs(sum-1) > 1.e-6 {
+				return fmt.Errorf("inmap: cessation lag fractions sum to %g instead of 1", sum)
+			}
+		}
+		d.valuation = v
+		return nil
+	}
+}
+
+// damagesDeaths returns the name of the deaths variable that damages
+// variable varName is calculated from, and whether varName is a damages
+// variable.
+func (d *InMAP) damagesDeaths(varName string) (string, bool) {
+	if d.valuation == nil || !strings.Contains(varName, " damages") {
+		return "", false
+	}
+	deaths := strings.Replace(varName, " damages", " deaths", 1)
+	if _, ok := d.healthImpacts[deaths]; ok {
+		return deaths, true
+	}
+	if _, ok := d.popIndices[strings.TrimSuffix(deaths, " deaths")]; ok {
+		return deaths, true
+	}
+	return "", false
+}
+
+// deathsNames returns the names of all of the deaths output variables.
+func (d *InMAP) deathsNames() []string {
+	var o []string
+	for pop := range d.popIndices {
+		o = append(o, pop+" deaths")
+	}
+	for n := range d.healthImpacts {
+		o = append(o, n)
+	}
+	sort.Strings(o)
+	return o
+}
+
+// damagesNames returns the names of all of the damages output variables,
+// or nil if the damages are not calculated.
+func (d *InMAP) damagesNames() []string {
+	if d.valuation == nil {
+		return nil
+	}
+	deaths := d.deathsNames()
+	o := make([]string, len(deaths))
+	for i, n := range deaths {
+		o[i] = strings.Replace(n, " deaths", " damages", 1)
+	}
+	return o
+}
+
+// HealthTotals returns the total of each deaths output variable
+// [deaths/year] and, if a Valuation has been set, each damages output
+// variable over the ground-level grid cells. It will only give the correct
+// results if run after InMAP finishes calculating.
+func (d *InMAP) HealthTotals() map[string]float64 {
+	names := append(d.deathsNames(), d.damagesNames()...)
+	o := make(map[string]float64)
+	for _, n := range names {
+		for _, c := range d.cells {
+			if c.Layer == 0 {
+				o[n] += d.value(c, n)
+			}
+		}
+	}
+	return o
+}
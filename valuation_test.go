@@ -0,0 +1,101 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValuation(t *testing.T) {
+	const testTolerance = 1.e-10
+
+	v := &Valuation{VSL: 1.e7, CurrencyYear: 2010, Year: 2020, IncomeGrowth: 0.02,
+		IncomeElasticity: 0.5, DiscountRate: 0.03, CessationLag: []float64{0.5, 0.5}}
+	perDeath := 1.e7 * math.Pow(1.02, 5) * (0.5 + 0.5/1.03)
+	if have := v.valuePerDeath(); absDifferent(have, perDeath, testTolerance*perDeath) {
+		t.Errorf("value per death: have %g, want %g", have, perDeath)
+	}
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetHealthImpacts(HealthImpact{Population: "TotalPop", CR: GEMM()}),
+			SetValuation(v),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.cells {
+		c.Cf[iPM2_5] = 1
+	}
+	names := []string{"TotalPop deaths", "TotalPop damages",
+		"TotalPop deaths[GEMM]", "TotalPop damages[GEMM]"}
+	r, err := d.Results(false, names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totals := d.HealthTotals()
+	for i := 0; i < len(names); i += 2 {
+		deaths, damages := names[i], names[i+1]
+		var total float64
+		for j, dd := range r[deaths] {
+			want := dd * perDeath
+			if have := r[damages][j]; absDifferent(have, want, testTolerance*want) {
+				t.Errorf("%s cell %d: have %g, want %g", damages, j, have, want)
+			}
+			total += r[damages][j]
+		}
+		if total == 0 {
+			t.Errorf("%s: damages are all zero", damages)
+		}
+		if absDifferent(totals[damages], total, testTolerance*total) {
+			t.Errorf("%s total: have %g, want %g", damages, totals[damages], total)
+		}
+	}
+	if u := d.getUnits("TotalPop damages"); u != "2010 $/grid cell" {
+		t.Errorf("units: have %s, want 2010 $/grid cell", u)
+	}
+
+	err = SetValuation(&Valuation{VSL: 1.e7, CessationLag: []float64{0.5, 0.4}})(d)
+	if err == nil {
+		t.Error("no error for a cessation lag that does not sum to one")
+	}
+
+	// If Year is not set, there is no income growth.
+	unset := &Valuation{VSL: 1.e7, CurrencyYear: 2010, IncomeGrowth: 0.02,
+		IncomeElasticity: 0.5}
+	if err = SetValuation(unset)(d); err != nil {
+		t.Fatal(err)
+	}
+	if have := d.valuation.valuePerDeath(); absDifferent(have, 1.e7, testTolerance*1.e7) {
+		t.Errorf("value per death with unset year: have %g, want %g", have, 1.e7)
+	}
+	if unset.Year != 0 {
+		t.Errorf("SetValuation changed the year to %d", unset.Year)
+	}
+
+	err = SetValuation(&Valuation{VSL: 1.e7, CurrencyYear: 2010, Year: 2000})(d)
+	if err == nil {
+		t.Error("no error for a year that is earlier than the currency year")
+	}
+}
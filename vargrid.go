@@ -384,7 +384,7 @@ func (config *VarGridConfig) RegularGrid(data *CTMData, pop *Population, popInde
 		// Add emissions to new cells.
 		if emis != nil {
 			for _, c := range d.cells {
-				c.setEmissionsFlux(emis) // This needs to be called after setNeighbors.
+				d.setEmissionsFlux(c, emis) // This needs to be called after setNeighbors.
 			}
 		}
 		return nil
@@ -469,7 +469,7 @@ func (d *InMAP) deleteAndAddCells(config *VarGridConfig, newCellIndices [][][2]i
 	// Add emissions to new cells.
 	if emis != nil {
 		for i := oldNumCells - 1; i < len(d.cells); i++ {
-			d.cells[i].setEmissionsFlux(emis) // This needs to be called after setNeighbors.
+			d.setEmissionsFlux(d.cells[i], emis) // This needs to be called after setNeighbors.
 		}
 	}
 	return nil
@@ -482,6 +482,9 @@ func (d *InMAP) AddCells(cells ...*Cell) {
 	if d.index == nil {
 		d.index = rtree.NewTree(25, 50)
 	}
+	d.verticalSystem = nil
+	d.extrapolation = nil
+	d.plumeColumns = nil
 	for _, c := range cells {
 		if c.Layer > d.nlayers-1 { // Make sure we still have the right number of layers
 			d.nlayers = c.Layer + 1
@@ -498,6 +501,9 @@ func (d *InMAP) AddCells(cells ...*Cell) {
 // DeleteCells deletes the cell with index i from the grid and removes any
 // references to it from other cells.
 func (d *InMAP) DeleteCells(indicesToDelete ...int) {
+	d.verticalSystem = nil
+	d.extrapolation = nil
+	d.plumeColumns = nil
 	indexToSubtract := 0
 	for _, ii := range indicesToDelete {
 		i := ii - indexToSubtract
@@ -506,6 +512,7 @@ func (d *InMAP) DeleteCells(indicesToDelete ...int) {
 		d.cells[len(d.cells)-1] = nil
 		d.cells = d.cells[:len(d.cells)-1]
 		d.index.Delete(c)
+		d.retireCell(c)
 		c.dereferenceNeighbors(d)
 		indexToSubtract++
 	}
@@ -773,6 +780,12 @@ func (c *Cell) loadData(data *CTMData, k int) error {
 	if len(ctmcells) == 0. {
 		return fmt.Errorf("there is no CTM data overlapping with the InMAP cell at %+v", c.Centroid())
 	}
+	for _, s := range species {
+		if _, ok := data.data[s.Baseline]; s.Baseline != "" && !ok {
+			return fmt.Errorf("inmap: CTM data is missing baseline variable %s for species %s",
+				s.Baseline, s.Name)
+		}
+	}
 	for i, ctmcell := range ctmcells {
 		ctmrow := ctmcell.Row
 		ctmcol := ctmcell.Col
@@ -801,6 +814,8 @@ func (c *Cell) loadData(data *CTMData, k int) error {
 			k, ctmrow, ctmcol) * frac
 		c.SO2oxidation += data.data["SO2oxidation"].data.Get(
 			k, ctmrow, ctmcol) * frac
+		c.NONO2partitioning += data.data["NO_NO2partitioning"].data.Get(
+			k, ctmrow, ctmcol) * frac
 		c.ParticleDryDep += data.data["ParticleDryDep"].data.Get(
 			k, ctmrow, ctmcol) * frac
 		c.SO2DryDep += data.data["SO2DryDep"].data.Get(
@@ -840,28 +855,20 @@ func (c *Cell) loadData(data *CTMData, k int) error {
 				k, ctmrow, ctmcol) * frac
 		c.Temperature += data.data["Temperature"].data.Get(
 			k, ctmrow, ctmcol) * frac
+		// Relative humidity is not in older CTM data files.
+		if rh, ok := data.data["RelativeHumidity"]; ok {
+			c.RelativeHumidity += rh.data.Get(k, ctmrow, ctmcol) * frac
+		}
 		c.S1 += data.data["S1"].data.Get(
 			k, ctmrow, ctmcol) * frac
 		c.SClass += data.data["Sclass"].data.Get(
 			k, ctmrow, ctmcol) * frac
-		c.CBaseline[iPM2_5] += data.data["TotalPM25"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[igNH] += data.data["gNH"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[ipNH] += data.data["pNH"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[igNO] += data.data["gNO"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[ipNO] += data.data["pNO"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[igS] += data.data["gS"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[ipS] += data.data["pS"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[igOrg] += data.data["aVOC"].data.Get(
-			k, ctmrow, ctmcol) * frac
-		c.CBaseline[ipOrg] += data.data["aSOA"].data.Get(
-			k, ctmrow, ctmcol) * frac
+		for ii, s := range species {
+			if s.Baseline != "" {
+				c.CBaseline[ii] += data.data[s.Baseline].data.Get(
+					k, ctmrow, ctmcol) * frac
+			}
+		}
 	}
 	return nil
 }
@@ -0,0 +1,262 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MixingNoVerticalDiffusion returns a function that calculates the same
+// processes as Mixing except for vertical diffusion between neighboring cells,
+// which should instead be calculated by ImplicitVerticalDiffusion.
+// Non-local convective mixing is still included.
+func MixingNoVerticalDiffusion() CellManipulator {
+	return mixing(false)
+}
+
+// SetTimestepCFLNoVerticalDiffusion returns a function that sets the time
+// step in the same way as SetTimestepCFL, but without considering the
+// stability of vertical diffusion. It should be used when vertical diffusion
+// is calculated using ImplicitVerticalDiffusion.
+func SetTimestepCFLNoVerticalDiffusion() DomainManipulator {
+	return setTimestepClasses(1, false)
+}
+
+// SetTimestepClassesNoVerticalDiffusion returns a function that groups the
+// grid cells into time step classes in the same way as SetTimestepClasses,
+// but without considering the stability of vertical diffusion.
+func SetTimestepClassesNoVerticalDiffusion(n int) DomainManipulator {
+	return setTimestepClasses(n, false)
+}
+
+// ImplicitVerticalDiffusion returns a function that calculates vertical
+// diffusion between neighboring grid cells (the kzzAbove and kzzBelow terms
+// in Mixing) for all of the grid cells, using the θ method: θ=1 gives the
+// backward Euler (fully implicit) method and θ=0.5 gives the Crank–Nicolson
+// method. θ must be between 0.5 and 1, where the method is stable for any
+// time step. It is run after the other calculations for each time step and
+// changes the final concentrations (Cf), so it should be used with
+// MixingNoVerticalDiffusion and either SetTimestepCFLNoVerticalDiffusion or
+// SetTimestepClassesNoVerticalDiffusion.
+//
+// The cells that are connected vertically form a column, or, where
+// a cell is above several smaller cells, a tree of cells. The resulting
+// system of equations is solved exactly by eliminating the cells
+// in each tree from the top of the branches down, which is the
+// same as the Thomas algorithm for a single column.
+// Diffusion through the top of the domain is calculated from the
+// concentrations in the top boundary cells (see SetBoundaryConditions),
+// and the net mass that leaves the domain is kept track of in the top
+// boundary cells.
+func ImplicitVerticalDiffusion(θ float64) DomainManipulator {
+	return func(d *InMAP) error {
+		if θ < 0.5 || θ > 1 {
+			return fmt.Errorf("inmap: implicit vertical diffusion θ must be between 0.5 and 1 but is %g", θ)
+		}
+		if d.verticalSystem == nil {
+			s, err := newVerticalSystem(d.cells)
+			if err != nil {
+				return err
+			}
+			d.verticalSystem = s
+		}
+		d.verticalSystem.solve(θ, d.Dt)
+		return nil
+	}
+}
+
+// verticalSystem holds the connections between vertically neighboring
+// grid cells.
+type verticalSystem struct {
+	// cells are ordered so that each cell's parent comes before it.
+	cells []*Cell
+
+	// parent is the index in cells of the parent of each cell,
+	// or -1 for the cells at the base of each tree.
+	parent []int
+
+	// lower is the lower of each cell and its parent, and above is the
+	// index of the upper cell in lower.above.
+	lower []*Cell
+	above []int
+}
+
+// newVerticalSystem finds the trees of vertically connected cells.
+func newVerticalSystem(cells []*Cell) (*verticalSystem, error) {
+	s := &verticalSystem{
+		cells:  make([]*Cell, 0, len(cells)),
+		parent: make([]int, 0, len(cells)),
+		lower:  make([]*Cell, 0, len(cells)),
+		above:  make([]int, 0, len(cells)),
+	}
+	visited := make(map[*Cell]bool, len(cells))
+	for _, root := range cells {
+		if visited[root] {
+			continue
+		}
+		visited[root] = true
+		s.cells = append(s.cells, root)
+		s.parent = append(s.parent, -1)
+		s.lower = append(s.lower, nil)
+		s.above = append(s.above, -1)
+		// Breadth-first search
+		for k := len(s.cells) - 1; k < len(s.cells); k++ {
+			c := s.cells[k]
+			add := func(nb, lower *Cell, i int) error {
+				if nb.boundary || (s.parent[k] >= 0 && nb == s.cells[s.parent[k]]) {
+					return nil
+				}
+				if visited[nb] {
+					return fmt.Errorf("inmap: the grid cell at %+v is connected vertically to "+
+						"another cell in more than one way, which is not supported by "+
+						"ImplicitVerticalDiffusion", nb.Centroid())
+				}
+				visited[nb] = true
+				s.cells = append(s.cells, nb)
+				s.parent = append(s.parent, k)
+				s.lower = append(s.lower, lower)
+				s.above = append(s.above, i)
+				return nil
+			}
+			for i, a := range c.above {
+				if err := add(a, c, i); err != nil {
+					return nil, err
+				}
+			}
+			for _, b := range c.below {
+				if b.boundary || b == c { // Cells in the ground layer are below themselves.
+					continue
+				}
+				i := -1
+				for j, a := range b.above {
+					if a == c {
+						i = j
+						break
+					}
+				}
+				if i < 0 {
+					return nil, fmt.Errorf("inmap: the grid cell at %+v is not above "+
+						"the cell below it", c.Centroid())
+				}
+				if err := add(b, b, i); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// verticalTransfer returns the vertical diffusion rate [m³/s] between cell c
+// and cell c.above[i]. Because the grid is nested, the area of the interface
+// between the cells is the area of the smaller cell.
+func (c *Cell) verticalTransfer(i int) float64 {
+	a := c.above[i]
+	return c.kzzAbove[i] / c.dzPlusHalf[i] * min(c.Dx*c.Dy, a.Dx*a.Dy)
+}
+
+// solve calculates vertical diffusion over time step Δt using the θ method.
+func (s *verticalSystem) solve(θ, Δt float64) {
+	n := len(s.cells)
+	t := make([]float64, n)    // transfer rate to parent
+	diag := make([]float64, n) // eliminated diagonal
+	tSum := make([]float64, n) // total transfer rate to neighbors
+	tTop := make([]float64, n) // transfer rate to the top boundary
+	for k, c := range s.cells {
+		if s.parent[k] >= 0 {
+			t[k] = s.lower[k].verticalTransfer(s.above[k])
+			tSum[k] += t[k]
+			tSum[s.parent[k]] += t[k]
+		}
+		for i, a := range c.above {
+			if a.boundary {
+				tTop[k] += c.verticalTransfer(i)
+			}
+		}
+	}
+	for k, c := range s.cells {
+		diag[k] = c.Volume + θ*Δt*(tSum[k]+tTop[k])
+	}
+	// Eliminate the cells from the ends of the branches toward the base.
+	for k := n - 1; k >= 0; k-- {
+		if p := s.parent[k]; p >= 0 {
+			w := θ * Δt * t[k]
+			diag[p] -= w * w / diag[k]
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(PolNames))
+	for ii := range PolNames {
+		go func(ii int) {
+			defer wg.Done()
+			b := make([]float64, n)
+			for k, c := range s.cells {
+				b[k] = c.Volume * c.Cf[ii]
+				if tTop[k] == 0 {
+					continue
+				}
+				b[k] -= (1 - θ) * Δt * tTop[k] * c.Cf[ii]
+				// Inflow from the top boundary. The boundary concentrations
+				// are fixed, so the implicit (θ) and explicit (1-θ) parts
+				// of the inflow, θ·Δt·T·Ci and (1-θ)·Δt·T·Ci, add up to Δt·T·Ci.
+				for i, a := range c.above {
+					if a.boundary {
+						b[k] += Δt * c.verticalTransfer(i) * a.Ci[ii]
+					}
+				}
+			}
+			for k, c := range s.cells {
+				if p := s.parent[k]; p >= 0 {
+					f := (1 - θ) * Δt * t[k] * (s.cells[p].Cf[ii] - c.Cf[ii])
+					b[k] += f
+					b[p] -= f
+				}
+			}
+			for k := n - 1; k >= 0; k-- {
+				if p := s.parent[k]; p >= 0 {
+					b[p] += θ * Δt * t[k] * b[k] / diag[k]
+				}
+			}
+			x := make([]float64, n)
+			for k := range s.cells {
+				x[k] = b[k]
+				if p := s.parent[k]; p >= 0 {
+					x[k] += θ * Δt * t[k] * x[p]
+				}
+				x[k] /= diag[k]
+			}
+			for k, c := range s.cells {
+				if tTop[k] != 0 {
+					// Keep track of mass that leaves the domain; inflow
+					// is counted as negative outflow.
+					for i, a := range c.above {
+						if a.boundary {
+							a.Cf[ii] += Δt * c.verticalTransfer(i) *
+								(θ*x[k] + (1-θ)*c.Cf[ii] - a.Ci[ii]) / a.Volume
+						}
+					}
+				}
+				c.Cf[ii] = x[k]
+			}
+		}(ii)
+	}
+	wg.Wait()
+}
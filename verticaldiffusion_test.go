@@ -0,0 +1,215 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// Test whether mass is conserved by implicit vertical diffusion with
+// a time step much longer than the explicit stability limit.
+func TestImplicitVerticalDiffusion(t *testing.T) {
+	const (
+		testTolerance = 1.e-8
+		numTimesteps  = 5
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.LineString{
+			geom.Point{X: -3999, Y: -3999.},
+			geom.Point{X: -3500, Y: -3500.},
+		},
+	}) // ground level emissions
+
+	for _, θ := range []float64{1, 0.5} {
+		var explicitDt float64
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+				cfg.MutateGrid(PopulationMutator(cfg, popIndices), ctmdata, pop, mr, emis),
+				SetTimestepCFL(),
+				func(d *InMAP) error {
+					explicitDt = d.Dt
+					return nil
+				},
+				SetTimestepCFLNoVerticalDiffusion(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				ImplicitVerticalDiffusion(θ),
+				SteadyStateConvergenceCheck(numTimesteps, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if d.Dt < explicitDt {
+			t.Errorf("θ=%g: time step %g should not be shorter than explicit time step %g",
+				θ, d.Dt, explicitDt)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := 0.
+		var aboveGround float64
+		for _, group := range [][]*Cell{d.cells, d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary} {
+			for _, c := range group {
+				sum += c.Cf[iPM2_5] * c.Volume
+				if c.Layer > 0 {
+					aboveGround += c.Cf[iPM2_5] * c.Volume
+				}
+				if θ == 1 && c.Cf[iPM2_5] < 0 {
+					t.Errorf("θ=%g: negative concentration %g", θ, c.Cf[iPM2_5])
+				}
+			}
+		}
+		expectedMass := 0.
+		for _, c := range d.cells {
+			expectedMass += c.EmisFlux[iPM2_5] * c.Volume * d.Dt * numTimesteps
+		}
+		if different(sum, expectedMass, testTolerance) {
+			t.Errorf("θ=%g: sum=%g (it should equal %g)\n", θ, sum, expectedMass)
+		}
+		if aboveGround <= 0 {
+			t.Errorf("θ=%g: no mass was mixed above the ground layer", θ)
+		}
+	}
+}
+
+// With a short time step, implicit vertical diffusion should give
+// nearly the same results as explicit vertical diffusion.
+func TestImplicitVerticalDiffusionExplicit(t *testing.T) {
+	const (
+		testTolerance = 1.e-3
+		numTimesteps  = 10
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		PM25: E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	shortTimestep := func(d *InMAP) error {
+		d.Dt /= 100
+		return nil
+	}
+	explicit := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+			shortTimestep,
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(Mixing()),
+			SteadyStateConvergenceCheck(numTimesteps, nil),
+		},
+	}
+	implicit := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, emis),
+			SetTimestepCFL(),
+			shortTimestep,
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(MixingNoVerticalDiffusion()),
+			ImplicitVerticalDiffusion(0.5),
+			SteadyStateConvergenceCheck(numTimesteps, nil),
+		},
+	}
+	for _, d := range []*InMAP{explicit, implicit} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var diff, total float64
+	for i, c := range explicit.cells {
+		diff += math.Abs(c.Cf[iPM2_5]-implicit.cells[i].Cf[iPM2_5]) * c.Volume
+		total += c.Cf[iPM2_5] * c.Volume
+	}
+	if diff/total > testTolerance {
+		t.Errorf("relative difference %g between explicit and implicit vertical "+
+			"diffusion is too large", diff/total)
+	}
+}
+
+// Mass should flow in from a top boundary with a nonzero concentration
+// and be counted as negative outflow.
+func TestImplicitVerticalDiffusionTopBoundary(t *testing.T) {
+	const (
+		testTolerance = 1.e-8
+		numTimesteps  = 5
+		topConc       = 1. // μg/m³
+	)
+
+	cfg, ctmdata, pop, popIndices, mr := VarGridData()
+	bc := func(face string, _, _ *Cell) []float64 {
+		o := make([]float64, len(PolNames))
+		if face == "top" {
+			o[iPM2_5] = topConc
+		}
+		return o
+	}
+	for _, θ := range []float64{1, 0.5} {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, NewEmissions()),
+				SetBoundaryConditions(bc),
+				SetTimestepCFLNoVerticalDiffusion(),
+			},
+			RunFuncs: []DomainManipulator{
+				ImplicitVerticalDiffusion(θ),
+				SteadyStateConvergenceCheck(numTimesteps, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		b := d.MassBudget()
+		if b.InDomain[iPM2_5] <= 0 {
+			t.Errorf("θ=%g: no mass entered through the top boundary", θ)
+		}
+		if absDifferent(b.InDomain[iPM2_5], -b.Top[iPM2_5], testTolerance*b.InDomain[iPM2_5]) {
+			t.Errorf("θ=%g: mass in domain %g != inflow %g", θ, b.InDomain[iPM2_5], -b.Top[iPM2_5])
+		}
+		for _, c := range d.cells {
+			if θ == 1 && (c.Cf[iPM2_5] < 0 || c.Cf[iPM2_5] > topConc*(1+testTolerance)) {
+				t.Errorf("θ=%g: concentration %g is outside of [0, %g]", θ, c.Cf[iPM2_5], topConc)
+				break
+			}
+		}
+	}
+}
@@ -76,6 +76,20 @@ func (d *InMAP) OutputOptions() (names []string, descriptions []string, units []
 	}
 	descriptions = append(descriptions, tempDeaths...)
 
+	// Health impacts.
+	var tempHealth []string
+	for n := range d.healthImpacts {
+		tempHealth = append(tempHealth, n)
+	}
+	sort.Strings(tempHealth)
+	names = append(names, tempHealth...)
+	descriptions = append(descriptions, tempHealth...)
+
+	// Damages.
+	tempDamages := d.damagesNames()
+	names = append(names, tempDamages...)
+	descriptions = append(descriptions, tempDamages...)
+
 	// Emissions.
 	var tempEmis []string
 	for pol := range emisLabels {
@@ -85,6 +99,15 @@ func (d *InMAP) OutputOptions() (names []string, descriptions []string, units []
 	names = append(names, tempEmis...)
 	descriptions = append(descriptions, tempEmis...)
 
+	// Deposition.
+	var tempDep []string
+	for pol := range depositionLabels {
+		tempDep = append(tempDep, pol)
+	}
+	sort.Strings(tempDep)
+	names = append(names, tempDep...)
+	descriptions = append(descriptions, tempDep...)
+
 	// Eveything else
 	t := reflect.TypeOf(*d.cells[0])
 	var tempNames []string
@@ -304,7 +327,7 @@ func (d *InMAP) VerticalProfile(variable string, p geom.Point) (height, vals []f
 	}
 	i := 0
 	for !c.boundary {
-		vals[i] = c.getValue(variable, d.popIndices)
+		vals[i] = d.value(c, variable)
 		height[i] = c.LayerHeight + c.Dz/2.
 		c = c.above[0]
 		i++
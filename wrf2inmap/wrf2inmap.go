@@ -255,6 +255,11 @@ func main() {
 	glwChan := make(chan *sparse.DenseArray)
 	qrainChan2 := make(chan *sparse.DenseArray)
 	pblhChan2 := make(chan *sparse.DenseArray)
+	tChanRH := make(chan *sparse.DenseArray)
+	pbChanRH := make(chan *sparse.DenseArray)
+	pChanRH := make(chan *sparse.DenseArray)
+	qVaporChan := make(chan *sparse.DenseArray)
+	go relativeHumidity(tChanRH, pbChanRH, pChanRH, qVaporChan)
 	go StabilityMixingChemistry(layerHeights, pblhChan2,
 		ustarChan, altChanMixing,
 		Tchan, PBchan, Pchan, surfaceHeatFluxChan, hoChan, h2o2Chan,
@@ -273,8 +278,9 @@ func main() {
 		readSingleVar("HFX", surfaceHeatFluxChan),
 		readSingleVar("UST", ustarChan),
 		readSingleVar("PBLH", pblhChan2),
-		readSingleVar("T", Tchan), readSingleVar("PB", PBchan),
-		readSingleVar("P", Pchan), readSingleVar("ho", hoChan),
+		readSingleVar("T", Tchan, tChanRH), readSingleVar("PB", PBchan, pbChanRH),
+		readSingleVar("P", Pchan, pChanRH), readSingleVar("QVAPOR", qVaporChan),
+		readSingleVar("ho", hoChan),
 		readSingleVar("h2o2", h2o2Chan),
 		readSingleVar("LU_INDEX", luIndexChan),
 		readSingleVar("QRAIN", qrainChan, qrainChan2),
@@ -333,6 +339,10 @@ func main() {
 	VOCDryDep := <-Tchan
 	Kxxyy := <-Tchan
 
+	// average relative humidity
+	tChanRH <- nil
+	relHumidity := <-tChanRH
+
 	// average total pm2.5
 	totalpm25Chan <- nil
 	totalpm25 := <-totalpm25Chan
@@ -404,7 +414,7 @@ func main() {
 		"Average concentration of nitrogen fraction of particulate ammonium",
 		"ug m-3", pNH)
 	data.AddVariable("NO_NO2partitioning", []string{"z", "y", "x"},
-		"Mass fraction of N in NOx that exists as NO.", "fraction",
+		"Mass fraction of N in NOx that exists as NO2.", "fraction",
 		NONO2partitioning)
 	data.AddVariable("SO2oxidation", []string{"z", "y", "x"},
 		"Rate of SO2 oxidation to SO4 by hydroxyl radical and H2O2",
@@ -450,6 +460,8 @@ func main() {
 		"RMS wind speed^(-1.4)", "(m s-1)^(-1.4)", windSpeedMinusOnePointFour)
 	data.AddVariable("Temperature", []string{"z", "y", "x"},
 		"Average Temperature", "K", temperature)
+	data.AddVariable("RelativeHumidity", []string{"z", "y", "x"},
+		"Average relative humidity", "fraction", relHumidity)
 	data.AddVariable("S1", []string{"z", "y", "x"},
 		"Stability parameter", "?", S1)
 	data.AddVariable("Sclass", []string{"z", "y", "x"},
@@ -707,6 +719,45 @@ func average(datachan chan *sparse.DenseArray) {
 	}
 }
 
+// relativeHumidity calculates the average relative humidity (as a
+// fraction) from the perturbation potential temperature,
+// the base state and perturbation pressure, and the water vapor mixing ratio.
+func relativeHumidity(Tchan, PBchan, Pchan, qVaporChan chan *sparse.DenseArray) {
+	const (
+		po    = 101300. // Pa, reference pressure
+		kappa = 0.2854  // related to von karman's constant
+		ε     = 0.622   // ratio of molecular weights of water and dry air
+	)
+	var rh *sparse.DenseArray
+	firstData := true
+	for {
+		T := <-Tchan // K, perturbation potential temperature
+		if T == nil {
+			for i, val := range rh.Elements {
+				rh.Elements[i] = val / numTsteps
+			}
+			Tchan <- rh
+			return
+		}
+		PB := <-PBchan         // Pa
+		P := <-Pchan           // Pa
+		qVapor := <-qVaporChan // kg/kg
+		if firstData {
+			rh = sparse.ZerosDense(T.Shape...)
+			firstData = false
+		}
+		for i, θ := range T.Elements {
+			p := P.Elements[i] + PB.Elements[i]
+			t := (θ + 300.) * math.Pow(p/po, kappa) // K
+			// Saturation vapor pressure [Pa] (Bolton, 1980)
+			es := 611.2 * math.Exp(17.67*(t-273.15)/(t-29.65))
+			q := qVapor.Elements[i]
+			e := q * p / (ε + q) // vapor pressure [Pa]
+			rh.Elements[i] += math.Min(e/es, 1)
+		}
+	}
+}
+
 // calcLayerHeights calculates the heights above the ground
 // of the layers (in meters).
 // For more information, refer to